@@ -66,9 +66,17 @@ func (x *CreateRequest) GetHost() string {
 }
 
 type CreateResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	SessionId     string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
-	FrontendUrl   string                 `protobuf:"bytes,2,opt,name=frontend_url,json=frontendUrl,proto3" json:"frontend_url,omitempty"`
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	SessionId string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	// frontend_url is the host's own link, which makes its browser the
+	// session's owner. editor_url and viewer_url are the links to share with
+	// people who may use the terminals and people who may only watch.
+	FrontendUrl string `protobuf:"bytes,2,opt,name=frontend_url,json=frontendUrl,proto3" json:"frontend_url,omitempty"`
+	// agent_secret must be sent in every InitialAgentMessage for the session,
+	// so only the agent that created it can serve it.
+	AgentSecret   string `protobuf:"bytes,3,opt,name=agent_secret,json=agentSecret,proto3" json:"agent_secret,omitempty"`
+	EditorUrl     string `protobuf:"bytes,4,opt,name=editor_url,json=editorUrl,proto3" json:"editor_url,omitempty"`
+	ViewerUrl     string `protobuf:"bytes,5,opt,name=viewer_url,json=viewerUrl,proto3" json:"viewer_url,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -117,7 +125,27 @@ func (x *CreateResponse) GetFrontendUrl() string {
 	return ""
 }
 
-// --- Messages from Agent (Client) to Server ---
+func (x *CreateResponse) GetAgentSecret() string {
+	if x != nil {
+		return x.AgentSecret
+	}
+	return ""
+}
+
+func (x *CreateResponse) GetEditorUrl() string {
+	if x != nil {
+		return x.EditorUrl
+	}
+	return ""
+}
+
+func (x *CreateResponse) GetViewerUrl() string {
+	if x != nil {
+		return x.ViewerUrl
+	}
+	return ""
+}
+
 type ClientUpdate struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	// Types that are valid to be assigned to Payload:
@@ -126,6 +154,11 @@ type ClientUpdate struct {
 	//	*ClientUpdate_PtyOutput
 	//	*ClientUpdate_TerminalCreatedResponse
 	//	*ClientUpdate_TerminalError
+	//	*ClientUpdate_TerminalExited
+	//	*ClientUpdate_Pong
+	//	*ClientUpdate_InputCredit
+	//	*ClientUpdate_HostResize
+	//	*ClientUpdate_Notice
 	Payload       isClientUpdate_Payload `protobuf_oneof:"payload"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -204,6 +237,51 @@ func (x *ClientUpdate) GetTerminalError() *TerminalError {
 	return nil
 }
 
+func (x *ClientUpdate) GetTerminalExited() *TerminalExited {
+	if x != nil {
+		if x, ok := x.Payload.(*ClientUpdate_TerminalExited); ok {
+			return x.TerminalExited
+		}
+	}
+	return nil
+}
+
+func (x *ClientUpdate) GetPong() *Heartbeat {
+	if x != nil {
+		if x, ok := x.Payload.(*ClientUpdate_Pong); ok {
+			return x.Pong
+		}
+	}
+	return nil
+}
+
+func (x *ClientUpdate) GetInputCredit() *FlowCredit {
+	if x != nil {
+		if x, ok := x.Payload.(*ClientUpdate_InputCredit); ok {
+			return x.InputCredit
+		}
+	}
+	return nil
+}
+
+func (x *ClientUpdate) GetHostResize() *TerminalResize {
+	if x != nil {
+		if x, ok := x.Payload.(*ClientUpdate_HostResize); ok {
+			return x.HostResize
+		}
+	}
+	return nil
+}
+
+func (x *ClientUpdate) GetNotice() *AgentNotice {
+	if x != nil {
+		if x, ok := x.Payload.(*ClientUpdate_Notice); ok {
+			return x.Notice
+		}
+	}
+	return nil
+}
+
 type isClientUpdate_Payload interface {
 	isClientUpdate_Payload()
 }
@@ -217,13 +295,40 @@ type ClientUpdate_PtyOutput struct {
 }
 
 type ClientUpdate_TerminalCreatedResponse struct {
-	TerminalCreatedResponse *TerminalCreatedResponse `protobuf:"bytes,3,opt,name=terminal_created_response,json=terminalCreatedResponse,proto3,oneof"` // Agent confirms terminal creation
+	TerminalCreatedResponse *TerminalCreatedResponse `protobuf:"bytes,3,opt,name=terminal_created_response,json=terminalCreatedResponse,proto3,oneof"`
 }
 
 type ClientUpdate_TerminalError struct {
 	TerminalError *TerminalError `protobuf:"bytes,4,opt,name=terminal_error,json=terminalError,proto3,oneof"`
 }
 
+type ClientUpdate_TerminalExited struct {
+	TerminalExited *TerminalExited `protobuf:"bytes,5,opt,name=terminal_exited,json=terminalExited,proto3,oneof"`
+}
+
+type ClientUpdate_Pong struct {
+	Pong *Heartbeat `protobuf:"bytes,6,opt,name=pong,proto3,oneof"`
+}
+
+type ClientUpdate_InputCredit struct {
+	// Input bytes the agent has written to a PTY, returning them to the
+	// backend's input window for that terminal.
+	InputCredit *FlowCredit `protobuf:"bytes,7,opt,name=input_credit,json=inputCredit,proto3,oneof"`
+}
+
+type ClientUpdate_HostResize struct {
+	// The size of the window the agent's host is using the terminal in
+	// locally. The backend counts it like one more viewer's and answers
+	// with a resize when the terminal's size changes.
+	HostResize *TerminalResize `protobuf:"bytes,8,opt,name=host_resize,json=hostResize,proto3,oneof"`
+}
+
+type ClientUpdate_Notice struct {
+	// Warns the session that the agent is about to end it, or that it no
+	// longer is.
+	Notice *AgentNotice `protobuf:"bytes,9,opt,name=notice,proto3,oneof"`
+}
+
 func (*ClientUpdate_InitialMessage) isClientUpdate_Payload() {}
 
 func (*ClientUpdate_PtyOutput) isClientUpdate_Payload() {}
@@ -232,6 +337,88 @@ func (*ClientUpdate_TerminalCreatedResponse) isClientUpdate_Payload() {}
 
 func (*ClientUpdate_TerminalError) isClientUpdate_Payload() {}
 
+func (*ClientUpdate_TerminalExited) isClientUpdate_Payload() {}
+
+func (*ClientUpdate_Pong) isClientUpdate_Payload() {}
+
+func (*ClientUpdate_InputCredit) isClientUpdate_Payload() {}
+
+func (*ClientUpdate_HostResize) isClientUpdate_Payload() {}
+
+func (*ClientUpdate_Notice) isClientUpdate_Payload() {}
+
+// AgentNotice announces that the agent will shut down at deadline_unix_ms
+// because of one of its policies, such as its idle timeout. A notice with
+// no reason withdraws the last one. final is set when the agent is
+// shutting down now, so the backend need not wait for it to come back.
+type AgentNotice struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Reason         string                 `protobuf:"bytes,1,opt,name=reason,proto3" json:"reason,omitempty"`
+	Message        string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	DeadlineUnixMs int64                  `protobuf:"varint,3,opt,name=deadline_unix_ms,json=deadlineUnixMs,proto3" json:"deadline_unix_ms,omitempty"`
+	Final          bool                   `protobuf:"varint,4,opt,name=final,proto3" json:"final,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *AgentNotice) Reset() {
+	*x = AgentNotice{}
+	mi := &file_api_proto_shellsync_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentNotice) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentNotice) ProtoMessage() {}
+
+func (x *AgentNotice) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_shellsync_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentNotice.ProtoReflect.Descriptor instead.
+func (*AgentNotice) Descriptor() ([]byte, []int) {
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *AgentNotice) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *AgentNotice) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *AgentNotice) GetDeadlineUnixMs() int64 {
+	if x != nil {
+		return x.DeadlineUnixMs
+	}
+	return 0
+}
+
+func (x *AgentNotice) GetFinal() bool {
+	if x != nil {
+		return x.Final
+	}
+	return false
+}
+
 type TerminalError struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	TerminalId    string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
@@ -242,7 +429,7 @@ type TerminalError struct {
 
 func (x *TerminalError) Reset() {
 	*x = TerminalError{}
-	mi := &file_api_proto_shellsync_proto_msgTypes[3]
+	mi := &file_api_proto_shellsync_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -254,7 +441,7 @@ func (x *TerminalError) String() string {
 func (*TerminalError) ProtoMessage() {}
 
 func (x *TerminalError) ProtoReflect() protoreflect.Message {
-	mi := &file_api_proto_shellsync_proto_msgTypes[3]
+	mi := &file_api_proto_shellsync_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -267,7 +454,7 @@ func (x *TerminalError) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TerminalError.ProtoReflect.Descriptor instead.
 func (*TerminalError) Descriptor() ([]byte, []int) {
-	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{3}
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *TerminalError) GetTerminalId() string {
@@ -285,15 +472,27 @@ func (x *TerminalError) GetError() string {
 }
 
 type InitialAgentMessage struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	SessionId     string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	SessionId string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	// Set when the agent reconnects to a session it was already serving;
+	// terminal_ids then lists the terminals it still has open.
+	Resume      bool     `protobuf:"varint,2,opt,name=resume,proto3" json:"resume,omitempty"`
+	TerminalIds []string `protobuf:"bytes,3,rep,name=terminal_ids,json=terminalIds,proto3" json:"terminal_ids,omitempty"`
+	// Flow control windows, per terminal and in bytes. The agent sends at most
+	// output_window bytes of output the backend has not credited back, and
+	// accepts at most input_window bytes of input it has not credited back.
+	// Zero means the agent does not do flow control in that direction.
+	OutputWindow uint32 `protobuf:"varint,4,opt,name=output_window,json=outputWindow,proto3" json:"output_window,omitempty"`
+	InputWindow  uint32 `protobuf:"varint,5,opt,name=input_window,json=inputWindow,proto3" json:"input_window,omitempty"`
+	// agent_secret is the secret CreateResponse returned for the session.
+	AgentSecret   string `protobuf:"bytes,6,opt,name=agent_secret,json=agentSecret,proto3" json:"agent_secret,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *InitialAgentMessage) Reset() {
 	*x = InitialAgentMessage{}
-	mi := &file_api_proto_shellsync_proto_msgTypes[4]
+	mi := &file_api_proto_shellsync_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -305,7 +504,7 @@ func (x *InitialAgentMessage) String() string {
 func (*InitialAgentMessage) ProtoMessage() {}
 
 func (x *InitialAgentMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_api_proto_shellsync_proto_msgTypes[4]
+	mi := &file_api_proto_shellsync_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -318,7 +517,7 @@ func (x *InitialAgentMessage) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use InitialAgentMessage.ProtoReflect.Descriptor instead.
 func (*InitialAgentMessage) Descriptor() ([]byte, []int) {
-	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{4}
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *InitialAgentMessage) GetSessionId() string {
@@ -328,6 +527,41 @@ func (x *InitialAgentMessage) GetSessionId() string {
 	return ""
 }
 
+func (x *InitialAgentMessage) GetResume() bool {
+	if x != nil {
+		return x.Resume
+	}
+	return false
+}
+
+func (x *InitialAgentMessage) GetTerminalIds() []string {
+	if x != nil {
+		return x.TerminalIds
+	}
+	return nil
+}
+
+func (x *InitialAgentMessage) GetOutputWindow() uint32 {
+	if x != nil {
+		return x.OutputWindow
+	}
+	return 0
+}
+
+func (x *InitialAgentMessage) GetInputWindow() uint32 {
+	if x != nil {
+		return x.InputWindow
+	}
+	return 0
+}
+
+func (x *InitialAgentMessage) GetAgentSecret() string {
+	if x != nil {
+		return x.AgentSecret
+	}
+	return ""
+}
+
 type TerminalOutput struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	TerminalId    string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
@@ -338,7 +572,7 @@ type TerminalOutput struct {
 
 func (x *TerminalOutput) Reset() {
 	*x = TerminalOutput{}
-	mi := &file_api_proto_shellsync_proto_msgTypes[5]
+	mi := &file_api_proto_shellsync_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -350,7 +584,7 @@ func (x *TerminalOutput) String() string {
 func (*TerminalOutput) ProtoMessage() {}
 
 func (x *TerminalOutput) ProtoReflect() protoreflect.Message {
-	mi := &file_api_proto_shellsync_proto_msgTypes[5]
+	mi := &file_api_proto_shellsync_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -363,7 +597,7 @@ func (x *TerminalOutput) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TerminalOutput.ProtoReflect.Descriptor instead.
 func (*TerminalOutput) Descriptor() ([]byte, []int) {
-	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{5}
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *TerminalOutput) GetTerminalId() string {
@@ -381,15 +615,18 @@ func (x *TerminalOutput) GetData() []byte {
 }
 
 type TerminalCreatedResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	TerminalId    string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	TerminalId string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
+	// read_only terminals take no input, signals or close requests from
+	// viewers, such as the command of `shellsync run`.
+	ReadOnly      bool `protobuf:"varint,2,opt,name=read_only,json=readOnly,proto3" json:"read_only,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *TerminalCreatedResponse) Reset() {
 	*x = TerminalCreatedResponse{}
-	mi := &file_api_proto_shellsync_proto_msgTypes[6]
+	mi := &file_api_proto_shellsync_proto_msgTypes[7]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -401,7 +638,7 @@ func (x *TerminalCreatedResponse) String() string {
 func (*TerminalCreatedResponse) ProtoMessage() {}
 
 func (x *TerminalCreatedResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_api_proto_shellsync_proto_msgTypes[6]
+	mi := &file_api_proto_shellsync_proto_msgTypes[7]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -414,7 +651,7 @@ func (x *TerminalCreatedResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TerminalCreatedResponse.ProtoReflect.Descriptor instead.
 func (*TerminalCreatedResponse) Descriptor() ([]byte, []int) {
-	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{6}
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *TerminalCreatedResponse) GetTerminalId() string {
@@ -424,6 +661,75 @@ func (x *TerminalCreatedResponse) GetTerminalId() string {
 	return ""
 }
 
+func (x *TerminalCreatedResponse) GetReadOnly() bool {
+	if x != nil {
+		return x.ReadOnly
+	}
+	return false
+}
+
+type TerminalExited struct {
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	TerminalId string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
+	// Exit code of the shell, or -1 when it was terminated by a signal.
+	ExitCode int32 `protobuf:"varint,2,opt,name=exit_code,json=exitCode,proto3" json:"exit_code,omitempty"`
+	// Name of the terminating signal, empty for a normal exit.
+	Signal        string `protobuf:"bytes,3,opt,name=signal,proto3" json:"signal,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TerminalExited) Reset() {
+	*x = TerminalExited{}
+	mi := &file_api_proto_shellsync_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TerminalExited) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TerminalExited) ProtoMessage() {}
+
+func (x *TerminalExited) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_shellsync_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TerminalExited.ProtoReflect.Descriptor instead.
+func (*TerminalExited) Descriptor() ([]byte, []int) {
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *TerminalExited) GetTerminalId() string {
+	if x != nil {
+		return x.TerminalId
+	}
+	return ""
+}
+
+func (x *TerminalExited) GetExitCode() int32 {
+	if x != nil {
+		return x.ExitCode
+	}
+	return 0
+}
+
+func (x *TerminalExited) GetSignal() string {
+	if x != nil {
+		return x.Signal
+	}
+	return ""
+}
+
 type ServerUpdate struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	// Types that are valid to be assigned to Payload:
@@ -431,6 +737,12 @@ type ServerUpdate struct {
 	//	*ServerUpdate_ServerHello
 	//	*ServerUpdate_PtyInput
 	//	*ServerUpdate_CreateTerminalRequest
+	//	*ServerUpdate_Resize
+	//	*ServerUpdate_CloseTerminalRequest
+	//	*ServerUpdate_Signal
+	//	*ServerUpdate_Ping
+	//	*ServerUpdate_OutputCredit
+	//	*ServerUpdate_Participants
 	Payload       isServerUpdate_Payload `protobuf_oneof:"payload"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -438,7 +750,7 @@ type ServerUpdate struct {
 
 func (x *ServerUpdate) Reset() {
 	*x = ServerUpdate{}
-	mi := &file_api_proto_shellsync_proto_msgTypes[7]
+	mi := &file_api_proto_shellsync_proto_msgTypes[9]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -450,7 +762,7 @@ func (x *ServerUpdate) String() string {
 func (*ServerUpdate) ProtoMessage() {}
 
 func (x *ServerUpdate) ProtoReflect() protoreflect.Message {
-	mi := &file_api_proto_shellsync_proto_msgTypes[7]
+	mi := &file_api_proto_shellsync_proto_msgTypes[9]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -463,7 +775,7 @@ func (x *ServerUpdate) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ServerUpdate.ProtoReflect.Descriptor instead.
 func (*ServerUpdate) Descriptor() ([]byte, []int) {
-	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{7}
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{9}
 }
 
 func (x *ServerUpdate) GetPayload() isServerUpdate_Payload {
@@ -500,6 +812,60 @@ func (x *ServerUpdate) GetCreateTerminalRequest() *CreateTerminalRequest {
 	return nil
 }
 
+func (x *ServerUpdate) GetResize() *TerminalResize {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerUpdate_Resize); ok {
+			return x.Resize
+		}
+	}
+	return nil
+}
+
+func (x *ServerUpdate) GetCloseTerminalRequest() *CloseTerminalRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerUpdate_CloseTerminalRequest); ok {
+			return x.CloseTerminalRequest
+		}
+	}
+	return nil
+}
+
+func (x *ServerUpdate) GetSignal() *SignalRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerUpdate_Signal); ok {
+			return x.Signal
+		}
+	}
+	return nil
+}
+
+func (x *ServerUpdate) GetPing() *Heartbeat {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerUpdate_Ping); ok {
+			return x.Ping
+		}
+	}
+	return nil
+}
+
+func (x *ServerUpdate) GetOutputCredit() *FlowCredit {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerUpdate_OutputCredit); ok {
+			return x.OutputCredit
+		}
+	}
+	return nil
+}
+
+func (x *ServerUpdate) GetParticipants() *Participants {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerUpdate_Participants); ok {
+			return x.Participants
+		}
+	}
+	return nil
+}
+
 type isServerUpdate_Payload interface {
 	isServerUpdate_Payload()
 }
@@ -516,15 +882,55 @@ type ServerUpdate_CreateTerminalRequest struct {
 	CreateTerminalRequest *CreateTerminalRequest `protobuf:"bytes,3,opt,name=create_terminal_request,json=createTerminalRequest,proto3,oneof"`
 }
 
+type ServerUpdate_Resize struct {
+	Resize *TerminalResize `protobuf:"bytes,4,opt,name=resize,proto3,oneof"`
+}
+
+type ServerUpdate_CloseTerminalRequest struct {
+	CloseTerminalRequest *CloseTerminalRequest `protobuf:"bytes,5,opt,name=close_terminal_request,json=closeTerminalRequest,proto3,oneof"`
+}
+
+type ServerUpdate_Signal struct {
+	Signal *SignalRequest `protobuf:"bytes,6,opt,name=signal,proto3,oneof"`
+}
+
+type ServerUpdate_Ping struct {
+	Ping *Heartbeat `protobuf:"bytes,7,opt,name=ping,proto3,oneof"`
+}
+
+type ServerUpdate_OutputCredit struct {
+	// Output bytes every viewer has consumed, returning them to the agent's
+	// output window for that terminal.
+	OutputCredit *FlowCredit `protobuf:"bytes,8,opt,name=output_credit,json=outputCredit,proto3,oneof"`
+}
+
+type ServerUpdate_Participants struct {
+	// The browser clients in the session, sent when the agent connects and
+	// whenever someone joins or leaves.
+	Participants *Participants `protobuf:"bytes,9,opt,name=participants,proto3,oneof"`
+}
+
 func (*ServerUpdate_ServerHello) isServerUpdate_Payload() {}
 
 func (*ServerUpdate_PtyInput) isServerUpdate_Payload() {}
 
 func (*ServerUpdate_CreateTerminalRequest) isServerUpdate_Payload() {}
 
-type TerminalInput struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	TerminalId    string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
+func (*ServerUpdate_Resize) isServerUpdate_Payload() {}
+
+func (*ServerUpdate_CloseTerminalRequest) isServerUpdate_Payload() {}
+
+func (*ServerUpdate_Signal) isServerUpdate_Payload() {}
+
+func (*ServerUpdate_Ping) isServerUpdate_Payload() {}
+
+func (*ServerUpdate_OutputCredit) isServerUpdate_Payload() {}
+
+func (*ServerUpdate_Participants) isServerUpdate_Payload() {}
+
+type TerminalInput struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TerminalId    string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
 	Data          []byte                 `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -532,7 +938,7 @@ type TerminalInput struct {
 
 func (x *TerminalInput) Reset() {
 	*x = TerminalInput{}
-	mi := &file_api_proto_shellsync_proto_msgTypes[8]
+	mi := &file_api_proto_shellsync_proto_msgTypes[10]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -544,7 +950,7 @@ func (x *TerminalInput) String() string {
 func (*TerminalInput) ProtoMessage() {}
 
 func (x *TerminalInput) ProtoReflect() protoreflect.Message {
-	mi := &file_api_proto_shellsync_proto_msgTypes[8]
+	mi := &file_api_proto_shellsync_proto_msgTypes[10]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -557,7 +963,7 @@ func (x *TerminalInput) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TerminalInput.ProtoReflect.Descriptor instead.
 func (*TerminalInput) Descriptor() ([]byte, []int) {
-	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{8}
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *TerminalInput) GetTerminalId() string {
@@ -575,15 +981,22 @@ func (x *TerminalInput) GetData() []byte {
 }
 
 type CreateTerminalRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	TerminalId    string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	TerminalId string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
+	// Optional overrides. The agent falls back to $SHELL and then to its
+	// configured default shell, and may refuse overrides it does not allow.
+	Command       string            `protobuf:"bytes,2,opt,name=command,proto3" json:"command,omitempty"`
+	Args          []string          `protobuf:"bytes,3,rep,name=args,proto3" json:"args,omitempty"`
+	Cwd           string            `protobuf:"bytes,4,opt,name=cwd,proto3" json:"cwd,omitempty"`
+	Env           map[string]string `protobuf:"bytes,5,rep,name=env,proto3" json:"env,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Term          string            `protobuf:"bytes,6,opt,name=term,proto3" json:"term,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *CreateTerminalRequest) Reset() {
 	*x = CreateTerminalRequest{}
-	mi := &file_api_proto_shellsync_proto_msgTypes[9]
+	mi := &file_api_proto_shellsync_proto_msgTypes[11]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -595,7 +1008,7 @@ func (x *CreateTerminalRequest) String() string {
 func (*CreateTerminalRequest) ProtoMessage() {}
 
 func (x *CreateTerminalRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_api_proto_shellsync_proto_msgTypes[9]
+	mi := &file_api_proto_shellsync_proto_msgTypes[11]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -608,7 +1021,7 @@ func (x *CreateTerminalRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use CreateTerminalRequest.ProtoReflect.Descriptor instead.
 func (*CreateTerminalRequest) Descriptor() ([]byte, []int) {
-	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{9}
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{11}
 }
 
 func (x *CreateTerminalRequest) GetTerminalId() string {
@@ -618,50 +1031,471 @@ func (x *CreateTerminalRequest) GetTerminalId() string {
 	return ""
 }
 
+func (x *CreateTerminalRequest) GetCommand() string {
+	if x != nil {
+		return x.Command
+	}
+	return ""
+}
+
+func (x *CreateTerminalRequest) GetArgs() []string {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+func (x *CreateTerminalRequest) GetCwd() string {
+	if x != nil {
+		return x.Cwd
+	}
+	return ""
+}
+
+func (x *CreateTerminalRequest) GetEnv() map[string]string {
+	if x != nil {
+		return x.Env
+	}
+	return nil
+}
+
+func (x *CreateTerminalRequest) GetTerm() string {
+	if x != nil {
+		return x.Term
+	}
+	return ""
+}
+
+type TerminalResize struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TerminalId    string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
+	Rows          uint32                 `protobuf:"varint,2,opt,name=rows,proto3" json:"rows,omitempty"`
+	Cols          uint32                 `protobuf:"varint,3,opt,name=cols,proto3" json:"cols,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TerminalResize) Reset() {
+	*x = TerminalResize{}
+	mi := &file_api_proto_shellsync_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TerminalResize) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TerminalResize) ProtoMessage() {}
+
+func (x *TerminalResize) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_shellsync_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TerminalResize.ProtoReflect.Descriptor instead.
+func (*TerminalResize) Descriptor() ([]byte, []int) {
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *TerminalResize) GetTerminalId() string {
+	if x != nil {
+		return x.TerminalId
+	}
+	return ""
+}
+
+func (x *TerminalResize) GetRows() uint32 {
+	if x != nil {
+		return x.Rows
+	}
+	return 0
+}
+
+func (x *TerminalResize) GetCols() uint32 {
+	if x != nil {
+		return x.Cols
+	}
+	return 0
+}
+
+type CloseTerminalRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TerminalId    string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CloseTerminalRequest) Reset() {
+	*x = CloseTerminalRequest{}
+	mi := &file_api_proto_shellsync_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CloseTerminalRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CloseTerminalRequest) ProtoMessage() {}
+
+func (x *CloseTerminalRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_shellsync_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CloseTerminalRequest.ProtoReflect.Descriptor instead.
+func (*CloseTerminalRequest) Descriptor() ([]byte, []int) {
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *CloseTerminalRequest) GetTerminalId() string {
+	if x != nil {
+		return x.TerminalId
+	}
+	return ""
+}
+
+type SignalRequest struct {
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	TerminalId string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
+	// Signal name such as "SIGINT" or "INT", delivered to the foreground
+	// process group of the terminal.
+	Signal        string `protobuf:"bytes,2,opt,name=signal,proto3" json:"signal,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignalRequest) Reset() {
+	*x = SignalRequest{}
+	mi := &file_api_proto_shellsync_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignalRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignalRequest) ProtoMessage() {}
+
+func (x *SignalRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_shellsync_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignalRequest.ProtoReflect.Descriptor instead.
+func (*SignalRequest) Descriptor() ([]byte, []int) {
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *SignalRequest) GetTerminalId() string {
+	if x != nil {
+		return x.TerminalId
+	}
+	return ""
+}
+
+func (x *SignalRequest) GetSignal() string {
+	if x != nil {
+		return x.Signal
+	}
+	return ""
+}
+
+// Heartbeat is sent by the backend as a ping and echoed back unchanged by the
+// agent as a pong.
+type Heartbeat struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Seq   uint64                 `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	// Backend clock when the ping was sent, used to measure the round trip.
+	SentUnixNano int64 `protobuf:"varint,2,opt,name=sent_unix_nano,json=sentUnixNano,proto3" json:"sent_unix_nano,omitempty"`
+	// How long either side waits without hearing from the other before it
+	// gives up on the stream.
+	TimeoutMs     uint32 `protobuf:"varint,3,opt,name=timeout_ms,json=timeoutMs,proto3" json:"timeout_ms,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Heartbeat) Reset() {
+	*x = Heartbeat{}
+	mi := &file_api_proto_shellsync_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Heartbeat) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Heartbeat) ProtoMessage() {}
+
+func (x *Heartbeat) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_shellsync_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Heartbeat.ProtoReflect.Descriptor instead.
+func (*Heartbeat) Descriptor() ([]byte, []int) {
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *Heartbeat) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Heartbeat) GetSentUnixNano() int64 {
+	if x != nil {
+		return x.SentUnixNano
+	}
+	return 0
+}
+
+func (x *Heartbeat) GetTimeoutMs() uint32 {
+	if x != nil {
+		return x.TimeoutMs
+	}
+	return 0
+}
+
+// FlowCredit returns bytes to the sender's window for one terminal.
+type FlowCredit struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TerminalId    string                 `protobuf:"bytes,1,opt,name=terminal_id,json=terminalId,proto3" json:"terminal_id,omitempty"`
+	Bytes         uint32                 `protobuf:"varint,2,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FlowCredit) Reset() {
+	*x = FlowCredit{}
+	mi := &file_api_proto_shellsync_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FlowCredit) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FlowCredit) ProtoMessage() {}
+
+func (x *FlowCredit) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_shellsync_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FlowCredit.ProtoReflect.Descriptor instead.
+func (*FlowCredit) Descriptor() ([]byte, []int) {
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *FlowCredit) GetTerminalId() string {
+	if x != nil {
+		return x.TerminalId
+	}
+	return ""
+}
+
+func (x *FlowCredit) GetBytes() uint32 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+type Participants struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ClientIds     []string               `protobuf:"bytes,1,rep,name=client_ids,json=clientIds,proto3" json:"client_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Participants) Reset() {
+	*x = Participants{}
+	mi := &file_api_proto_shellsync_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Participants) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Participants) ProtoMessage() {}
+
+func (x *Participants) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_shellsync_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Participants.ProtoReflect.Descriptor instead.
+func (*Participants) Descriptor() ([]byte, []int) {
+	return file_api_proto_shellsync_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *Participants) GetClientIds() []string {
+	if x != nil {
+		return x.ClientIds
+	}
+	return nil
+}
+
 var File_api_proto_shellsync_proto protoreflect.FileDescriptor
 
 const file_api_proto_shellsync_proto_rawDesc = "" +
 	"\n" +
 	"\x19api/proto/shellsync.proto\x12\tshellsync\"#\n" +
 	"\rCreateRequest\x12\x12\n" +
-	"\x04host\x18\x01 \x01(\tR\x04host\"R\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\"\xb3\x01\n" +
 	"\x0eCreateResponse\x12\x1d\n" +
 	"\n" +
 	"session_id\x18\x01 \x01(\tR\tsessionId\x12!\n" +
-	"\ffrontend_url\x18\x02 \x01(\tR\vfrontendUrl\"\xc5\x02\n" +
+	"\ffrontend_url\x18\x02 \x01(\tR\vfrontendUrl\x12!\n" +
+	"\fagent_secret\x18\x03 \x01(\tR\vagentSecret\x12\x1d\n" +
+	"\n" +
+	"editor_url\x18\x04 \x01(\tR\teditorUrl\x12\x1d\n" +
+	"\n" +
+	"viewer_url\x18\x05 \x01(\tR\tviewerUrl\"\xe3\x04\n" +
 	"\fClientUpdate\x12I\n" +
 	"\x0finitial_message\x18\x01 \x01(\v2\x1e.shellsync.InitialAgentMessageH\x00R\x0einitialMessage\x12:\n" +
 	"\n" +
 	"pty_output\x18\x02 \x01(\v2\x19.shellsync.TerminalOutputH\x00R\tptyOutput\x12`\n" +
 	"\x19terminal_created_response\x18\x03 \x01(\v2\".shellsync.TerminalCreatedResponseH\x00R\x17terminalCreatedResponse\x12A\n" +
-	"\x0eterminal_error\x18\x04 \x01(\v2\x18.shellsync.TerminalErrorH\x00R\rterminalErrorB\t\n" +
-	"\apayload\"F\n" +
+	"\x0eterminal_error\x18\x04 \x01(\v2\x18.shellsync.TerminalErrorH\x00R\rterminalError\x12D\n" +
+	"\x0fterminal_exited\x18\x05 \x01(\v2\x19.shellsync.TerminalExitedH\x00R\x0eterminalExited\x12*\n" +
+	"\x04pong\x18\x06 \x01(\v2\x14.shellsync.HeartbeatH\x00R\x04pong\x12:\n" +
+	"\finput_credit\x18\a \x01(\v2\x15.shellsync.FlowCreditH\x00R\vinputCredit\x12<\n" +
+	"\vhost_resize\x18\b \x01(\v2\x19.shellsync.TerminalResizeH\x00R\n" +
+	"hostResize\x120\n" +
+	"\x06notice\x18\t \x01(\v2\x16.shellsync.AgentNoticeH\x00R\x06noticeB\t\n" +
+	"\apayload\"\x7f\n" +
+	"\vAgentNotice\x12\x16\n" +
+	"\x06reason\x18\x01 \x01(\tR\x06reason\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x12(\n" +
+	"\x10deadline_unix_ms\x18\x03 \x01(\x03R\x0edeadlineUnixMs\x12\x14\n" +
+	"\x05final\x18\x04 \x01(\bR\x05final\"F\n" +
 	"\rTerminalError\x12\x1f\n" +
 	"\vterminal_id\x18\x01 \x01(\tR\n" +
 	"terminalId\x12\x14\n" +
-	"\x05error\x18\x02 \x01(\tR\x05error\"4\n" +
+	"\x05error\x18\x02 \x01(\tR\x05error\"\xda\x01\n" +
 	"\x13InitialAgentMessage\x12\x1d\n" +
 	"\n" +
-	"session_id\x18\x01 \x01(\tR\tsessionId\"E\n" +
+	"session_id\x18\x01 \x01(\tR\tsessionId\x12\x16\n" +
+	"\x06resume\x18\x02 \x01(\bR\x06resume\x12!\n" +
+	"\fterminal_ids\x18\x03 \x03(\tR\vterminalIds\x12#\n" +
+	"\routput_window\x18\x04 \x01(\rR\foutputWindow\x12!\n" +
+	"\finput_window\x18\x05 \x01(\rR\vinputWindow\x12!\n" +
+	"\fagent_secret\x18\x06 \x01(\tR\vagentSecret\"E\n" +
 	"\x0eTerminalOutput\x12\x1f\n" +
 	"\vterminal_id\x18\x01 \x01(\tR\n" +
 	"terminalId\x12\x12\n" +
-	"\x04data\x18\x02 \x01(\fR\x04data\":\n" +
+	"\x04data\x18\x02 \x01(\fR\x04data\"W\n" +
 	"\x17TerminalCreatedResponse\x12\x1f\n" +
 	"\vterminal_id\x18\x01 \x01(\tR\n" +
-	"terminalId\"\xd3\x01\n" +
+	"terminalId\x12\x1b\n" +
+	"\tread_only\x18\x02 \x01(\bR\breadOnly\"f\n" +
+	"\x0eTerminalExited\x12\x1f\n" +
+	"\vterminal_id\x18\x01 \x01(\tR\n" +
+	"terminalId\x12\x1b\n" +
+	"\texit_code\x18\x02 \x01(\x05R\bexitCode\x12\x16\n" +
+	"\x06signal\x18\x03 \x01(\tR\x06signal\"\xbe\x04\n" +
 	"\fServerUpdate\x12#\n" +
 	"\fserver_hello\x18\x01 \x01(\tH\x00R\vserverHello\x127\n" +
 	"\tpty_input\x18\x02 \x01(\v2\x18.shellsync.TerminalInputH\x00R\bptyInput\x12Z\n" +
-	"\x17create_terminal_request\x18\x03 \x01(\v2 .shellsync.CreateTerminalRequestH\x00R\x15createTerminalRequestB\t\n" +
+	"\x17create_terminal_request\x18\x03 \x01(\v2 .shellsync.CreateTerminalRequestH\x00R\x15createTerminalRequest\x123\n" +
+	"\x06resize\x18\x04 \x01(\v2\x19.shellsync.TerminalResizeH\x00R\x06resize\x12W\n" +
+	"\x16close_terminal_request\x18\x05 \x01(\v2\x1f.shellsync.CloseTerminalRequestH\x00R\x14closeTerminalRequest\x122\n" +
+	"\x06signal\x18\x06 \x01(\v2\x18.shellsync.SignalRequestH\x00R\x06signal\x12*\n" +
+	"\x04ping\x18\a \x01(\v2\x14.shellsync.HeartbeatH\x00R\x04ping\x12<\n" +
+	"\routput_credit\x18\b \x01(\v2\x15.shellsync.FlowCreditH\x00R\foutputCredit\x12=\n" +
+	"\fparticipants\x18\t \x01(\v2\x17.shellsync.ParticipantsH\x00R\fparticipantsB\t\n" +
 	"\apayload\"D\n" +
 	"\rTerminalInput\x12\x1f\n" +
 	"\vterminal_id\x18\x01 \x01(\tR\n" +
 	"terminalId\x12\x12\n" +
-	"\x04data\x18\x02 \x01(\fR\x04data\"8\n" +
+	"\x04data\x18\x02 \x01(\fR\x04data\"\x81\x02\n" +
 	"\x15CreateTerminalRequest\x12\x1f\n" +
 	"\vterminal_id\x18\x01 \x01(\tR\n" +
-	"terminalId2\x91\x01\n" +
+	"terminalId\x12\x18\n" +
+	"\acommand\x18\x02 \x01(\tR\acommand\x12\x12\n" +
+	"\x04args\x18\x03 \x03(\tR\x04args\x12\x10\n" +
+	"\x03cwd\x18\x04 \x01(\tR\x03cwd\x12;\n" +
+	"\x03env\x18\x05 \x03(\v2).shellsync.CreateTerminalRequest.EnvEntryR\x03env\x12\x12\n" +
+	"\x04term\x18\x06 \x01(\tR\x04term\x1a6\n" +
+	"\bEnvEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"Y\n" +
+	"\x0eTerminalResize\x12\x1f\n" +
+	"\vterminal_id\x18\x01 \x01(\tR\n" +
+	"terminalId\x12\x12\n" +
+	"\x04rows\x18\x02 \x01(\rR\x04rows\x12\x12\n" +
+	"\x04cols\x18\x03 \x01(\rR\x04cols\"7\n" +
+	"\x14CloseTerminalRequest\x12\x1f\n" +
+	"\vterminal_id\x18\x01 \x01(\tR\n" +
+	"terminalId\"H\n" +
+	"\rSignalRequest\x12\x1f\n" +
+	"\vterminal_id\x18\x01 \x01(\tR\n" +
+	"terminalId\x12\x16\n" +
+	"\x06signal\x18\x02 \x01(\tR\x06signal\"b\n" +
+	"\tHeartbeat\x12\x10\n" +
+	"\x03seq\x18\x01 \x01(\x04R\x03seq\x12$\n" +
+	"\x0esent_unix_nano\x18\x02 \x01(\x03R\fsentUnixNano\x12\x1d\n" +
+	"\n" +
+	"timeout_ms\x18\x03 \x01(\rR\ttimeoutMs\"C\n" +
+	"\n" +
+	"FlowCredit\x12\x1f\n" +
+	"\vterminal_id\x18\x01 \x01(\tR\n" +
+	"terminalId\x12\x14\n" +
+	"\x05bytes\x18\x02 \x01(\rR\x05bytes\"-\n" +
+	"\fParticipants\x12\x1d\n" +
+	"\n" +
+	"client_ids\x18\x01 \x03(\tR\tclientIds2\x91\x01\n" +
 	"\tShellSync\x12D\n" +
 	"\rCreateSession\x12\x18.shellsync.CreateRequest\x1a\x19.shellsync.CreateResponse\x12>\n" +
 	"\x06Stream\x12\x17.shellsync.ClientUpdate\x1a\x17.shellsync.ServerUpdate(\x010\x01B+Z)github.com/Ayush-Vish/shellsync/api/protob\x06proto3"
@@ -678,35 +1512,56 @@ func file_api_proto_shellsync_proto_rawDescGZIP() []byte {
 	return file_api_proto_shellsync_proto_rawDescData
 }
 
-var file_api_proto_shellsync_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_api_proto_shellsync_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
 var file_api_proto_shellsync_proto_goTypes = []any{
 	(*CreateRequest)(nil),           // 0: shellsync.CreateRequest
 	(*CreateResponse)(nil),          // 1: shellsync.CreateResponse
 	(*ClientUpdate)(nil),            // 2: shellsync.ClientUpdate
-	(*TerminalError)(nil),           // 3: shellsync.TerminalError
-	(*InitialAgentMessage)(nil),     // 4: shellsync.InitialAgentMessage
-	(*TerminalOutput)(nil),          // 5: shellsync.TerminalOutput
-	(*TerminalCreatedResponse)(nil), // 6: shellsync.TerminalCreatedResponse
-	(*ServerUpdate)(nil),            // 7: shellsync.ServerUpdate
-	(*TerminalInput)(nil),           // 8: shellsync.TerminalInput
-	(*CreateTerminalRequest)(nil),   // 9: shellsync.CreateTerminalRequest
+	(*AgentNotice)(nil),             // 3: shellsync.AgentNotice
+	(*TerminalError)(nil),           // 4: shellsync.TerminalError
+	(*InitialAgentMessage)(nil),     // 5: shellsync.InitialAgentMessage
+	(*TerminalOutput)(nil),          // 6: shellsync.TerminalOutput
+	(*TerminalCreatedResponse)(nil), // 7: shellsync.TerminalCreatedResponse
+	(*TerminalExited)(nil),          // 8: shellsync.TerminalExited
+	(*ServerUpdate)(nil),            // 9: shellsync.ServerUpdate
+	(*TerminalInput)(nil),           // 10: shellsync.TerminalInput
+	(*CreateTerminalRequest)(nil),   // 11: shellsync.CreateTerminalRequest
+	(*TerminalResize)(nil),          // 12: shellsync.TerminalResize
+	(*CloseTerminalRequest)(nil),    // 13: shellsync.CloseTerminalRequest
+	(*SignalRequest)(nil),           // 14: shellsync.SignalRequest
+	(*Heartbeat)(nil),               // 15: shellsync.Heartbeat
+	(*FlowCredit)(nil),              // 16: shellsync.FlowCredit
+	(*Participants)(nil),            // 17: shellsync.Participants
+	nil,                             // 18: shellsync.CreateTerminalRequest.EnvEntry
 }
 var file_api_proto_shellsync_proto_depIdxs = []int32{
-	4, // 0: shellsync.ClientUpdate.initial_message:type_name -> shellsync.InitialAgentMessage
-	5, // 1: shellsync.ClientUpdate.pty_output:type_name -> shellsync.TerminalOutput
-	6, // 2: shellsync.ClientUpdate.terminal_created_response:type_name -> shellsync.TerminalCreatedResponse
-	3, // 3: shellsync.ClientUpdate.terminal_error:type_name -> shellsync.TerminalError
-	8, // 4: shellsync.ServerUpdate.pty_input:type_name -> shellsync.TerminalInput
-	9, // 5: shellsync.ServerUpdate.create_terminal_request:type_name -> shellsync.CreateTerminalRequest
-	0, // 6: shellsync.ShellSync.CreateSession:input_type -> shellsync.CreateRequest
-	2, // 7: shellsync.ShellSync.Stream:input_type -> shellsync.ClientUpdate
-	1, // 8: shellsync.ShellSync.CreateSession:output_type -> shellsync.CreateResponse
-	7, // 9: shellsync.ShellSync.Stream:output_type -> shellsync.ServerUpdate
-	8, // [8:10] is the sub-list for method output_type
-	6, // [6:8] is the sub-list for method input_type
-	6, // [6:6] is the sub-list for extension type_name
-	6, // [6:6] is the sub-list for extension extendee
-	0, // [0:6] is the sub-list for field type_name
+	5,  // 0: shellsync.ClientUpdate.initial_message:type_name -> shellsync.InitialAgentMessage
+	6,  // 1: shellsync.ClientUpdate.pty_output:type_name -> shellsync.TerminalOutput
+	7,  // 2: shellsync.ClientUpdate.terminal_created_response:type_name -> shellsync.TerminalCreatedResponse
+	4,  // 3: shellsync.ClientUpdate.terminal_error:type_name -> shellsync.TerminalError
+	8,  // 4: shellsync.ClientUpdate.terminal_exited:type_name -> shellsync.TerminalExited
+	15, // 5: shellsync.ClientUpdate.pong:type_name -> shellsync.Heartbeat
+	16, // 6: shellsync.ClientUpdate.input_credit:type_name -> shellsync.FlowCredit
+	12, // 7: shellsync.ClientUpdate.host_resize:type_name -> shellsync.TerminalResize
+	3,  // 8: shellsync.ClientUpdate.notice:type_name -> shellsync.AgentNotice
+	10, // 9: shellsync.ServerUpdate.pty_input:type_name -> shellsync.TerminalInput
+	11, // 10: shellsync.ServerUpdate.create_terminal_request:type_name -> shellsync.CreateTerminalRequest
+	12, // 11: shellsync.ServerUpdate.resize:type_name -> shellsync.TerminalResize
+	13, // 12: shellsync.ServerUpdate.close_terminal_request:type_name -> shellsync.CloseTerminalRequest
+	14, // 13: shellsync.ServerUpdate.signal:type_name -> shellsync.SignalRequest
+	15, // 14: shellsync.ServerUpdate.ping:type_name -> shellsync.Heartbeat
+	16, // 15: shellsync.ServerUpdate.output_credit:type_name -> shellsync.FlowCredit
+	17, // 16: shellsync.ServerUpdate.participants:type_name -> shellsync.Participants
+	18, // 17: shellsync.CreateTerminalRequest.env:type_name -> shellsync.CreateTerminalRequest.EnvEntry
+	0,  // 18: shellsync.ShellSync.CreateSession:input_type -> shellsync.CreateRequest
+	2,  // 19: shellsync.ShellSync.Stream:input_type -> shellsync.ClientUpdate
+	1,  // 20: shellsync.ShellSync.CreateSession:output_type -> shellsync.CreateResponse
+	9,  // 21: shellsync.ShellSync.Stream:output_type -> shellsync.ServerUpdate
+	20, // [20:22] is the sub-list for method output_type
+	18, // [18:20] is the sub-list for method input_type
+	18, // [18:18] is the sub-list for extension type_name
+	18, // [18:18] is the sub-list for extension extendee
+	0,  // [0:18] is the sub-list for field type_name
 }
 
 func init() { file_api_proto_shellsync_proto_init() }
@@ -719,11 +1574,22 @@ func file_api_proto_shellsync_proto_init() {
 		(*ClientUpdate_PtyOutput)(nil),
 		(*ClientUpdate_TerminalCreatedResponse)(nil),
 		(*ClientUpdate_TerminalError)(nil),
+		(*ClientUpdate_TerminalExited)(nil),
+		(*ClientUpdate_Pong)(nil),
+		(*ClientUpdate_InputCredit)(nil),
+		(*ClientUpdate_HostResize)(nil),
+		(*ClientUpdate_Notice)(nil),
 	}
-	file_api_proto_shellsync_proto_msgTypes[7].OneofWrappers = []any{
+	file_api_proto_shellsync_proto_msgTypes[9].OneofWrappers = []any{
 		(*ServerUpdate_ServerHello)(nil),
 		(*ServerUpdate_PtyInput)(nil),
 		(*ServerUpdate_CreateTerminalRequest)(nil),
+		(*ServerUpdate_Resize)(nil),
+		(*ServerUpdate_CloseTerminalRequest)(nil),
+		(*ServerUpdate_Signal)(nil),
+		(*ServerUpdate_Ping)(nil),
+		(*ServerUpdate_OutputCredit)(nil),
+		(*ServerUpdate_Participants)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -731,7 +1597,7 @@ func file_api_proto_shellsync_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_proto_shellsync_proto_rawDesc), len(file_api_proto_shellsync_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   10,
+			NumMessages:   19,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
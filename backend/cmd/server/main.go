@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,14 +18,67 @@ import (
 	"google.golang.org/grpc"
 
 	pb "github.com/Ayush-Vish/shellsync/api/proto"
+	"github.com/Ayush-Vish/shellsync/backend/internal/auth"
 	"github.com/Ayush-Vish/shellsync/backend/internal/service"
 	"github.com/Ayush-Vish/shellsync/backend/internal/websocket"
 )
 
 func main() {
+	cfg := service.DefaultConfig()
+	flag.IntVar(&cfg.ScrollbackBytes, "scrollback-bytes", cfg.ScrollbackBytes, "Recent output kept per terminal and replayed to late joiners (0 disables replay); only used with -screen-model=false")
+	flag.BoolVar(&cfg.ScreenModel, "screen-model", cfg.ScreenModel, "Track each terminal's screen and send late joiners a redraw instead of raw output")
+	flag.IntVar(&cfg.ScreenHistory, "screen-history", cfg.ScreenHistory, "Lines scrolled off the screen kept per terminal for late joiners")
+	flag.DurationVar(&cfg.AgentGracePeriod, "agent-grace", cfg.AgentGracePeriod, "How long to queue commands for an agent that lost its connection before refusing them")
+	flag.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", cfg.HeartbeatInterval, "How often to ping agents to measure latency (0 disables heartbeats)")
+	flag.DurationVar(&cfg.HeartbeatTimeout, "heartbeat-timeout", cfg.HeartbeatTimeout, "Drop an agent stream that has been silent this long")
+	flag.IntVar(&cfg.InputBufferBytes, "input-buffer-bytes", cfg.InputBufferBytes, "Input per terminal that may wait for the agent before more is refused")
+	flag.IntVar(&cfg.MaxTerminals, "max-terminals", cfg.MaxTerminals, "Terminals a session may have open at once (0 means no limit)")
+	tlsCert := flag.String("tls-cert", "", "Certificate for TLS on the agent gRPC port (without it agents connect in plaintext)")
+	tlsKey := flag.String("tls-key", "", "Key of the TLS certificate")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA certificates agents must present a certificate from (mutual TLS)")
+	tokenKeyFile := flag.String("join-token-key-file", "", "File with the key that signs join tokens (default: a random key, so tokens do not survive a restart)")
+	flag.DurationVar(&cfg.JoinTokenTTL, "join-token-ttl", cfg.JoinTokenTTL, "How long the join token in a session URL is valid")
+	flag.StringVar(&cfg.FrontendURL, "frontend-url", cfg.FrontendURL, "URL the web frontend is served from; session URLs point there")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma-separated origins of pages allowed to open WebSockets (default: the origin of -frontend-url)")
+	flag.Parse()
+
+	if cfg.ScreenModel {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "scrollback-bytes" {
+				log.Println("Ignoring -scrollback-bytes: late joiners get a redraw from the screen model, see -screen-model")
+			}
+		})
+	}
+
+	if *tokenKeyFile != "" {
+		key, err := os.ReadFile(*tokenKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read join token key: %v", err)
+		}
+		if cfg.JoinTokenKey = bytes.TrimSpace(key); len(cfg.JoinTokenKey) < 16 {
+			log.Fatalf("Join token key in %s is too short, use at least 16 bytes", *tokenKeyFile)
+		}
+	}
+
+	grpcOpts, err := agentCredentials(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		log.Fatalf("Invalid TLS settings: %v", err)
+	}
+	if grpcOpts == nil {
+		log.Println("No TLS certificate given: agent connections are not encrypted, and agents need --insecure to connect")
+	}
+
 	// Initialize ShellSync service and WebSocket hub
-	shellService := service.NewShellSyncService()
-	wsHub := websocket.NewHub(shellService)
+	shellService := service.NewShellSyncService(cfg)
+	origins := []string{cfg.FrontendURL}
+	if *allowedOrigins != "" {
+		origins = strings.Split(*allowedOrigins, ",")
+	}
+	wsHub, err := websocket.NewHub(shellService, origins)
+	if err != nil {
+		log.Fatalf("Invalid WebSocket origins: %v", err)
+	}
+	log.Printf("Accepting WebSocket connections from pages on %s", strings.Join(origins, ", "))
 	shellService.SetHub(wsHub)
 
 	// gRPC server on :5001
@@ -31,7 +87,7 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to listen on :5001: %v", err)
 		}
-		grpcServer := grpc.NewServer()
+		grpcServer := grpc.NewServer(grpcOpts...)
 		pb.RegisterShellSyncServer(grpcServer, shellService)
 
 		log.Println("Starting gRPC server on port :5001")
@@ -52,6 +108,25 @@ func main() {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	})
+	r.HandleFunc("/sessions/{sessionID}/terminals/{terminalID}/screen", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if _, err := shellService.VerifyJoinToken(vars["sessionID"], "", r.URL.Query().Get("token")); err != nil {
+			http.Error(w, err.Error(), auth.HTTPStatus(err))
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "text" && format != "ansi" {
+			http.Error(w, "format must be text or ansi", http.StatusBadRequest)
+			return
+		}
+		screen, ok := shellService.TerminalScreen(vars["sessionID"], vars["terminalID"], format == "ansi")
+		if !ok {
+			http.Error(w, "terminal not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(screen)
+	}).Methods(http.MethodGet)
 	r.HandleFunc("/ws", wsHub.HandleWebSocket)
 
 	httpServer := &http.Server{
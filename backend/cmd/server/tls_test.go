@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/Ayush-Vish/shellsync/internal/tlstest"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// agentTLS returns the credentials of an agent that trusts ca, with the
+// given client certificate if certFile is set.
+func agentTLS(t *testing.T, ca *tlstest.CA, certFile, keyFile string) credentials.TransportCredentials {
+	t.Helper()
+	cfg := &tls.Config{RootCAs: x509.NewCertPool()}
+	cfg.RootCAs.AddCert(ca.Cert)
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(cfg)
+}
+
+func TestAgentCredentialsOptions(t *testing.T) {
+	ca := tlstest.NewCA(t, "ca")
+	cert, key := ca.Issue(t, "localhost", true)
+	tests := []struct {
+		name                string
+		cert, key, clientCA string
+		wantOpts, wantErr   bool
+	}{
+		{"plaintext", "", "", "", false, false},
+		{"tls", cert, key, "", true, false},
+		{"mutual tls", cert, key, ca.File, true, false},
+		{"certificate without key", cert, "", "", false, true},
+		{"key without certificate", "", key, "", false, true},
+		{"client CA without certificate", "", "", ca.File, false, true},
+		{"missing certificate file", cert + ".missing", key, "", false, true},
+		{"client CA file without certificates", cert, key, key, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := agentCredentials(tt.cert, tt.key, tt.clientCA)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("agentCredentials() = %v, want error %v", err, tt.wantErr)
+			}
+			if (opts != nil) != tt.wantOpts {
+				t.Fatalf("agentCredentials() returned %d options, want some: %v", len(opts), tt.wantOpts)
+			}
+		})
+	}
+}
+
+// TestAgentCredentialsHandshake connects agents to listeners set up by
+// agentCredentials.
+func TestAgentCredentialsHandshake(t *testing.T) {
+	ca := tlstest.NewCA(t, "ca")
+	cert, key := ca.Issue(t, "localhost", true)
+	agentCert, agentKey := ca.Issue(t, "agent", false)
+	other := tlstest.NewCA(t, "other-ca")
+	strangerCert, strangerKey := other.Issue(t, "stranger", false)
+
+	tlsOpts, err := agentCredentials(cert, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtlsOpts, err := agentCredentials(cert, key, ca.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsAddr := tlstest.Serve(t, tlsOpts...)
+	mtlsAddr := tlstest.Serve(t, mtlsOpts...)
+
+	tests := []struct {
+		name    string
+		addr    string
+		creds   credentials.TransportCredentials
+		wantErr bool
+	}{
+		{"tls", tlsAddr, agentTLS(t, ca, "", ""), false},
+		{"plaintext agent on tls", tlsAddr, insecure.NewCredentials(), true},
+		{"agent trusting another CA", tlsAddr, agentTLS(t, other, "", ""), true},
+		{"mutual tls", mtlsAddr, agentTLS(t, ca, agentCert, agentKey), false},
+		{"mutual tls without client certificate", mtlsAddr, agentTLS(t, ca, "", ""), true},
+		{"mutual tls with certificate of another CA", mtlsAddr, agentTLS(t, ca, strangerCert, strangerKey), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tlstest.Call(t, tt.addr, tt.creds); (err != nil) != tt.wantErr {
+				t.Fatalf("call = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
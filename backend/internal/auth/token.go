@@ -0,0 +1,115 @@
+// Package auth issues and checks the join tokens that let browsers into a
+// session. A token is the base64url-encoded JSON of its claims and an
+// HMAC-SHA256 of that encoding, separated by a dot.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Roles a token can grant. Viewers only watch, editors also use the
+// terminals, and the owner, the host's own browser, can also change the
+// roles of others.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// ValidRole reports whether role is one of the roles above.
+func ValidRole(role string) bool {
+	return role == RoleOwner || role == RoleEditor || role == RoleViewer
+}
+
+var (
+	ErrMissingToken   = errors.New("join token is missing")
+	ErrMalformedToken = errors.New("join token is malformed")
+	ErrBadSignature   = errors.New("join token signature is invalid")
+	ErrExpiredToken   = errors.New("join token has expired")
+	ErrWrongSession   = errors.New("join token is for another session")
+	ErrWrongClient    = errors.New("join token is for another client")
+)
+
+// Claims is what a join token grants: a role in one session until it
+// expires. A token with a ClientID only admits that client.
+type Claims struct {
+	SessionID string `json:"sid"`
+	ClientID  string `json:"cid,omitempty"`
+	Role      string `json:"role"`
+	// ExpiresAt is in Unix seconds.
+	ExpiresAt int64 `json:"exp"`
+}
+
+// Signer signs and verifies tokens with a secret key.
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key}
+}
+
+// Issue returns a token for claims that is valid for ttl.
+func (s *Signer) Issue(claims Claims, ttl time.Duration) string {
+	claims.ExpiresAt = time.Now().Add(ttl).Unix()
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.sign(encoded))
+}
+
+// Verify checks a token's signature and expiry at now and returns its
+// claims.
+func (s *Signer) Verify(token string, now time.Time) (Claims, error) {
+	if token == "" {
+		return Claims{}, ErrMissingToken
+	}
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Claims{}, ErrMalformedToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return Claims{}, ErrMalformedToken
+	}
+	if !hmac.Equal(mac, s.sign(encoded)) {
+		return Claims{}, ErrBadSignature
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Claims{}, ErrMalformedToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.SessionID == "" || !ValidRole(claims.Role) {
+		return Claims{}, ErrMalformedToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+func (s *Signer) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// HTTPStatus is the status to refuse a request with whose token failed
+// verification with err.
+func HTTPStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrMalformedToken):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrWrongSession), errors.Is(err, ErrWrongClient):
+		return http.StatusForbidden
+	default:
+		return http.StatusUnauthorized
+	}
+}
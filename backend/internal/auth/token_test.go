@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	signer := NewSigner([]byte("test key"))
+	token := signer.Issue(Claims{SessionID: "abc12345", Role: RoleEditor}, time.Hour)
+	now := time.Now()
+
+	claims, err := signer.Verify(token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.SessionID != "abc12345" || claims.Role != RoleEditor {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	payload, sig, _ := strings.Cut(token, ".")
+	forged := NewSigner([]byte("other key")).Issue(Claims{SessionID: "abc12345", Role: RoleEditor}, time.Hour)
+	_, forgedSig, _ := strings.Cut(forged, ".")
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		want  error
+	}{
+		{"missing", "", now, ErrMissingToken},
+		{"no signature", payload, now, ErrMalformedToken},
+		{"wrong key", payload + "." + forgedSig, now, ErrBadSignature},
+		{"changed payload", "e30." + sig, now, ErrBadSignature},
+		{"expired", token, now.Add(2 * time.Hour), ErrExpiredToken},
+	}
+	for _, tt := range tests {
+		if _, err := signer.Verify(tt.token, tt.now); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+	"github.com/Ayush-Vish/shellsync/backend/internal/types"
+)
+
+// Flow control keeps a fast producer from outrunning a slow consumer without
+// dropping bytes, in both directions and per terminal.
+//
+// Output: the agent keeps at most its output window of bytes in flight. Each
+// chunk it sends is broadcast with a types.Delivery, and its bytes are
+// credited back only once every client it was queued for has consumed it, so
+// the slowest viewer paces the PTY. An agent that runs out of credit stops
+// reading the PTY, which in turn blocks the program writing to it.
+//
+// Input: keystrokes wait in the terminal's Input buffer and are sent to the
+// agent only within its input window. The agent credits them back after
+// writing them to the PTY, and the hub then tells each sender with an
+// input_ack so browsers can keep their own window.
+
+// agentLink is one agent stream serving a session.
+type agentLink struct {
+	cancel context.CancelFunc
+
+	// outputFlow and inputWindow come from the agent's hello. An agent that
+	// predates flow control announces neither.
+	outputFlow  bool
+	inputWindow int
+
+	mu sync.Mutex
+	// credits is output credit not yet returned to the agent, and inFlight
+	// is input sent to it but not yet credited back, both by terminal.
+	credits  map[string]int
+	inFlight map[string]int
+	// closed is set once the stream is gone and its in-flight input has
+	// been written off; late credits for it are ignored.
+	closed bool
+	// wake is signalled when credits has something to send.
+	wake chan struct{}
+	// ending is set when the agent said it is shutting down for good, so
+	// the end of the stream needs no grace period.
+	ending atomic.Bool
+}
+
+func newAgentLink(cancel context.CancelFunc, hello *pb.InitialAgentMessage) *agentLink {
+	return &agentLink{
+		cancel:      cancel,
+		outputFlow:  hello.GetOutputWindow() > 0,
+		inputWindow: int(hello.GetInputWindow()),
+		credits:     make(map[string]int),
+		inFlight:    make(map[string]int),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// notify wakes up whoever waits on ch without ever blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// outputDelivery returns the Delivery for a chunk of output from the agent,
+// or nil when the agent does not do flow control.
+func (l *agentLink) outputDelivery(terminalID string, n int) *types.Delivery {
+	if !l.outputFlow {
+		return nil
+	}
+	return types.NewDelivery(func() {
+		l.mu.Lock()
+		l.credits[terminalID] += n
+		l.mu.Unlock()
+		notify(l.wake)
+	})
+}
+
+// sendOutputCredits returns the output credit collected so far to the agent.
+func (l *agentLink) sendOutputCredits(stream pb.ShellSync_StreamServer) error {
+	l.mu.Lock()
+	credits := l.credits
+	l.credits = make(map[string]int)
+	l.mu.Unlock()
+
+	for terminalID, n := range credits {
+		update := &pb.ServerUpdate{
+			Payload: &pb.ServerUpdate_OutputCredit{
+				OutputCredit: &pb.FlowCredit{TerminalId: terminalID, Bytes: uint32(n)},
+			},
+		}
+		if err := stream.Send(update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendInput sends the agent the queued input that fits in its window for each
+// terminal. Agents without an input window get all of it, and its senders
+// are acknowledged right away since there is nothing else to wait for.
+func (s *ShellSyncService) sendInput(session *types.Session, link *agentLink, stream pb.ShellSync_StreamServer) error {
+	type chunk struct {
+		terminalID string
+		data       []byte
+	}
+	var chunks []chunk
+	released := make(map[string]map[string]int)
+
+	session.Mu.Lock()
+	link.mu.Lock()
+	if link.closed {
+		// The stream is gone; the input waits for the agent's next one.
+		link.mu.Unlock()
+		session.Mu.Unlock()
+		return nil
+	}
+	for id, terminal := range session.Terminals {
+		n := len(terminal.Input)
+		if link.inputWindow > 0 {
+			n = min(n, link.inputWindow-link.inFlight[id])
+		}
+		if n <= 0 {
+			continue
+		}
+		chunks = append(chunks, chunk{terminalID: id, data: terminal.Input[:n:n]})
+		terminal.Input = terminal.Input[n:]
+		if len(terminal.Input) == 0 {
+			terminal.Input = nil
+		}
+		if link.inputWindow > 0 {
+			link.inFlight[id] += n
+		} else {
+			released[id] = terminal.ReleaseInputLocked(n)
+		}
+	}
+	link.mu.Unlock()
+	session.Mu.Unlock()
+
+	for id, clients := range released {
+		s.ackInput(session.ID, id, clients)
+	}
+	for _, c := range chunks {
+		update := &pb.ServerUpdate{
+			Payload: &pb.ServerUpdate_PtyInput{
+				PtyInput: &pb.TerminalInput{TerminalId: c.terminalID, Data: c.data},
+			},
+		}
+		if err := stream.Send(update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// creditInput handles the agent reporting n bytes of input as written to the
+// PTY: they leave the agent's window and their senders are acknowledged.
+func (s *ShellSyncService) creditInput(session *types.Session, link *agentLink, terminalID string, n int) {
+	link.mu.Lock()
+	closed := link.closed
+	link.inFlight[terminalID] = max(0, link.inFlight[terminalID]-n)
+	link.mu.Unlock()
+	if closed {
+		return
+	}
+
+	s.releaseInput(session, terminalID, n)
+	notify(session.InputReady)
+}
+
+// dropInFlightInput gives up on the input a broken stream was carrying. It
+// may or may not have reached the PTY; either way its senders must get their
+// window back.
+func (s *ShellSyncService) dropInFlightInput(session *types.Session, link *agentLink) {
+	link.mu.Lock()
+	inFlight := link.inFlight
+	link.inFlight = make(map[string]int)
+	link.closed = true
+	link.mu.Unlock()
+
+	for terminalID, n := range inFlight {
+		if n > 0 {
+			log.Printf("Session [%s]: %d bytes of input for terminal [%s] may not have been delivered", session.ID, n, terminalID)
+			s.releaseInput(session, terminalID, n)
+		}
+	}
+}
+
+// dropQueuedInputLocked discards the input waiting for an agent that is not
+// coming back and returns, per terminal, how much each client had queued. It
+// must be called with the session lock held.
+func dropQueuedInputLocked(session *types.Session) map[string]map[string]int {
+	released := make(map[string]map[string]int)
+	for id, terminal := range session.Terminals {
+		n := 0
+		for _, src := range terminal.InputSources {
+			n += src.Bytes
+		}
+		if n > 0 {
+			released[id] = terminal.ReleaseInputLocked(n)
+		}
+		terminal.Input = nil
+	}
+	return released
+}
+
+func (s *ShellSyncService) releaseInput(session *types.Session, terminalID string, n int) {
+	session.Mu.Lock()
+	var released map[string]int
+	if terminal, ok := session.Terminals[terminalID]; ok {
+		released = terminal.ReleaseInputLocked(n)
+	}
+	session.Mu.Unlock()
+	s.ackInput(session.ID, terminalID, released)
+}
+
+// ackInput tells each client of a session how many of its input bytes for a
+// terminal are no longer outstanding.
+func (s *ShellSyncService) ackInput(sessionID, terminalID string, clients map[string]int) {
+	if s.hub == nil {
+		return
+	}
+	for clientID, n := range clients {
+		s.hub.SendToClient(sessionID, clientID, types.Message{
+			Type:       "input_ack",
+			TerminalID: terminalID,
+			Bytes:      n,
+			Sender:     "server",
+		})
+	}
+}
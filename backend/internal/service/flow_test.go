@@ -0,0 +1,269 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+	"github.com/Ayush-Vish/shellsync/backend/internal/types"
+	"google.golang.org/grpc"
+)
+
+// fakeAgentStream stands in for an agent's gRPC stream.
+type fakeAgentStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv chan *pb.ClientUpdate
+	sent chan *pb.ServerUpdate
+}
+
+func newFakeAgentStream(t *testing.T) *fakeAgentStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &fakeAgentStream{
+		ctx:  ctx,
+		recv: make(chan *pb.ClientUpdate, 16),
+		sent: make(chan *pb.ServerUpdate, 1024),
+	}
+}
+
+func (f *fakeAgentStream) Context() context.Context { return f.ctx }
+
+func (f *fakeAgentStream) Send(update *pb.ServerUpdate) error {
+	f.sent <- update
+	return nil
+}
+
+func (f *fakeAgentStream) Recv() (*pb.ClientUpdate, error) {
+	select {
+	case msg := <-f.recv:
+		return msg, nil
+	case <-f.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+// next returns the next update the backend sent, skipping other kinds.
+func next[T any](t *testing.T, f *fakeAgentStream) T {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case update := <-f.sent:
+			if payload, ok := update.Payload.(T); ok {
+				return payload
+			}
+		case <-timeout:
+			var zero T
+			t.Fatalf("timed out waiting for %T", zero)
+			return zero
+		}
+	}
+}
+
+// fakeHub holds on to every output chunk until the test releases it, like a
+// viewer that has not caught up, and keeps the errors sent to clients.
+type fakeHub struct {
+	mu        sync.Mutex
+	held      []*types.Delivery
+	inputAcks map[string]int
+	errors    []types.Message
+}
+
+func (h *fakeHub) BroadcastToSession(sessionID string, message types.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if message.Type == "terminal_error" {
+		h.errors = append(h.errors, message)
+	}
+	if message.Delivery != nil {
+		message.Delivery.Hold()
+		h.held = append(h.held, message.Delivery)
+	}
+}
+
+func (h *fakeHub) SendToClient(sessionID, clientID string, message types.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if message.Type == "input_ack" {
+		h.inputAcks[clientID] += message.Bytes
+	}
+}
+
+func (h *fakeHub) release(n int) {
+	h.mu.Lock()
+	held := h.held[:n]
+	h.held = h.held[n:]
+	h.mu.Unlock()
+	for _, d := range held {
+		d.Release()
+	}
+}
+
+func (h *fakeHub) heldCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.held)
+}
+
+func (h *fakeHub) acked(clientID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.inputAcks[clientID]
+}
+
+func startFlowSession(t *testing.T, cfg Config, hello *pb.InitialAgentMessage) (*ShellSyncService, *fakeHub, *fakeAgentStream, string) {
+	t.Helper()
+	cfg.HeartbeatInterval = 0
+	svc := NewShellSyncService(cfg)
+	hub := &fakeHub{inputAcks: make(map[string]int)}
+	svc.SetHub(hub)
+	resp, err := svc.CreateSession(context.Background(), &pb.CreateRequest{Host: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := newFakeAgentStream(t)
+	hello.SessionId = resp.GetSessionId()
+	hello.AgentSecret = resp.GetAgentSecret()
+	stream.recv <- &pb.ClientUpdate{Payload: &pb.ClientUpdate_InitialMessage{InitialMessage: hello}}
+	go svc.Stream(stream)
+
+	session, _ := svc.GetSession(resp.GetSessionId())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		session.Mu.RLock()
+		state := session.AgentState
+		session.Mu.RUnlock()
+		if state == types.AgentConnected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not connect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return svc, hub, stream, resp.GetSessionId()
+}
+
+func output(terminalID string, data []byte) *pb.ClientUpdate {
+	return &pb.ClientUpdate{Payload: &pb.ClientUpdate_PtyOutput{
+		PtyOutput: &pb.TerminalOutput{TerminalId: terminalID, Data: data},
+	}}
+}
+
+// TestOutputCreditWaitsForViewers floods a terminal and checks that the agent
+// gets its output credit back only as the viewers consume the output.
+func TestOutputCreditWaitsForViewers(t *testing.T) {
+	_, hub, stream, _ := startFlowSession(t, DefaultConfig(), &pb.InitialAgentMessage{OutputWindow: 64 * 1024})
+
+	const chunks, size = 64, 1024
+	for i := 0; i < chunks; i++ {
+		stream.recv <- output("t", bytes.Repeat([]byte{'x'}, size))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.heldCount() < chunks {
+		if time.Now().After(deadline) {
+			t.Fatal("output was not broadcast")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case update := <-stream.sent:
+		if _, ok := update.Payload.(*pb.ServerUpdate_OutputCredit); ok {
+			t.Fatal("output credited before any viewer consumed it")
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	hub.release(chunks / 2)
+	credited := 0
+	for credited < chunks/2*size {
+		credited += int(next[*pb.ServerUpdate_OutputCredit](t, stream).OutputCredit.GetBytes())
+	}
+	if credited != chunks/2*size {
+		t.Fatalf("credited %d bytes for %d consumed", credited, chunks/2*size)
+	}
+
+	hub.release(chunks / 2)
+	for credited < chunks*size {
+		credited += int(next[*pb.ServerUpdate_OutputCredit](t, stream).OutputCredit.GetBytes())
+	}
+	if credited != chunks*size {
+		t.Fatalf("credited %d bytes in total, want %d", credited, chunks*size)
+	}
+}
+
+// TestInputFloodStaysInWindow floods a terminal with input. The agent must
+// never have more than its window in flight, input beyond the buffer must be
+// refused rather than lost, and everything accepted must arrive in order and
+// be acknowledged to its sender.
+func TestInputFloodStaysInWindow(t *testing.T) {
+	const window = 4 * 1024
+	cfg := DefaultConfig()
+	cfg.InputBufferBytes = 16 * 1024
+	svc, hub, stream, sessionID := startFlowSession(t, cfg, &pb.InitialAgentMessage{InputWindow: window})
+
+	// Output makes the agent's terminal known to the session.
+	stream.recv <- output("t", []byte("$ "))
+	session, _ := svc.GetSession(sessionID)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		session.Mu.RLock()
+		_, known := session.Terminals["t"]
+		session.Mu.RUnlock()
+		if known {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("terminal was not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var accepted bytes.Buffer
+	for i := 0; ; i++ {
+		chunk := bytes.Repeat([]byte{byte('a' + i%26)}, 512)
+		err := svc.ForwardInputToAgent(sessionID, "t", "c1", chunk)
+		if errors.Is(err, ErrAgentBusy) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("input %d: %v", i, err)
+		}
+		accepted.Write(chunk)
+	}
+	if accepted.Len() < cfg.InputBufferBytes {
+		t.Fatalf("only %d bytes accepted before the buffer was full", accepted.Len())
+	}
+
+	var received bytes.Buffer
+	credited := 0
+	for received.Len() < accepted.Len() {
+		input := next[*pb.ServerUpdate_PtyInput](t, stream).PtyInput
+		received.Write(input.GetData())
+		if inFlight := received.Len() - credited; inFlight > window {
+			t.Fatalf("%d bytes in flight with a window of %d", inFlight, window)
+		}
+		credited += len(input.GetData())
+		stream.recv <- &pb.ClientUpdate{Payload: &pb.ClientUpdate_InputCredit{
+			InputCredit: &pb.FlowCredit{TerminalId: "t", Bytes: uint32(len(input.GetData()))},
+		}}
+	}
+	if !bytes.Equal(received.Bytes(), accepted.Bytes()) {
+		t.Fatal("input arrived out of order or corrupted")
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for hub.acked("c1") != accepted.Len() {
+		if time.Now().After(deadline) {
+			t.Fatalf("acknowledged %d of %d input bytes", hub.acked("c1"), accepted.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -2,18 +2,27 @@ package service
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"math/rand"
 
 	"io"
 	"log"
-
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/Ayush-Vish/shellsync/api/proto"
+	"github.com/Ayush-Vish/shellsync/backend/internal/auth"
 	"github.com/Ayush-Vish/shellsync/backend/internal/types"
+	"github.com/Ayush-Vish/shellsync/backend/internal/vt"
+	"github.com/Ayush-Vish/shellsync/backend/utils"
 	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type PtyOutputBroadcaster interface {
@@ -26,14 +35,118 @@ type ShellSyncService struct {
 	sessions map[string]*types.Session
 	mu       sync.RWMutex
 	hub      types.PtyOutputBroadcaster
+	cfg      Config
+	// links holds the agent stream currently serving each session. An
+	// agent that reconnects replaces its old stream, which may not have
+	// noticed yet that it is dead.
+	links map[string]*agentLink
+	// graceTimers moves a session whose agent dropped from reconnecting to
+	// disconnected if the agent does not come back in time.
+	graceTimers map[string]*time.Timer
+	// tokens signs the join tokens of session URLs.
+	tokens *auth.Signer
+}
+
+var (
+	ErrAgentUnavailable = errors.New("no agent is connected to this session")
+	ErrAgentBusy        = errors.New("agent is busy, try again")
+	ErrReadOnly         = errors.New("terminal is read-only")
+)
+
+// Config holds the backend settings that come from command-line flags.
+type Config struct {
+	// ScrollbackBytes is how much recent output is kept per terminal and
+	// replayed to clients that join later. Zero disables replay.
+	ScrollbackBytes int
+	// ScreenModel runs a terminal emulator per terminal so late joiners get
+	// a redraw of the current screen rather than raw output. ScreenHistory
+	// is how many lines scrolled off the top are kept with it.
+	ScreenModel   bool
+	ScreenHistory int
+	// AgentGracePeriod is how long commands for an agent whose stream
+	// dropped are queued for its return before they are refused.
+	AgentGracePeriod time.Duration
+	// HeartbeatInterval is how often the agent is pinged to measure the
+	// round trip; zero disables heartbeats. An agent not heard from for
+	// HeartbeatTimeout is treated as gone.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	// InputBufferBytes is how much input per terminal may wait for the
+	// agent before more is refused.
+	InputBufferBytes int
+	// MaxTerminals is how many terminals a session may have open, counting
+	// those still being created. Zero means no limit.
+	MaxTerminals int
+	// JoinTokenKey signs the join tokens in session URLs; without one a
+	// random key is used, and tokens do not outlive the process.
+	// JoinTokenTTL is how long a token lets browsers join.
+	JoinTokenKey []byte
+	JoinTokenTTL time.Duration
+	// FrontendURL is where the web frontend is served; session URLs point
+	// there.
+	FrontendURL string
 }
 
-func NewShellSyncService() *ShellSyncService {
+func DefaultConfig() Config {
+	return Config{
+		ScrollbackBytes:  64 * 1024,
+		ScreenModel:      true,
+		ScreenHistory:    1000,
+		AgentGracePeriod: 30 * time.Second,
+
+		HeartbeatInterval: 5 * time.Second,
+		HeartbeatTimeout:  20 * time.Second,
+		InputBufferBytes:  256 * 1024,
+		MaxTerminals:      16,
+		JoinTokenTTL:      24 * time.Hour,
+		FrontendURL:       "http://localhost:3000",
+	}
+}
+
+func NewShellSyncService(cfg Config) *ShellSyncService {
+	key := cfg.JoinTokenKey
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := cryptorand.Read(key); err != nil {
+			panic(err)
+		}
+	}
 	return &ShellSyncService{
-		sessions: make(map[string]*types.Session),
+		sessions:    make(map[string]*types.Session),
+		cfg:         cfg,
+		links:       make(map[string]*agentLink),
+		graceTimers: make(map[string]*time.Timer),
+		tokens:      auth.NewSigner(key),
 	}
 }
 
+// terminalLocked returns the terminal with the given ID, registering it if
+// the agent mentions a terminal the session does not know yet (such as the
+// default terminal, whose output can arrive before its creation response).
+// It must be called with the session lock held.
+func (s *ShellSyncService) terminalLocked(session *types.Session, terminalID string) *types.Terminal {
+	terminal, exists := session.Terminals[terminalID]
+	if !exists {
+		terminal = s.newTerminal(terminalID, "")
+		session.Terminals[terminalID] = terminal
+	}
+	return terminal
+}
+
+func (s *ShellSyncService) newTerminal(terminalID, frontendID string) *types.Terminal {
+	terminal := &types.Terminal{
+		ID:         terminalID,
+		FrontendID: frontendID,
+		CreatedAt:  time.Now(),
+	}
+	if s.cfg.ScreenModel {
+		terminal.Screen = vt.NewScreen(vt.DefaultRows, vt.DefaultCols, s.cfg.ScreenHistory)
+	} else {
+		terminal.Scrollback = types.NewScrollback(s.cfg.ScrollbackBytes)
+	}
+	return terminal
+}
+
 func (s *ShellSyncService) SetHub(hub types.PtyOutputBroadcaster) {
 	s.hub = hub
 }
@@ -42,6 +155,10 @@ func (s *ShellSyncService) CreateSession(ctx context.Context, req *pb.CreateRequ
 	defer s.mu.Unlock()
 
 	sessionID := uuid.New().String()[:8]
+	secret := utils.GenerateRandomID(32)
+	if secret == "" {
+		return nil, status.Error(codes.Internal, "failed to generate the agent secret")
+	}
 	session := &types.Session{
 		ID:             sessionID,
 		Host:           req.Host,
@@ -49,20 +166,76 @@ func (s *ShellSyncService) CreateSession(ctx context.Context, req *pb.CreateRequ
 		Terminals:      make(map[string]*types.Terminal),
 		CreatedAt:      time.Now(),
 		AgentInputChan: make(chan types.AgentCommand, 20), 
+		AgentState:     types.AgentDisconnected,
+		InputReady:     make(chan struct{}, 1),
+		ClientsChanged: make(chan struct{}, 1),
+		AgentSecret:    secret,
 	}
 	s.sessions[sessionID] = session
 
 	log.Printf("Created session: %s for host: %s", sessionID, req.Host)
 	frontendClientID := "user-" + uuid.New().String()[:5]
+	// Only the host's own link makes its holder the owner. The editor and
+	// viewer links are for sharing, so the server names each browser that
+	// joins with them; see AssignClientID.
+	ownerToken := s.tokens.Issue(auth.Claims{SessionID: sessionID, ClientID: frontendClientID, Role: auth.RoleOwner}, s.cfg.JoinTokenTTL)
+	editorToken := s.tokens.Issue(auth.Claims{SessionID: sessionID, Role: auth.RoleEditor}, s.cfg.JoinTokenTTL)
+	viewerToken := s.tokens.Issue(auth.Claims{SessionID: sessionID, Role: auth.RoleViewer}, s.cfg.JoinTokenTTL)
+	base := strings.TrimSuffix(s.cfg.FrontendURL, "/")
 	return &pb.CreateResponse{
 		SessionId:   sessionID,
-		FrontendUrl: fmt.Sprintf("http://localhost:3000/ws/%s?client_id=%s", sessionID, frontendClientID),
+		FrontendUrl: fmt.Sprintf("%s/ws/%s?client_id=%s&token=%s", base, sessionID, frontendClientID, ownerToken),
+		AgentSecret: secret,
+		EditorUrl:   fmt.Sprintf("%s/ws/%s?token=%s", base, sessionID, editorToken),
+		ViewerUrl:   fmt.Sprintf("%s/ws/%s?token=%s", base, sessionID, viewerToken),
 	}, nil
 }
 
+// VerifyJoinToken checks that token lets the browser with clientID into the
+// session and returns what it grants. An empty clientID skips the client
+// check, for requests that do not join as a client.
+func (s *ShellSyncService) VerifyJoinToken(sessionID, clientID, token string) (auth.Claims, error) {
+	claims, err := s.tokens.Verify(token, time.Now())
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	if claims.SessionID != sessionID {
+		return auth.Claims{}, auth.ErrWrongSession
+	}
+	if clientID != "" && claims.ClientID != "" && claims.ClientID != clientID {
+		return auth.Claims{}, auth.ErrWrongClient
+	}
+	return claims, nil
+}
+
+// AssignClientID names a browser that joined with claims for no client in
+// particular, as the editor and viewer links are. Those links are shared, so
+// a browser cannot pick its own ID: it could take the owner's, or another
+// participant's and the role the owner gave it. The token returned admits
+// only the new ID, with the rest of claims, until the original expires; the
+// browser rejoins with it to keep its ID.
+func (s *ShellSyncService) AssignClientID(claims auth.Claims) (auth.Claims, string) {
+	session, exists := s.GetSession(claims.SessionID)
+	for {
+		claims.ClientID = "user-" + uuid.New().String()[:8]
+		if !exists {
+			break
+		}
+		session.Mu.RLock()
+		_, taken := session.Clients[claims.ClientID]
+		_, overridden := session.RoleOverrides[claims.ClientID]
+		session.Mu.RUnlock()
+		if !taken && !overridden {
+			break
+		}
+	}
+	return claims, s.tokens.Issue(claims, time.Until(time.Unix(claims.ExpiresAt, 0)))
+}
+
 func (s *ShellSyncService) Stream(stream pb.ShellSync_StreamServer) error {
 	log.Println("Server: New agent stream connected. Waiting for initial message...")
-	ctx := stream.Context()
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
 
 
 	initialMsg, err := stream.Recv()
@@ -70,16 +243,100 @@ func (s *ShellSyncService) Stream(stream pb.ShellSync_StreamServer) error {
 		log.Printf("Failed to receive initial message from agent: %v", err)
 		return err
 	}
-	sessionID := initialMsg.GetInitialMessage().GetSessionId()
+	hello := initialMsg.GetInitialMessage()
+	sessionID := hello.GetSessionId()
 
 
-	s.mu.RLock()
+	link := newAgentLink(cancel, hello)
+	s.mu.Lock()
 	session, exists := s.sessions[sessionID]
-	s.mu.RUnlock()
 	if !exists {
-		return fmt.Errorf("session %s not found for connecting agent", sessionID)
+		s.mu.Unlock()
+		// NotFound tells a reconnecting agent to stop retrying, e.g. after
+		// the backend restarted and lost its sessions.
+		return status.Errorf(codes.NotFound, "session %s not found for connecting agent", sessionID)
+	}
+	if subtle.ConstantTimeCompare([]byte(hello.GetAgentSecret()), []byte(session.AgentSecret)) != 1 {
+		s.mu.Unlock()
+		log.Printf("Session [%s]: refused an agent with the wrong secret", sessionID)
+		return status.Errorf(codes.PermissionDenied, "wrong agent secret for session %s", sessionID)
+	}
+	previous := s.links[sessionID]
+	if previous != nil && !hello.GetResume() {
+		// Only the agent already serving the session may take over its
+		// stream, when it reconnects.
+		s.mu.Unlock()
+		log.Printf("Session [%s]: refused a second agent", sessionID)
+		return status.Errorf(codes.AlreadyExists, "session %s already has an agent", sessionID)
 	}
-	log.Printf("Agent successfully associated with session %s", sessionID)
+	s.links[sessionID] = link
+	if timer := s.graceTimers[sessionID]; timer != nil {
+		timer.Stop()
+		delete(s.graceTimers, sessionID)
+	}
+	s.mu.Unlock()
+	if previous != nil {
+		log.Printf("Agent for session %s reconnected, dropping its previous stream", sessionID)
+		previous.cancel()
+	}
+	defer func() {
+		s.dropInFlightInput(session, link)
+		s.mu.Lock()
+		current := s.links[sessionID] == link
+		// An agent that said it is shutting down is not waited for.
+		ending := link.ending.Load()
+		if current {
+			delete(s.links, sessionID)
+			if !ending {
+				s.graceTimers[sessionID] = time.AfterFunc(s.cfg.AgentGracePeriod, func() {
+					s.agentGone(session)
+				})
+			}
+		}
+		s.mu.Unlock()
+		if current {
+			s.setAgentState(session, types.AgentReconnecting)
+			if ending {
+				s.agentGone(session)
+			}
+		}
+	}()
+
+	log.Printf("Agent successfully associated with session %s (resume: %v, output window: %d, input window: %d)",
+		sessionID, hello.GetResume(), hello.GetOutputWindow(), hello.GetInputWindow())
+	session.Mu.Lock()
+	var vanished []string
+	sizes := make(map[string]types.TerminalSize)
+	if hello.GetResume() {
+		vanished = s.resumeLocked(session, hello.GetTerminalIds())
+		// Resizes may have been refused while the agent was away.
+		for id, terminal := range session.Terminals {
+			if terminal.Size.Rows > 0 {
+				sizes[id] = terminal.Size
+			}
+		}
+	}
+	session.Mu.Unlock()
+	s.setAgentState(session, types.AgentConnected)
+	for id, size := range sizes {
+		s.sendResize(session, id, size)
+	}
+	// Input typed while the agent was away is waiting for this stream.
+	notify(session.InputReady)
+	notify(session.ClientsChanged)
+	if s.hub != nil {
+		for _, terminalID := range vanished {
+			s.hub.BroadcastToSession(sessionID, types.Message{
+				Type:       "terminal_exited",
+				TerminalID: terminalID,
+				ExitCode:   -1,
+				Sender:     "pty_agent",
+			})
+		}
+	}
+
+	var lastHeard atomic.Int64
+	lastHeard.Store(time.Now().UnixNano())
 
 	// Goroutine: Read messages from Agent and dispatch them.
 	go func() {
@@ -89,32 +346,55 @@ func (s *ShellSyncService) Stream(stream pb.ShellSync_StreamServer) error {
 				if err != io.EOF {
 					log.Printf("Error receiving from agent for session %s: %v", sessionID, err)
 				}
+				cancel()
 				return
 			}
+			lastHeard.Store(time.Now().UnixNano())
 
 
 			switch payload := msgFromAgent.Payload.(type) {
+			case *pb.ClientUpdate_Pong:
+				sent := payload.Pong.GetSentUnixNano()
+				if sent > 0 {
+					s.recordLatency(session, time.Since(time.Unix(0, sent)))
+				}
+			case *pb.ClientUpdate_HostResize:
+				s.resizeForHost(session, payload.HostResize)
+			case *pb.ClientUpdate_Notice:
+				s.recordNotice(session, link, payload.Notice)
+			case *pb.ClientUpdate_InputCredit:
+				credit := payload.InputCredit
+				s.creditInput(session, link, credit.GetTerminalId(), int(credit.GetBytes()))
 			case *pb.ClientUpdate_PtyOutput:
 				output := payload.PtyOutput
+				delivery := link.outputDelivery(output.GetTerminalId(), len(output.GetData()))
+				// Record and broadcast under the session lock so a joining
+				// client sees each chunk either in its replay or live, never
+				// both and never neither.
+				session.Mu.Lock()
+				terminal := s.terminalLocked(session, output.GetTerminalId())
+				terminal.Started = true
+				terminal.WriteOutputLocked(output.GetData())
 				if s.hub != nil {
 					message := types.Message{
 						Type:       "pty_output",
 						TerminalID: output.GetTerminalId(),
-						Content:    string(output.GetData()),
+						Data:       output.GetData(),
 						Sender:     "pty_agent",
+						Delivery:   delivery,
 					}
 					s.hub.BroadcastToSession(sessionID, message)
 				}
+				session.Mu.Unlock()
+				delivery.Release()
 			case *pb.ClientUpdate_TerminalCreatedResponse:
 				resp := payload.TerminalCreatedResponse
 				log.Printf("Session [%s]: Agent confirmed creation of terminal [%s]", sessionID, resp.GetTerminalId())
 
 				session.Mu.Lock()
-				terminal, exists := session.Terminals[resp.GetTerminalId()]
-				if !exists {
-					terminal = &types.Terminal{ID: resp.GetTerminalId(), CreatedAt: time.Now()}
-					session.Terminals[resp.GetTerminalId()] = terminal
-				}
+				terminal := s.terminalLocked(session, resp.GetTerminalId())
+				terminal.Started = true
+				terminal.ReadOnly = resp.GetReadOnly()
 				frontendID := terminal.FrontendID 
 				session.Mu.Unlock()
 
@@ -122,15 +402,19 @@ func (s *ShellSyncService) Stream(stream pb.ShellSync_StreamServer) error {
 					Type:       "terminal_created",
 					TerminalID: resp.GetTerminalId(),
 					FrontendID: frontendID,
+					ReadOnly:   resp.GetReadOnly(),
 				}
 				s.hub.BroadcastToSession(sessionID, message)
 			case *pb.ClientUpdate_TerminalError:
 				errMsg := payload.TerminalError
 				log.Printf("Session [%s]: Agent reported error for terminal [%s]: %s", sessionID, errMsg.GetTerminalId(), errMsg.GetError())
+				// Only a terminal that failed to start is dropped; errors about
+				// a running terminal (a failed signal, say) leave it alone and
+				// carry no frontend ID, so the window keeps its terminal.
 				session.Mu.Lock()
 				terminal, exists := session.Terminals[errMsg.GetTerminalId()]
 				frontendID := ""
-				if exists {
+				if exists && !terminal.Started {
 					frontendID = terminal.FrontendID
 					delete(session.Terminals, errMsg.GetTerminalId())
 				}
@@ -145,32 +429,164 @@ func (s *ShellSyncService) Stream(stream pb.ShellSync_StreamServer) error {
 					}
 					s.hub.BroadcastToSession(sessionID, errorMsg)
 				}
+			case *pb.ClientUpdate_TerminalExited:
+				exited := payload.TerminalExited
+				log.Printf("Session [%s]: Terminal [%s] exited (code %d, signal %q)", sessionID, exited.GetTerminalId(), exited.GetExitCode(), exited.GetSignal())
+				session.Mu.Lock()
+				frontendID := ""
+				if terminal, exists := session.Terminals[exited.GetTerminalId()]; exists {
+					frontendID = terminal.FrontendID
+					delete(session.Terminals, exited.GetTerminalId())
+				}
+				session.Mu.Unlock()
+				if s.hub != nil {
+					s.hub.BroadcastToSession(sessionID, types.Message{
+						Type:       "terminal_exited",
+						TerminalID: exited.GetTerminalId(),
+						FrontendID: frontendID,
+						ExitCode:   int(exited.GetExitCode()),
+						Signal:     exited.GetSignal(),
+						Sender:     "pty_agent",
+					})
+				}
 			}
 		}
 	}()
 
 
+	// Sending runs apart from the handler: on a half-dead link a Send can
+	// block until the transport gives up, and the stream must still be
+	// dropped, and the session go to Reconnecting, once the agent is silent
+	// for too long. Returning ends the RPC, which also unblocks the Send.
+	done := make(chan error, 2)
+	go func() { done <- s.sendToAgent(ctx, stream, session, link) }()
+	if s.cfg.HeartbeatInterval > 0 && s.cfg.HeartbeatTimeout > 0 {
+		go func() { done <- watchSilence(ctx, &lastHeard, s.cfg.HeartbeatTimeout) }()
+	}
+	select {
+	case err := <-done:
+		if status.Code(err) == codes.DeadlineExceeded {
+			log.Printf("Agent for session %s: %v, dropping its stream.", sessionID, err)
+		}
+		return err
+	case <-ctx.Done():
+		// AgentInputChan stays open: commands queue up for the agent's
+		// next stream.
+		log.Printf("Agent for session %s disconnected.", sessionID)
+		return ctx.Err()
+	}
+}
+
+// watchSilence returns once nothing has been heard from the agent, as
+// recorded in lastHeard, for longer than timeout, or ctx is done.
+func watchSilence(ctx context.Context, lastHeard *atomic.Int64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	for {
+		silent := time.Since(time.Unix(0, lastHeard.Load()))
+		if silent > timeout {
+			return status.Errorf(codes.DeadlineExceeded, "no heartbeat for %s", silent.Round(time.Millisecond))
+		}
+		timer.Reset(timeout - silent + time.Millisecond)
 		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sendToAgent sends the agent heartbeats, output credit, input, the
+// participants and the commands of its session until ctx is done or a Send
+// fails.
+func (s *ShellSyncService) sendToAgent(ctx context.Context, stream pb.ShellSync_StreamServer, session *types.Session, link *agentLink) error {
+	sessionID := session.ID
+	var heartbeat <-chan time.Time
+	if s.cfg.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(s.cfg.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	var pingSeq uint64
+
+	for ctx.Err() == nil {
+		select {
+		case <-heartbeat:
+			pingSeq++
+			ping := &pb.ServerUpdate{
+				Payload: &pb.ServerUpdate_Ping{
+					Ping: &pb.Heartbeat{
+						Seq:          pingSeq,
+						SentUnixNano: time.Now().UnixNano(),
+						TimeoutMs:    uint32(s.cfg.HeartbeatTimeout / time.Millisecond),
+					},
+				},
+			}
+			if err := stream.Send(ping); err != nil {
+				log.Printf("Error sending heartbeat to agent for session %s: %v", sessionID, err)
+				return err
+			}
+		case <-link.wake:
+			if err := link.sendOutputCredits(stream); err != nil {
+				log.Printf("Error sending output credit to agent for session %s: %v", sessionID, err)
+				return err
+			}
+		case <-session.InputReady:
+			if err := s.sendInput(session, link, stream); err != nil {
+				log.Printf("Error sending input to agent for session %s: %v", sessionID, err)
+				return err
+			}
+		case <-session.ClientsChanged:
+			session.Mu.RLock()
+			clientIDs := session.ClientIDsLocked()
+			session.Mu.RUnlock()
+			participants := &pb.ServerUpdate{
+				Payload: &pb.ServerUpdate_Participants{
+					Participants: &pb.Participants{ClientIds: clientIDs},
+				},
+			}
+			if err := stream.Send(participants); err != nil {
+				log.Printf("Error sending participants to agent for session %s: %v", sessionID, err)
+				return err
+			}
 		case <-ctx.Done():
-			log.Printf("Agent for session %s disconnected.", sessionID)
-			close(session.AgentInputChan)
 			return ctx.Err()
 		case command := <-session.AgentInputChan:
 			var serverUpdate *pb.ServerUpdate
 
 			switch cmd := command.(type) {
-			case types.PtyInputData:
-				serverUpdate = &pb.ServerUpdate{
-					Payload: &pb.ServerUpdate_PtyInput{
-						PtyInput: &pb.TerminalInput{TerminalId: cmd.TerminalID, Data: cmd.Data},
-					},
-				}
 			case types.CreateTerminalCmd:
 				serverUpdate = &pb.ServerUpdate{
 					Payload: &pb.ServerUpdate_CreateTerminalRequest{
 						CreateTerminalRequest: &pb.CreateTerminalRequest{
 							TerminalId: cmd.TerminalID,
+							Command:    cmd.Options.Command,
+							Args:       cmd.Options.Args,
+							Cwd:        cmd.Options.Cwd,
+							Env:        cmd.Options.Env,
+							Term:       cmd.Options.Term,
+						},
+					},
+				}
+			case types.CloseTerminalCmd:
+				serverUpdate = &pb.ServerUpdate{
+					Payload: &pb.ServerUpdate_CloseTerminalRequest{
+						CloseTerminalRequest: &pb.CloseTerminalRequest{TerminalId: cmd.TerminalID},
+					},
+				}
+			case types.SignalTerminalCmd:
+				serverUpdate = &pb.ServerUpdate{
+					Payload: &pb.ServerUpdate_Signal{
+						Signal: &pb.SignalRequest{TerminalId: cmd.TerminalID, Signal: cmd.Signal},
+					},
+				}
+			case types.ResizeTerminalCmd:
+				serverUpdate = &pb.ServerUpdate{
+					Payload: &pb.ServerUpdate_Resize{
+						Resize: &pb.TerminalResize{
+							TerminalId: cmd.TerminalID,
+							Rows:       uint32(cmd.Rows),
+							Cols:       uint32(cmd.Cols),
 						},
 					},
 				}
@@ -178,28 +594,242 @@ func (s *ShellSyncService) Stream(stream pb.ShellSync_StreamServer) error {
 
 			if err := stream.Send(serverUpdate); err != nil {
 				log.Printf("Error sending command to agent for session %s: %v", sessionID, err)
+				s.requeueCommand(session, command)
 				return err
 			}
 		}
 	}
+	return ctx.Err()
+}
+
+// resumeLocked reconciles the session with the terminals a reconnecting agent
+// still has. Started terminals the agent no longer knows ended while the
+// link was down without their exit reaching us; they are removed and
+// returned. It must be called with the session lock held.
+func (s *ShellSyncService) resumeLocked(session *types.Session, agentTerminals []string) []string {
+	alive := make(map[string]bool, len(agentTerminals))
+	for _, id := range agentTerminals {
+		alive[id] = true
+		s.terminalLocked(session, id).Started = true
+	}
+	var vanished []string
+	for id, terminal := range session.Terminals {
+		if terminal.Started && !alive[id] {
+			delete(session.Terminals, id)
+			vanished = append(vanished, id)
+		}
+	}
+	return vanished
+}
+
+// setAgentState records the agent's connection state and tells the browsers
+// when it changes.
+func (s *ShellSyncService) setAgentState(session *types.Session, state types.AgentState) {
+	session.Mu.Lock()
+	changed := session.AgentState != state
+	session.AgentState = state
+	if state != types.AgentConnected {
+		session.AgentLatency = 0
+	}
+	latency := session.AgentLatency
+	session.Mu.Unlock()
+	if !changed {
+		return
+	}
+	log.Printf("Session [%s]: agent is %s", session.ID, state)
+	s.broadcastAgentStatus(session.ID, state, latency)
+}
+
+// recordLatency stores the round trip of a heartbeat and passes it on to the
+// browsers along with the agent status.
+func (s *ShellSyncService) recordLatency(session *types.Session, rtt time.Duration) {
+	session.Mu.Lock()
+	session.AgentLatency = rtt
+	state := session.AgentState
+	session.Mu.Unlock()
+	s.broadcastAgentStatus(session.ID, state, rtt)
+}
+
+// recordNotice keeps the agent's warning that it will end the session for
+// clients that join later and passes it on to the clients there are.
+func (s *ShellSyncService) recordNotice(session *types.Session, link *agentLink, notice *pb.AgentNotice) {
+	var recorded *types.AgentNotice
+	if notice.GetReason() != "" {
+		recorded = &types.AgentNotice{
+			Reason:   notice.GetReason(),
+			Message:  notice.GetMessage(),
+			Deadline: time.UnixMilli(notice.GetDeadlineUnixMs()),
+			Final:    notice.GetFinal(),
+		}
+		log.Printf("Session [%s]: agent notice (%s): %s", session.ID, recorded.Reason, recorded.Message)
+	}
+	if notice.GetFinal() {
+		link.ending.Store(true)
+	}
+	session.Mu.Lock()
+	session.Notice = recorded
+	session.Mu.Unlock()
+	if s.hub != nil {
+		s.hub.BroadcastToSession(session.ID, types.Message{
+			Type:   "agent_notice",
+			Notice: recorded,
+			Sender: "pty_agent",
+		})
+	}
+}
+
+func (s *ShellSyncService) broadcastAgentStatus(sessionID string, state types.AgentState, latency time.Duration) {
+	if s.hub == nil {
+		return
+	}
+	s.hub.BroadcastToSession(sessionID, types.Message{
+		Type:         "agent_status",
+		AgentStatus:  state,
+		AgentLatency: latency,
+		Sender:       "server",
+	})
+}
+
+// agentGone runs when an agent has not come back within the grace period,
+// or right away when the agent said it was shutting down. The session is
+// marked disconnected and the commands queued for the agent are dropped;
+// terminals that were waiting to be created fail.
+func (s *ShellSyncService) agentGone(session *types.Session) {
+	s.mu.Lock()
+	if s.links[session.ID] != nil {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.graceTimers, session.ID)
+	s.mu.Unlock()
+
+	var failed []types.CreateTerminalCmd
+	session.Mu.Lock()
+	if session.AgentState != types.AgentReconnecting {
+		session.Mu.Unlock()
+		return
+	}
+	session.AgentState = types.AgentDisconnected
+	notice := session.Notice
+	droppedInput := dropQueuedInputLocked(session)
+drain:
+	for {
+		select {
+		case command := <-session.AgentInputChan:
+			if cmd, ok := command.(types.CreateTerminalCmd); ok {
+				delete(session.Terminals, cmd.TerminalID)
+				failed = append(failed, cmd)
+			}
+		default:
+			break drain
+		}
+	}
+	session.Mu.Unlock()
+
+	if notice != nil && notice.Final {
+		log.Printf("Session [%s]: agent ended the session: %s", session.ID, notice.Message)
+	} else {
+		log.Printf("Session [%s]: agent did not reconnect within %s", session.ID, s.cfg.AgentGracePeriod)
+	}
+	s.broadcastAgentStatus(session.ID, types.AgentDisconnected, 0)
+	for terminalID, clients := range droppedInput {
+		s.ackInput(session.ID, terminalID, clients)
+	}
+	if s.hub == nil {
+		return
+	}
+	for _, cmd := range failed {
+		s.hub.BroadcastToSession(session.ID, types.Message{
+			Type:       "terminal_error",
+			TerminalID: cmd.TerminalID,
+			FrontendID: cmd.FrontendID,
+			Error:      ErrAgentUnavailable.Error(),
+			Sender:     "server",
+		})
+	}
+}
+
+// requeueCommand puts back a command a stream took but failed to send, such
+// as a stale stream racing the one that resumes the session, so the agent's
+// next stream sends it. If the queue has filled up meanwhile the command is
+// dropped, and a terminal waiting for it to be created fails.
+func (s *ShellSyncService) requeueCommand(session *types.Session, command types.AgentCommand) {
+	select {
+	case session.AgentInputChan <- command:
+		return
+	default:
+	}
+	log.Printf("Session [%s]: command %T dropped: %v", session.ID, command, ErrAgentBusy)
+	if cmd, ok := command.(types.CreateTerminalCmd); ok {
+		session.Mu.Lock()
+		delete(session.Terminals, cmd.TerminalID)
+		session.Mu.Unlock()
+		s.refuseTerminal(session.ID, cmd.FrontendID, ErrAgentBusy)
+	}
+}
+
+// queueCommand hands a command to the session's agent. While the agent is
+// reconnecting, commands wait for its next stream; with no agent at all, or
+// a full queue, they are refused rather than blocking.
+func queueCommand(session *types.Session, command types.AgentCommand) error {
+	session.Mu.RLock()
+	defer session.Mu.RUnlock()
+	if session.AgentState == types.AgentDisconnected {
+		return ErrAgentUnavailable
+	}
+	select {
+	case session.AgentInputChan <- command:
+		return nil
+	default:
+		return ErrAgentBusy
+	}
 }
 
-func (s *ShellSyncService) ForwardInputToAgent(sessionID, terminalID string, input []byte) {
+// ForwardInputToAgent queues input from a client for the agent. Input waits
+// in the terminal while the agent's input window is full or the agent is
+// reconnecting; only once InputBufferBytes are waiting is more refused.
+func (s *ShellSyncService) ForwardInputToAgent(sessionID, terminalID, clientID string, input []byte) error {
 	s.mu.RLock()
 	session, exists := s.sessions[sessionID]
 	s.mu.RUnlock()
 
 	if !exists {
-		return
+		return fmt.Errorf("session %s not found", sessionID)
 	}
-	select {
-	case session.AgentInputChan <- types.PtyInputData{TerminalID: terminalID, Data: input}:
-	default:
-		log.Printf("Agent input channel for session %s is full. Input dropped.", sessionID)
+	if err := queueInput(session, terminalID, clientID, input, s.cfg.InputBufferBytes); err != nil {
+		log.Printf("Session [%s]: input for terminal [%s] dropped: %v", sessionID, terminalID, err)
+		return err
+	}
+	notify(session.InputReady)
+	return nil
+}
+
+func queueInput(session *types.Session, terminalID, clientID string, input []byte, limit int) error {
+	session.Mu.Lock()
+	defer session.Mu.Unlock()
+	if session.AgentState == types.AgentDisconnected {
+		return ErrAgentUnavailable
+	}
+	terminal, ok := session.Terminals[terminalID]
+	if !ok {
+		return fmt.Errorf("terminal %s not found", terminalID)
+	}
+	if terminal.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(terminal.Input)+len(input) > limit {
+		return ErrAgentBusy
 	}
+	terminal.Input = append(terminal.Input, input...)
+	if n := len(terminal.InputSources); n > 0 && terminal.InputSources[n-1].ClientID == clientID {
+		terminal.InputSources[n-1].Bytes += len(input)
+	} else {
+		terminal.InputSources = append(terminal.InputSources, types.InputSource{ClientID: clientID, Bytes: len(input)})
+	}
+	return nil
 }
 
-func (s *ShellSyncService) RequestNewTerminal(sessionID, frontendID string) {
+func (s *ShellSyncService) RequestNewTerminal(sessionID, frontendID string, opts types.TerminalOptions) {
 	s.mu.RLock()
 	session, ok := s.sessions[sessionID]
 	s.mu.RUnlock()
@@ -223,32 +853,26 @@ func (s *ShellSyncService) RequestNewTerminal(sessionID, frontendID string) {
 	if session.Terminals == nil {
 		session.Terminals = make(map[string]*types.Terminal)
 	}
-	session.Terminals[backendTerminalID] = &types.Terminal{
-		ID:         backendTerminalID,
-		CreatedAt:  time.Now(),
-		FrontendID: frontendID, 
+	if max := s.cfg.MaxTerminals; max > 0 && len(session.Terminals) >= max {
+		session.Mu.Unlock()
+		s.refuseTerminal(sessionID, frontendID, fmt.Errorf("this session allows at most %d terminals", max))
+		return
 	}
+	session.Terminals[backendTerminalID] = s.newTerminal(backendTerminalID, frontendID)
 	session.Mu.Unlock()
 	log.Printf("Requesting agent to create terminal with ID %s for session %s", backendTerminalID, sessionID)
 
 
-	select {
-	case session.AgentInputChan <- types.CreateTerminalCmd{
+	err := queueCommand(session, types.CreateTerminalCmd{
 		TerminalID: backendTerminalID,
 		FrontendID: frontendID, 
-	}:
-
-	default:
-		log.Printf("Agent input channel for session %s is full. Terminal creation dropped.", sessionID)
-		if s.hub != nil {
-			errorMsg := types.Message{
-				Type:       "terminal_error",
-				FrontendID: frontendID,
-				Error:      "Agent is busy. Try again.",
-				Sender:     "pty_agent",
-			}
-			s.hub.BroadcastToSession(sessionID, errorMsg)
-		}
+		Options:    opts,
+	})
+	if err != nil {
+		session.Mu.Lock()
+		delete(session.Terminals, backendTerminalID)
+		session.Mu.Unlock()
+		s.refuseTerminal(sessionID, frontendID, err)
 		return
 	}
 
@@ -266,16 +890,330 @@ func (s *ShellSyncService) RequestNewTerminal(sessionID, frontendID string) {
 	//log.Printf("Terminal %s registered in session state. Waiting for agent confirmation.", backendTerminalID)
 }
 
+// refuseTerminal tells the clients that the terminal a client asked for is
+// not going to be created.
+func (s *ShellSyncService) refuseTerminal(sessionID, frontendID string, err error) {
+	log.Printf("Session [%s]: terminal creation dropped: %v", sessionID, err)
+	if s.hub != nil {
+		errorMsg := types.Message{
+			Type:       "terminal_error",
+			FrontendID: frontendID,
+			Error:      err.Error(),
+			Sender:     "pty_agent",
+		}
+		s.hub.BroadcastToSession(sessionID, errorMsg)
+	}
+}
+
+// CloseTerminal asks the agent to hang up a terminal. The terminal stays in the
+// session until the agent reports that its shell has exited. Read-only
+// terminals end only with their command.
+func (s *ShellSyncService) CloseTerminal(sessionID, terminalID string) {
+	s.mu.RLock()
+	session, exists := s.sessions[sessionID]
+	s.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	session.Mu.RLock()
+	terminal, ok := session.Terminals[terminalID]
+	readOnly := ok && terminal.ReadOnly
+	session.Mu.RUnlock()
+	if !ok {
+		log.Printf("Session [%s]: close requested for unknown terminal [%s]", sessionID, terminalID)
+		return
+	}
+
+	err := ErrReadOnly
+	if !readOnly {
+		err = queueCommand(session, types.CloseTerminalCmd{TerminalID: terminalID})
+	}
+	if err != nil {
+		log.Printf("Session [%s]: close of terminal [%s] dropped: %v", sessionID, terminalID, err)
+		if s.hub != nil {
+			s.hub.BroadcastToSession(sessionID, types.Message{
+				Type:       "terminal_error",
+				TerminalID: terminalID,
+				Error:      err.Error(),
+				Sender:     "pty_agent",
+			})
+		}
+	}
+}
+
+// SignalTerminal asks the agent to deliver a signal to the foreground job of a
+// terminal. The agent reports a bad signal name or a failed delivery as a
+// terminal error.
+func (s *ShellSyncService) SignalTerminal(sessionID, terminalID, signal string) {
+	s.mu.RLock()
+	session, exists := s.sessions[sessionID]
+	s.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	session.Mu.RLock()
+	terminal, ok := session.Terminals[terminalID]
+	readOnly := ok && terminal.ReadOnly
+	session.Mu.RUnlock()
+	if !ok {
+		log.Printf("Session [%s]: signal requested for unknown terminal [%s]", sessionID, terminalID)
+		return
+	}
+
+	err := ErrReadOnly
+	if !readOnly {
+		err = queueCommand(session, types.SignalTerminalCmd{TerminalID: terminalID, Signal: signal})
+	}
+	if err != nil {
+		log.Printf("Session [%s]: signal %s for terminal [%s] dropped: %v", sessionID, signal, terminalID, err)
+		if s.hub != nil {
+			s.hub.BroadcastToSession(sessionID, types.Message{
+				Type:       "terminal_error",
+				TerminalID: terminalID,
+				Error:      "Signal not sent: " + err.Error(),
+				Sender:     "pty_agent",
+			})
+		}
+	}
+}
+
+// ResizeTerminal records the viewport size reported by one browser client and
+// resizes the agent PTY when the effective size changes. Several viewers can
+// watch the same terminal with differently sized windows, so like tmux the
+// smallest viewer wins: the PTY gets the minimum rows and the minimum columns
+// across all clients, which keeps full-screen programs usable for everyone.
+func (s *ShellSyncService) ResizeTerminal(sessionID, terminalID, clientID string, rows, cols uint16) {
+	if rows == 0 || cols == 0 {
+		return
+	}
+	s.mu.RLock()
+	session, exists := s.sessions[sessionID]
+	s.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	session.Mu.Lock()
+	terminal, ok := session.Terminals[terminalID]
+	if !ok {
+		session.Mu.Unlock()
+		log.Printf("Session [%s]: resize for unknown terminal [%s]", sessionID, terminalID)
+		return
+	}
+	if terminal.Sizes == nil {
+		terminal.Sizes = make(map[string]types.TerminalSize)
+	}
+	terminal.Sizes[clientID] = types.TerminalSize{Rows: rows, Cols: cols}
+	size, changed := applySmallestSize(terminal)
+	session.Mu.Unlock()
+
+	if changed {
+		s.sendResize(session, terminalID, size)
+	}
+}
+
+// resizeForHost records the size of the window the agent's host uses a
+// terminal in, as one more viewer. The host reports it before the terminal
+// may be known here, so the terminal is created if need be.
+func (s *ShellSyncService) resizeForHost(session *types.Session, resize *pb.TerminalResize) {
+	if resize.GetRows() == 0 || resize.GetCols() == 0 {
+		return
+	}
+	session.Mu.Lock()
+	terminal := s.terminalLocked(session, resize.GetTerminalId())
+	if terminal.Sizes == nil {
+		terminal.Sizes = make(map[string]types.TerminalSize)
+	}
+	terminal.Sizes[types.HostViewer] = types.TerminalSize{Rows: uint16(resize.GetRows()), Cols: uint16(resize.GetCols())}
+	size, changed := applySmallestSize(terminal)
+	session.Mu.Unlock()
+
+	if changed {
+		s.sendResize(session, resize.GetTerminalId(), size)
+	}
+}
+
+// RemoveClientFromSession closes one connection of a client. With its last
+// one the client leaves the participants, and the sizes it reported are
+// forgotten, so a small window that was closed no longer constrains the
+// remaining viewers.
+func (s *ShellSyncService) RemoveClientFromSession(sessionID, clientID string) {
+	s.mu.RLock()
+	session, exists := s.sessions[sessionID]
+	s.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	session.Mu.Lock()
+	if client, ok := session.Clients[clientID]; ok && client.Conns > 1 {
+		client.Conns--
+		session.Mu.Unlock()
+		return
+	}
+	delete(session.Clients, clientID)
+	notify(session.ClientsChanged)
+	resized := forgetSizesLocked(session, clientID)
+	session.Mu.Unlock()
+
+	for id, size := range resized {
+		s.sendResize(session, id, size)
+	}
+}
+
+// forgetSizesLocked drops the sizes a client reported and returns the
+// terminals whose size changed. It must be called with the session lock
+// held.
+func forgetSizesLocked(session *types.Session, clientID string) map[string]types.TerminalSize {
+	resized := make(map[string]types.TerminalSize)
+	for id, terminal := range session.Terminals {
+		if _, ok := terminal.Sizes[clientID]; !ok {
+			continue
+		}
+		delete(terminal.Sizes, clientID)
+		if size, changed := applySmallestSize(terminal); changed {
+			resized[id] = size
+		}
+	}
+	return resized
+}
+
+func (s *ShellSyncService) sendResize(session *types.Session, terminalID string, size types.TerminalSize) {
+	if err := queueCommand(session, types.ResizeTerminalCmd{TerminalID: terminalID, Rows: size.Rows, Cols: size.Cols}); err != nil {
+		log.Printf("Session [%s]: resize of terminal [%s] dropped: %v", session.ID, terminalID, err)
+	}
+}
+
+// applySmallestSize recomputes the effective size of a terminal from the
+// sizes of its viewers. It must be called with the session lock held.
+func applySmallestSize(terminal *types.Terminal) (types.TerminalSize, bool) {
+	var size types.TerminalSize
+	for _, sz := range terminal.Sizes {
+		if size.Rows == 0 || sz.Rows < size.Rows {
+			size.Rows = sz.Rows
+		}
+		if size.Cols == 0 || sz.Cols < size.Cols {
+			size.Cols = sz.Cols
+		}
+	}
+	if size.Rows == 0 || size == terminal.Size {
+		return terminal.Size, false
+	}
+	terminal.Size = size
+	if terminal.Screen != nil {
+		terminal.Screen.Resize(int(size.Rows), int(size.Cols))
+	}
+	return size, true
+}
+
+// TerminalScreen returns the current screen of a terminal as plain text, or
+// as ANSI output that redraws it. It reports false if the terminal does not
+// exist or the screen model is disabled.
+func (s *ShellSyncService) TerminalScreen(sessionID, terminalID string, ansi bool) ([]byte, bool) {
+	session, exists := s.GetSession(sessionID)
+	if !exists {
+		return nil, false
+	}
+	session.Mu.RLock()
+	defer session.Mu.RUnlock()
+	terminal, ok := session.Terminals[terminalID]
+	if !ok || terminal.Screen == nil {
+		return nil, false
+	}
+	if ansi {
+		return terminal.Screen.ANSI(), true
+	}
+	return []byte(terminal.Screen.Text()), true
+}
+
 func (s *ShellSyncService) GetSession(sessionID string) (*types.Session, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	session, exists := s.sessions[sessionID]
 	return session, exists
 }
-func (s *ShellSyncService) AddClientToSession(sessionID, clientID string) bool {
+func (s *ShellSyncService) AddClientToSession(sessionID, clientID, role string) bool {
+	s.mu.RLock()
+	session, exists := s.sessions[sessionID]
+	s.mu.RUnlock()
+	if !exists {
+		return false
+	}
 
+	session.Mu.Lock()
+	defer session.Mu.Unlock()
+	if session.Clients == nil {
+		session.Clients = make(map[string]*types.Client)
+	}
+	// Another connection of the same client keeps the role it has.
+	if client, ok := session.Clients[clientID]; ok {
+		client.Conns++
+		client.LastSeen = time.Now()
+		return true
+	}
+	if override, ok := session.RoleOverrides[clientID]; ok && role != auth.RoleOwner {
+		role = override
+	}
+	session.Clients[clientID] = &types.Client{ID: clientID, LastSeen: time.Now(), Role: role, Conns: 1}
+	notify(session.ClientsChanged)
 	return true
 }
+
+// ClientRole returns the role of a client in the session, or "" if it is
+// not in the session.
+func (s *ShellSyncService) ClientRole(sessionID, clientID string) string {
+	session, exists := s.GetSession(sessionID)
+	if !exists {
+		return ""
+	}
+	session.Mu.RLock()
+	defer session.Mu.RUnlock()
+	if client, ok := session.Clients[clientID]; ok {
+		return client.Role
+	}
+	return ""
+}
+
+// SetClientRole makes a client an editor or a viewer. The role outlives the
+// connection: it replaces the role of the client's join token whenever the
+// client joins the session again. The owner's role cannot be changed. The
+// sizes of a client made a viewer no longer count.
+func (s *ShellSyncService) SetClientRole(sessionID, clientID, role string) error {
+	if role != auth.RoleEditor && role != auth.RoleViewer {
+		return fmt.Errorf("cannot give the role %q", role)
+	}
+	session, exists := s.GetSession(sessionID)
+	if !exists {
+		return fmt.Errorf("session %s not found", sessionID)
+	}
+	session.Mu.Lock()
+	client, ok := session.Clients[clientID]
+	if !ok {
+		session.Mu.Unlock()
+		return fmt.Errorf("client %s is not in the session", clientID)
+	}
+	if client.Role == auth.RoleOwner {
+		session.Mu.Unlock()
+		return errors.New("the owner's role cannot be changed")
+	}
+	client.Role = role
+	if session.RoleOverrides == nil {
+		session.RoleOverrides = make(map[string]string)
+	}
+	session.RoleOverrides[clientID] = role
+	var resized map[string]types.TerminalSize
+	if role == auth.RoleViewer {
+		resized = forgetSizesLocked(session, clientID)
+	}
+	session.Mu.Unlock()
+
+	for id, size := range resized {
+		s.sendResize(session, id, size)
+	}
+	return nil
+}
 func (s *ShellSyncService) GetSessions() []*types.Session {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -0,0 +1,434 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+	"github.com/Ayush-Vish/shellsync/backend/internal/auth"
+	"github.com/Ayush-Vish/shellsync/backend/internal/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestStreamChecksAgent checks that only the agent with the session's
+// secret can attach, and that a second one is turned away unless it
+// resumes the session.
+func TestStreamChecksAgent(t *testing.T) {
+	svc, _, _, sessionID := startFlowSession(t, DefaultConfig(), &pb.InitialAgentMessage{})
+	session, _ := svc.GetSession(sessionID)
+
+	attach := func(hello *pb.InitialAgentMessage) <-chan error {
+		hello.SessionId = sessionID
+		stream := newFakeAgentStream(t)
+		stream.recv <- &pb.ClientUpdate{Payload: &pb.ClientUpdate_InitialMessage{InitialMessage: hello}}
+		done := make(chan error, 1)
+		go func() { done <- svc.Stream(stream) }()
+		return done
+	}
+	wantCode := func(done <-chan error, want codes.Code) {
+		t.Helper()
+		select {
+		case err := <-done:
+			if status.Code(err) != want {
+				t.Errorf("Stream = %v, want code %v", err, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Stream still running, want code %v", want)
+		}
+	}
+
+	wantCode(attach(&pb.InitialAgentMessage{AgentSecret: "guess"}), codes.PermissionDenied)
+	wantCode(attach(&pb.InitialAgentMessage{}), codes.PermissionDenied)
+	wantCode(attach(&pb.InitialAgentMessage{AgentSecret: session.AgentSecret}), codes.AlreadyExists)
+
+	// The first stream is dropped for the resuming one, which stays.
+	resumed := attach(&pb.InitialAgentMessage{AgentSecret: session.AgentSecret, Resume: true})
+	select {
+	case err := <-resumed:
+		t.Fatalf("resuming agent refused: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// brokenAgentStream fails to send terminal creations, like a stream that
+// dies under the backend just as it takes one.
+type brokenAgentStream struct {
+	*fakeAgentStream
+}
+
+func (f brokenAgentStream) Send(update *pb.ServerUpdate) error {
+	if update.GetCreateTerminalRequest() != nil {
+		return errors.New("stream broken")
+	}
+	return f.fakeAgentStream.Send(update)
+}
+
+// TestFailedSendIsRequeued checks that a command taken by a stream that then
+// fails to send it reaches the agent's next stream instead of being lost.
+func TestFailedSendIsRequeued(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HeartbeatInterval = 0
+	svc := NewShellSyncService(cfg)
+	svc.SetHub(&fakeHub{inputAcks: make(map[string]int)})
+	resp, err := svc.CreateSession(context.Background(), &pb.CreateRequest{Host: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := func(resume bool) *pb.ClientUpdate {
+		return &pb.ClientUpdate{Payload: &pb.ClientUpdate_InitialMessage{InitialMessage: &pb.InitialAgentMessage{
+			SessionId: resp.GetSessionId(), AgentSecret: resp.GetAgentSecret(), Resume: resume,
+		}}}
+	}
+
+	broken := brokenAgentStream{newFakeAgentStream(t)}
+	broken.recv <- hello(false)
+	brokenDone := make(chan error, 1)
+	go func() { brokenDone <- svc.Stream(broken) }()
+	session, _ := svc.GetSession(resp.GetSessionId())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		session.Mu.RLock()
+		state := session.AgentState
+		session.Mu.RUnlock()
+		if state == types.AgentConnected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not connect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	svc.RequestNewTerminal(resp.GetSessionId(), "f", types.TerminalOptions{})
+	select {
+	case <-brokenDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broken stream kept running")
+	}
+
+	resumed := newFakeAgentStream(t)
+	resumed.recv <- hello(true)
+	go svc.Stream(resumed)
+	create := next[*pb.ServerUpdate_CreateTerminalRequest](t, resumed).CreateTerminalRequest
+	session.Mu.RLock()
+	terminal := session.Terminals[create.GetTerminalId()]
+	session.Mu.RUnlock()
+	if terminal == nil || terminal.FrontendID != "f" {
+		t.Fatalf("terminal %s is not waiting for the agent", create.GetTerminalId())
+	}
+}
+
+// TestSharedLinkClients checks that browsers joining with a shared link are
+// named by the server and cannot become the owner, and that a role the owner
+// gave a client survives its reconnecting.
+func TestSharedLinkClients(t *testing.T) {
+	svc := NewShellSyncService(DefaultConfig())
+	resp, err := svc.CreateSession(context.Background(), &pb.CreateRequest{Host: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := resp.GetSessionId()
+	query := func(link string) url.Values {
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Query()
+	}
+	owner := query(resp.GetFrontendUrl())
+	ownerID := owner.Get("client_id")
+	claims, err := svc.VerifyJoinToken(sessionID, ownerID, owner.Get("token"))
+	if err != nil || claims.Role != auth.RoleOwner {
+		t.Fatalf("owner link: %+v, %v", claims, err)
+	}
+	svc.AddClientToSession(sessionID, ownerID, claims.Role)
+
+	// An editor asking to be the owner is not let in as the owner, and a
+	// link without a client is named by the server.
+	editorToken := query(resp.GetEditorUrl()).Get("token")
+	claims, err = svc.VerifyJoinToken(sessionID, ownerID, editorToken)
+	if err != nil || claims.ClientID != "" || claims.Role != auth.RoleEditor {
+		t.Fatalf("editor link: %+v, %v", claims, err)
+	}
+	claims, rejoin := svc.AssignClientID(claims)
+	editorID := claims.ClientID
+	if editorID == "" || editorID == ownerID {
+		t.Fatalf("editor named %q", editorID)
+	}
+	if _, err := svc.VerifyJoinToken(sessionID, ownerID, rejoin); !errors.Is(err, auth.ErrWrongClient) {
+		t.Fatalf("the editor's own token let it in as the owner: %v", err)
+	}
+	svc.AddClientToSession(sessionID, editorID, claims.Role)
+
+	if err := svc.SetClientRole(sessionID, editorID, auth.RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SetClientRole(sessionID, ownerID, auth.RoleViewer); err == nil {
+		t.Fatal("the owner was made a viewer")
+	}
+	svc.RemoveClientFromSession(sessionID, editorID)
+	claims, err = svc.VerifyJoinToken(sessionID, editorID, rejoin)
+	if err != nil || claims.ClientID != editorID || claims.Role != auth.RoleEditor {
+		t.Fatalf("rejoin token: %+v, %v", claims, err)
+	}
+	svc.AddClientToSession(sessionID, editorID, claims.Role)
+	if role := svc.ClientRole(sessionID, editorID); role != auth.RoleViewer {
+		t.Fatalf("rejoined as %s, want the viewer it was made", role)
+	}
+	if role := svc.ClientRole(sessionID, ownerID); role != auth.RoleOwner {
+		t.Fatalf("owner is now %s", role)
+	}
+
+	// A second tab of the same client shares its role, and closing either
+	// leaves the other in the session.
+	svc.AddClientToSession(sessionID, editorID, claims.Role)
+	svc.RemoveClientFromSession(sessionID, editorID)
+	if role := svc.ClientRole(sessionID, editorID); role != auth.RoleViewer {
+		t.Fatalf("after one of two tabs closed the client is %q, want %s", role, auth.RoleViewer)
+	}
+	svc.RemoveClientFromSession(sessionID, editorID)
+	if role := svc.ClientRole(sessionID, editorID); role != "" {
+		t.Fatalf("client is still %s after its last tab closed", role)
+	}
+}
+
+// TestResizeUsesSmallestViewer checks that the agent PTY takes the smallest
+// rows and columns of the clients viewing a terminal, and is only resized
+// when that changes. The sizes of a client made a viewer stop counting.
+func TestResizeUsesSmallestViewer(t *testing.T) {
+	svc := NewShellSyncService(DefaultConfig())
+	resp, err := svc.CreateSession(context.Background(), &pb.CreateRequest{Host: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := resp.GetSessionId()
+	session, _ := svc.GetSession(sessionID)
+	session.Mu.Lock()
+	session.AgentState = types.AgentConnected
+	session.Terminals["t"] = &types.Terminal{ID: "t"}
+	session.Mu.Unlock()
+
+	resize := func(clientID string, rows, cols uint16) func() {
+		return func() { svc.ResizeTerminal(sessionID, "t", clientID, rows, cols) }
+	}
+	steps := []struct {
+		name string
+		do   func()
+		want *types.ResizeTerminalCmd
+	}{
+		{"first viewer", resize("a", 40, 120), &types.ResizeTerminalCmd{TerminalID: "t", Rows: 40, Cols: 120}},
+		{"smaller viewer", resize("b", 30, 100), &types.ResizeTerminalCmd{TerminalID: "t", Rows: 30, Cols: 100}},
+		{"rows and columns from different viewers", resize("a", 50, 80), &types.ResizeTerminalCmd{TerminalID: "t", Rows: 30, Cols: 80}},
+		{"larger viewer changes nothing", resize("c", 60, 200), nil},
+		{"zero size is ignored", resize("a", 0, 0), nil},
+		{"zero columns are ignored", resize("b", 10, 0), nil},
+		{"smaller viewer leaves", func() { svc.RemoveClientFromSession(sessionID, "b") }, &types.ResizeTerminalCmd{TerminalID: "t", Rows: 50, Cols: 80}},
+		{"unrelated viewer leaves", func() { svc.RemoveClientFromSession(sessionID, "d") }, nil},
+		{"editor with a small window", func() {
+			svc.AddClientToSession(sessionID, "e", auth.RoleEditor)
+			svc.ResizeTerminal(sessionID, "t", "e", 20, 60)
+		}, &types.ResizeTerminalCmd{TerminalID: "t", Rows: 20, Cols: 60}},
+		{"editor made a viewer", func() { svc.SetClientRole(sessionID, "e", auth.RoleViewer) }, &types.ResizeTerminalCmd{TerminalID: "t", Rows: 50, Cols: 80}},
+	}
+	for _, step := range steps {
+		step.do()
+		select {
+		case cmd := <-session.AgentInputChan:
+			if step.want == nil || cmd != *step.want {
+				t.Fatalf("%s: agent told %+v, want %+v", step.name, cmd, step.want)
+			}
+		default:
+			if step.want != nil {
+				t.Fatalf("%s: agent not told to resize to %+v", step.name, *step.want)
+			}
+		}
+	}
+}
+
+// TestCommandsWithoutAgent checks what becomes of the commands of clients
+// while the agent is away: they wait for it while it reconnects, and are
+// refused with an error, rather than blocking, once it is gone or the queue
+// is full.
+func TestCommandsWithoutAgent(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   types.AgentState
+		full    bool
+		wantErr error
+	}{
+		{"reconnecting", types.AgentReconnecting, false, nil},
+		{"reconnecting with a full queue", types.AgentReconnecting, true, ErrAgentBusy},
+		{"disconnected", types.AgentDisconnected, false, ErrAgentUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := NewShellSyncService(DefaultConfig())
+			hub := &fakeHub{inputAcks: make(map[string]int)}
+			svc.SetHub(hub)
+			resp, err := svc.CreateSession(context.Background(), &pb.CreateRequest{Host: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessionID := resp.GetSessionId()
+			session, _ := svc.GetSession(sessionID)
+			session.Mu.Lock()
+			session.AgentState = tt.state
+			session.Terminals["t"] = &types.Terminal{ID: "t"}
+			session.Mu.Unlock()
+			for tt.full && len(session.AgentInputChan) < cap(session.AgentInputChan) {
+				session.AgentInputChan <- types.CloseTerminalCmd{TerminalID: "other"}
+			}
+			queued := len(session.AgentInputChan)
+
+			// Input waits in the terminal, not the agent's queue.
+			err = svc.ForwardInputToAgent(sessionID, "t", "c", []byte("ls\n"))
+			if tt.state == types.AgentDisconnected {
+				if !errors.Is(err, ErrAgentUnavailable) {
+					t.Fatalf("input: %v, want %v", err, ErrAgentUnavailable)
+				}
+			} else if err != nil {
+				t.Fatalf("input: %v", err)
+			}
+
+			svc.RequestNewTerminal(sessionID, "f", types.TerminalOptions{})
+			svc.SignalTerminal(sessionID, "t", "SIGINT")
+			svc.ResizeTerminal(sessionID, "t", "c", 24, 80)
+
+			var errs []string
+			for _, msg := range hub.errors {
+				errs = append(errs, msg.Error)
+			}
+			session.Mu.RLock()
+			terminals := len(session.Terminals)
+			session.Mu.RUnlock()
+			if tt.wantErr == nil {
+				if len(errs) != 0 {
+					t.Fatalf("clients told %q", errs)
+				}
+				if got := len(session.AgentInputChan) - queued; got != 3 {
+					t.Fatalf("%d commands queued for the agent, want create, signal and resize", got)
+				}
+				if terminals != 2 {
+					t.Fatalf("%d terminals, want the new one waiting for the agent", terminals)
+				}
+				return
+			}
+			// Resizes are dropped quietly: the next one from the client, or the
+			// host, sets the size again.
+			want := []string{tt.wantErr.Error(), "Signal not sent: " + tt.wantErr.Error()}
+			if len(errs) != len(want) || errs[0] != want[0] || errs[1] != want[1] {
+				t.Fatalf("clients told %q, want %q", errs, want)
+			}
+			if hub.errors[0].FrontendID != "f" || hub.errors[1].TerminalID != "t" {
+				t.Fatalf("errors %+v are not about the refused terminals", hub.errors)
+			}
+			if len(session.AgentInputChan) != queued {
+				t.Fatal("a refused command was queued")
+			}
+			if terminals != 1 {
+				t.Fatalf("%d terminals, want the refused one dropped", terminals)
+			}
+		})
+	}
+}
+
+// stuckAgentStream is an agent whose send window stays full: Send blocks
+// until the stream is torn down.
+type stuckAgentStream struct {
+	*fakeAgentStream
+}
+
+func (f stuckAgentStream) Send(update *pb.ServerUpdate) error {
+	<-f.ctx.Done()
+	return io.EOF
+}
+
+// TestHeartbeatTimeout checks that an agent that stops answering heartbeats
+// is dropped within HeartbeatTimeout, even while the backend is stuck
+// sending to it, and that one that answers stays connected.
+func TestHeartbeatTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		stuck   bool
+		answers bool
+	}{
+		{"silent", false, false},
+		{"silent with sends blocked", true, false},
+		{"answering", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.HeartbeatInterval = 20 * time.Millisecond
+			cfg.HeartbeatTimeout = 200 * time.Millisecond
+			svc := NewShellSyncService(cfg)
+			svc.SetHub(&fakeHub{inputAcks: make(map[string]int)})
+			resp, err := svc.CreateSession(context.Background(), &pb.CreateRequest{Host: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fake := newFakeAgentStream(t)
+			fake.recv <- &pb.ClientUpdate{Payload: &pb.ClientUpdate_InitialMessage{InitialMessage: &pb.InitialAgentMessage{
+				SessionId: resp.GetSessionId(), AgentSecret: resp.GetAgentSecret(),
+			}}}
+			var stream pb.ShellSync_StreamServer = fake
+			if tt.stuck {
+				stream = stuckAgentStream{fake}
+			}
+			if tt.answers {
+				go func() {
+					for {
+						select {
+						case update := <-fake.sent:
+							if ping := update.GetPing(); ping != nil {
+								fake.recv <- &pb.ClientUpdate{Payload: &pb.ClientUpdate_Pong{Pong: ping}}
+							}
+						case <-fake.ctx.Done():
+							return
+						}
+					}
+				}()
+			}
+			go svc.Stream(stream)
+
+			session, _ := svc.GetSession(resp.GetSessionId())
+			state := func() types.AgentState {
+				session.Mu.RLock()
+				defer session.Mu.RUnlock()
+				return session.AgentState
+			}
+			for start := time.Now(); state() != types.AgentConnected; time.Sleep(time.Millisecond) {
+				if time.Since(start) > 5*time.Second {
+					t.Fatal("agent did not connect")
+				}
+			}
+			connected := time.Now()
+
+			// Allow for scheduling, but not for another timeout.
+			deadline := connected.Add(cfg.HeartbeatTimeout + cfg.HeartbeatTimeout/2)
+			for time.Now().Before(deadline) && state() == types.AgentConnected {
+				time.Sleep(time.Millisecond)
+			}
+			if tt.answers {
+				if got := state(); got != types.AgentConnected {
+					t.Fatalf("answering agent is %s", got)
+				}
+				session.Mu.RLock()
+				latency := session.AgentLatency
+				session.Mu.RUnlock()
+				if latency <= 0 {
+					t.Fatal("no latency recorded from the answers")
+				}
+				return
+			}
+			if got := state(); got != types.AgentReconnecting {
+				t.Fatalf("silent agent is %s %s after connecting, want %s", got, time.Since(connected).Round(time.Millisecond), types.AgentReconnecting)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package types
+
+import "sync/atomic"
+
+// Delivery follows one chunk of terminal output on its way to the browsers.
+// Every client the chunk is queued for holds it until the chunk has been
+// consumed, and done runs once the last holder lets go. The backend uses it
+// to return output credit to the agent only when the slowest viewer has
+// caught up.
+type Delivery struct {
+	holds atomic.Int32
+	done  func()
+}
+
+// NewDelivery returns a Delivery held once by its creator, who releases it
+// after handing the chunk to every client.
+func NewDelivery(done func()) *Delivery {
+	d := &Delivery{done: done}
+	d.holds.Store(1)
+	return d
+}
+
+// Hold records another consumer of the chunk. A nil Delivery, as used for
+// replayed output, is ignored.
+func (d *Delivery) Hold() {
+	if d != nil {
+		d.holds.Add(1)
+	}
+}
+
+// Release records that one consumer is done with the chunk.
+func (d *Delivery) Release() {
+	if d != nil && d.holds.Add(-1) == 0 {
+		d.done()
+	}
+}
+
+// InputSource records which client sent a run of input bytes, so the client
+// can be told when the agent has written them to the PTY.
+type InputSource struct {
+	ClientID string
+	Bytes    int
+}
+
+// ReleaseInputLocked takes n bytes off the front of the terminal's
+// unacknowledged input and returns how many of them each client sent. It
+// must be called with the session lock held.
+func (t *Terminal) ReleaseInputLocked(n int) map[string]int {
+	released := make(map[string]int)
+	for n > 0 && len(t.InputSources) > 0 {
+		src := &t.InputSources[0]
+		take := min(n, src.Bytes)
+		released[src.ClientID] += take
+		src.Bytes -= take
+		n -= take
+		if src.Bytes == 0 {
+			t.InputSources = t.InputSources[1:]
+		}
+	}
+	return released
+}
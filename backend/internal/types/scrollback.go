@@ -0,0 +1,69 @@
+package types
+
+import "bytes"
+
+// Scrollback is a fixed-size ring buffer holding the most recent output of a
+// terminal, replayed to browsers that join after the output was produced.
+// It is not safe for concurrent use; callers hold the session lock.
+type Scrollback struct {
+	buf     []byte
+	start   int // index of the oldest byte
+	size    int // number of valid bytes
+	wrapped bool
+}
+
+func NewScrollback(limit int) *Scrollback {
+	if limit <= 0 {
+		return nil
+	}
+	return &Scrollback{buf: make([]byte, limit)}
+}
+
+// Write appends output, overwriting the oldest bytes once the buffer is full.
+// A nil Scrollback discards everything, which disables replay.
+func (s *Scrollback) Write(p []byte) {
+	if s == nil || len(p) == 0 {
+		return
+	}
+	limit := len(s.buf)
+	if len(p) >= limit {
+		copy(s.buf, p[len(p)-limit:])
+		s.start, s.size = 0, limit
+		s.wrapped = true
+		return
+	}
+
+	end := (s.start + s.size) % limit
+	n := copy(s.buf[end:], p)
+	copy(s.buf, p[n:])
+
+	s.size += len(p)
+	if s.size > limit {
+		s.start = (s.start + s.size - limit) % limit
+		s.size = limit
+		s.wrapped = true
+	}
+}
+
+// Bytes returns a copy of the buffered output, oldest first. Once old output
+// has been overwritten the buffer most likely starts in the middle of a line,
+// a UTF-8 character or an escape sequence, so everything up to the first
+// newline is dropped.
+func (s *Scrollback) Bytes() []byte {
+	if s == nil || s.size == 0 {
+		return nil
+	}
+	out := make([]byte, 0, s.size)
+	if s.start+s.size <= len(s.buf) {
+		out = append(out, s.buf[s.start:s.start+s.size]...)
+	} else {
+		out = append(out, s.buf[s.start:]...)
+		out = append(out, s.buf[:s.start+s.size-len(s.buf)]...)
+	}
+	if s.wrapped {
+		if i := bytes.IndexByte(out, '\n'); i >= 0 {
+			out = out[i+1:]
+		}
+	}
+	return out
+}
@@ -0,0 +1,35 @@
+package types
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScrollback(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		writes []string
+		want   string
+	}{
+		{"empty", 16, nil, ""},
+		{"fits", 16, []string{"hello ", "world"}, "hello world"},
+		{"exactly full", 6, []string{"abc", "def"}, "abcdef"},
+		{"wraps to line start", 10, []string{"one\n", "two\n", "three\n"}, "three\n"},
+		{"wraps without newline", 4, []string{"abc", "def"}, "cdef"},
+		{"single oversized write", 8, []string{"xx\n" + strings.Repeat("y", 10)}, "yyyyyyyy"},
+		{"many small writes", 8, []string{"a", "b", "c\n", "d", "e", "f", "g", "h", "i"}, "defghi"},
+		{"disabled", 0, []string{"ignored"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScrollback(tt.limit)
+			for _, w := range tt.writes {
+				s.Write([]byte(w))
+			}
+			if got := string(s.Bytes()); got != tt.want {
+				t.Errorf("Bytes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
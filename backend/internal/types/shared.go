@@ -1,17 +1,29 @@
 package types
 
 import (
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/Ayush-Vish/shellsync/backend/internal/auth"
+	"github.com/Ayush-Vish/shellsync/backend/internal/vt"
 )
 
 type PTYService interface {
-	ForwardInputToAgent(sessionID, terminalID string, input []byte)
+	ForwardInputToAgent(sessionID, terminalID, clientID string, input []byte) error
 
-	RequestNewTerminal(sessionID, frontendID string)
+	RequestNewTerminal(sessionID, frontendID string, opts TerminalOptions)
+	ResizeTerminal(sessionID, terminalID, clientID string, rows, cols uint16)
+	CloseTerminal(sessionID, terminalID string)
+	SignalTerminal(sessionID, terminalID, signal string)
 	GetSession(sessionID string) (*Session, bool)
 	GetSessions() []*Session
-	AddClientToSession(sessionID, clientID string) bool
+	AddClientToSession(sessionID, clientID, role string) bool
+	RemoveClientFromSession(sessionID, clientID string)
+	VerifyJoinToken(sessionID, clientID, token string) (auth.Claims, error)
+	AssignClientID(claims auth.Claims) (auth.Claims, string)
+	ClientRole(sessionID, clientID string) string
+	SetClientRole(sessionID, clientID, role string) error
 
 	SetHub(hub PtyOutputBroadcaster)
 }
@@ -23,12 +35,94 @@ type Message struct {
 	Sender     string `json:"sender,omitempty"`
 	FrontendID string `json:"frontend_id,omitempty"`
 	Error      string `json:"error,omitempty"`
+	ExitCode   int    `json:"exit_code,omitempty"`
+	Signal     string `json:"signal,omitempty"`
+	// ReadOnly marks a terminal_created terminal as taking no input.
+	ReadOnly bool `json:"read_only,omitempty"`
+	// ClientID and Role are the payload of a role_changed message, and with
+	// Token of a joined message.
+	ClientID string `json:"client_id,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Token    string `json:"token,omitempty"`
+	// Data carries raw PTY bytes. The hub encodes it per client according to
+	// the encoding that client negotiated, so it never goes through Content.
+	Data []byte `json:"-"`
+	// Replay marks output sent from scrollback to a client that just joined.
+	Replay bool `json:"replay,omitempty"`
+	// AgentStatus and AgentLatency are the payload of an agent_status
+	// message.
+	AgentStatus  AgentState    `json:"agent_status,omitempty"`
+	AgentLatency time.Duration `json:"-"`
+	// State is the payload of a session_state message.
+	State *SessionState `json:"-"`
+	// Notice is the payload of an agent_notice message, nil when the last
+	// notice was withdrawn.
+	Notice *AgentNotice `json:"-"`
+	// Bytes is the payload of an input_ack message: input from this client
+	// that the agent has taken off its window.
+	Bytes int `json:"bytes,omitempty"`
+	// Delivery, when set, is held by every client the output is queued for
+	// until that client has consumed it.
+	Delivery *Delivery `json:"-"`
+}
+
+// SessionState is the snapshot a client receives when it joins, enough to
+// rebuild the canvas after a page refresh.
+type SessionState struct {
+	SessionID      string          `json:"sessionId"`
+	Host           string          `json:"host"`
+	AgentStatus    AgentState      `json:"agentStatus"`
+	AgentLatencyMs float64         `json:"agentLatencyMs,omitempty"`
+	Terminals      []TerminalState `json:"terminals"`
+	Participants   []string        `json:"participants"`
+	// Roles maps the participants to their roles.
+	Roles  map[string]string `json:"roles"`
+	Notice *AgentNotice      `json:"notice,omitempty"`
+}
+
+// AgentNotice warns that the agent is going to end the session, and why.
+type AgentNotice struct {
+	// Reason names the policy, such as "idle_timeout" or "max_lifetime".
+	Reason   string    `json:"reason"`
+	Message  string    `json:"message"`
+	Deadline time.Time `json:"deadline"`
+	// Final is set once the agent is shutting down.
+	Final bool `json:"final,omitempty"`
+}
+
+// LatencyMs converts a round-trip time to the milliseconds shown to
+// browsers, keeping a tenth of a millisecond.
+func LatencyMs(d time.Duration) float64 {
+	return float64(d/(100*time.Microsecond)) / 10
+}
+
+type TerminalState struct {
+	TerminalID string    `json:"terminalId"`
+	FrontendID string    `json:"frontendId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Rows       uint16    `json:"rows,omitempty"`
+	Cols       uint16    `json:"cols,omitempty"`
+	ReadOnly   bool      `json:"readOnly,omitempty"`
 }
 
 type PtyOutputBroadcaster interface {
 	BroadcastToSession(sessionID string, message Message)
+	SendToClient(sessionID, clientID string, message Message)
 }
 
+// AgentState says whether a session's agent is attached.
+type AgentState string
+
+const (
+	AgentConnected AgentState = "connected"
+	// AgentReconnecting means the agent's stream dropped recently and the
+	// agent is expected back. Commands wait in AgentInputChan meanwhile.
+	AgentReconnecting AgentState = "reconnecting"
+	// AgentDisconnected means there is no agent to talk to; commands are
+	// refused.
+	AgentDisconnected AgentState = "disconnected"
+)
+
 type Session struct {
 	ID             string
 	Host           string
@@ -36,35 +130,175 @@ type Session struct {
 	Clients        map[string]*Client
 	AgentInputChan chan AgentCommand
 	Terminals      map[string]*Terminal
-	Mu             sync.RWMutex
+	AgentState     AgentState
+	// InputReady is signalled when a terminal has new input for the agent.
+	InputReady chan struct{}
+	// ClientsChanged is signalled when a client joins or leaves, so the
+	// agent can be told who is watching.
+	ClientsChanged chan struct{}
+	// AgentLatency is the round-trip time of the last heartbeat, zero
+	// while the agent is not connected.
+	AgentLatency time.Duration
+	// Notice is the agent's last warning that it will end the session.
+	Notice *AgentNotice
+	// RoleOverrides holds the roles the owner gave clients, by client ID,
+	// which win over the roles of their join tokens.
+	RoleOverrides map[string]string
+	// AgentSecret is what an agent must know to serve the session.
+	AgentSecret string `json:"-"`
+	Mu          sync.RWMutex
+}
+
+// SnapshotLocked builds the session_state payload, listing terminals in
+// creation order. It must be called with the session lock held.
+func (s *Session) SnapshotLocked() *SessionState {
+	state := &SessionState{
+		SessionID:      s.ID,
+		Host:           s.Host,
+		AgentStatus:    s.AgentState,
+		AgentLatencyMs: LatencyMs(s.AgentLatency),
+		Terminals:      make([]TerminalState, 0, len(s.Terminals)),
+		Participants:   make([]string, 0, len(s.Clients)),
+		Notice:         s.Notice,
+	}
+	for _, t := range s.Terminals {
+		state.Terminals = append(state.Terminals, TerminalState{
+			TerminalID: t.ID,
+			FrontendID: t.FrontendID,
+			CreatedAt:  t.CreatedAt,
+			Rows:       t.Size.Rows,
+			Cols:       t.Size.Cols,
+			ReadOnly:   t.ReadOnly,
+		})
+	}
+	sort.Slice(state.Terminals, func(i, j int) bool {
+		return state.Terminals[i].CreatedAt.Before(state.Terminals[j].CreatedAt)
+	})
+	state.Participants = append(state.Participants, s.ClientIDsLocked()...)
+	state.Roles = make(map[string]string, len(s.Clients))
+	for id, client := range s.Clients {
+		state.Roles[id] = client.Role
+	}
+	return state
+}
+
+// ClientIDsLocked returns the IDs of the clients in the session, sorted. It
+// must be called with the session lock held.
+func (s *Session) ClientIDsLocked() []string {
+	ids := make([]string, 0, len(s.Clients))
+	for id := range s.Clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
 }
 
 type Terminal struct {
 	ID         string
 	FrontendID string
 	CreatedAt  time.Time
+	// Started is set once the agent has confirmed the terminal or sent
+	// output from it. Errors before that mean the terminal never started.
+	Started bool
+	// ReadOnly terminals only show output; viewers cannot type into,
+	// signal or close them.
+	ReadOnly bool
+	// Size is the size last applied to the agent PTY. Sizes holds the
+	// viewport each browser client reported, keyed by client ID.
+	Size  TerminalSize
+	Sizes map[string]TerminalSize
+	// Screen tracks what the terminal currently shows and is what clients
+	// that join later are sent. Scrollback keeps the raw recent output
+	// instead when the screen model is disabled.
+	Screen     *vt.Screen  `json:"-"`
+	Scrollback *Scrollback `json:"-"`
+	// Input holds keystrokes not yet sent to the agent. InputSources lists,
+	// in order, who sent the input that the agent has not yet written to
+	// the PTY, both queued here and in flight.
+	Input        []byte        `json:"-"`
+	InputSources []InputSource `json:"-"`
 }
 
-type AgentCommand interface {
-	isAgentCommand()
+// WriteOutputLocked records output produced by the terminal. It must be
+// called with the session lock held.
+func (t *Terminal) WriteOutputLocked(p []byte) {
+	if t.Screen != nil {
+		t.Screen.Write(p)
+		return
+	}
+	t.Scrollback.Write(p)
 }
 
-type PtyInputData struct {
-	TerminalID string
-	Data       []byte
+// ReplayLocked returns the output that brings a new viewer up to date: a
+// redraw of the screen, or the raw scrollback. It must be called with the
+// session lock held.
+func (t *Terminal) ReplayLocked() []byte {
+	if t.Screen != nil {
+		return t.Screen.ANSI()
+	}
+	return t.Scrollback.Bytes()
 }
 
-func (PtyInputData) isAgentCommand() {}
+// HostViewer is the key Terminal.Sizes keeps the agent host's own window
+// under, while the host uses the terminal locally.
+const HostViewer = "pty_agent"
+
+type TerminalSize struct {
+	Rows uint16
+	Cols uint16
+}
+
+type AgentCommand interface {
+	isAgentCommand()
+}
 
 type CreateTerminalCmd struct {
 	FrontendID string
 	TerminalID string
+	Options    TerminalOptions
+}
+
+// TerminalOptions are the optional overrides a browser can ask for when it
+// creates a terminal. Empty fields leave the agent defaults in place.
+type TerminalOptions struct {
+	Command string            `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Cwd     string            `json:"cwd,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Term    string            `json:"term,omitempty"`
 }
 
 func (CreateTerminalCmd) isAgentCommand() {}
 
+type ResizeTerminalCmd struct {
+	TerminalID string
+	Rows       uint16
+	Cols       uint16
+}
+
+func (ResizeTerminalCmd) isAgentCommand() {}
+
+type CloseTerminalCmd struct {
+	TerminalID string
+}
+
+func (CloseTerminalCmd) isAgentCommand() {}
+
+type SignalTerminalCmd struct {
+	TerminalID string
+	Signal     string
+}
+
+func (SignalTerminalCmd) isAgentCommand() {}
+
 type Client struct {
 	ID       string
 	Name     string
 	LastSeen time.Time
+	// Role is what the client may do in the session, one of the auth.Role*
+	// names. It starts as the role of the client's join token.
+	Role string
+	// Conns counts the client's open connections, such as several tabs of
+	// the same link. It leaves the session with the last one.
+	Conns int
 }
@@ -0,0 +1,184 @@
+package vt
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Text returns the visible screen as plain text, one line per row with
+// trailing blanks removed.
+func (s *Screen) Text() string {
+	var b strings.Builder
+	for y, line := range s.lines {
+		if y > 0 {
+			b.WriteByte('\n')
+		}
+		var row strings.Builder
+		for _, c := range line {
+			if c.Cont {
+				continue
+			}
+			if c.Ch == 0 {
+				row.WriteByte(' ')
+				continue
+			}
+			row.WriteRune(c.Ch)
+			for _, r := range c.Comb {
+				row.WriteRune(r)
+			}
+		}
+		b.WriteString(strings.TrimRight(row.String(), " "))
+	}
+	return b.String()
+}
+
+// ANSI returns output that redraws the screen on a freshly reset terminal of
+// the same size: history lines first, so they land in the viewer's
+// scrollback, then the primary screen, the alternate screen if a full-screen
+// program is running, and finally the cursor, modes and current attributes.
+func (s *Screen) ANSI() []byte {
+	var b bytes.Buffer
+	b.WriteString("\x1b[0m\x1b[H\x1b[2J")
+	if s.title != "" {
+		b.WriteString("\x1b]2;" + s.title + "\x07")
+	}
+
+	rows := make([][]Cell, 0, len(s.history)+s.rows)
+	rows = append(rows, s.history...)
+	rows = append(rows, s.primary...)
+	for i, line := range rows {
+		if i > 0 {
+			b.WriteString("\x1b[0m\r\n")
+		}
+		writeLine(&b, line)
+	}
+	b.WriteString("\x1b[0m")
+
+	// Put the cursor where a program leaving the alternate screen expects to
+	// find it. Positioning is relative to the last row so it still works when
+	// the viewer's screen is taller than ours.
+	primaryCursor := s.cur
+	if s.altActive {
+		primaryCursor = s.savedPrimary
+	}
+	b.WriteByte('\r')
+	if up := s.rows - 1 - primaryCursor.y; up > 0 {
+		b.WriteString("\x1b[" + strconv.Itoa(up) + "A")
+	}
+	if primaryCursor.x > 0 {
+		b.WriteString("\x1b[" + strconv.Itoa(primaryCursor.x) + "C")
+	}
+
+	if s.altActive {
+		b.WriteString("\x1b[?1049h\x1b[H\x1b[2J")
+		for y, line := range s.alternate {
+			b.WriteString("\x1b[" + strconv.Itoa(y+1) + ";1H")
+			writeLine(&b, line)
+			b.WriteString("\x1b[0m")
+		}
+	}
+
+	if s.top != 0 || s.bottom != s.rows-1 {
+		// DECSTBM homes the cursor, so the position has to be absolute.
+		b.WriteString("\x1b[" + strconv.Itoa(s.top+1) + ";" + strconv.Itoa(s.bottom+1) + "r")
+		if s.cur.originMode {
+			b.WriteString("\x1b[?6h")
+		}
+		y := s.cur.y
+		if s.cur.originMode {
+			y -= s.top
+		}
+		b.WriteString("\x1b[" + strconv.Itoa(y+1) + ";" + strconv.Itoa(s.cur.x+1) + "H")
+	} else if s.altActive {
+		b.WriteString("\x1b[" + strconv.Itoa(s.cur.y+1) + ";" + strconv.Itoa(s.cur.x+1) + "H")
+	}
+
+	if !s.autowrap {
+		b.WriteString("\x1b[?7l")
+	}
+	if s.insert {
+		b.WriteString("\x1b[4h")
+	}
+	if !s.cursorVisible {
+		b.WriteString("\x1b[?25l")
+	}
+	modes := make([]int, 0, len(s.modes))
+	for m := range s.modes {
+		modes = append(modes, m)
+	}
+	sort.Ints(modes)
+	for _, m := range modes {
+		b.WriteString("\x1b[?" + strconv.Itoa(m) + "h")
+	}
+	if s.cur.g0Graphics {
+		b.WriteString("\x1b(0")
+	}
+	if s.cur.g1Graphics {
+		b.WriteString("\x1b)0")
+	}
+	if s.cur.shifted {
+		b.WriteByte(0x0e)
+	}
+	writeSGR(&b, s.cur.attr)
+	return b.Bytes()
+}
+
+func writeLine(b *bytes.Buffer, line []Cell) {
+	attr := defaultAttr
+	for _, c := range line[:lineEnd(line)] {
+		if c.Cont {
+			continue
+		}
+		if c.Attr != attr {
+			writeSGR(b, c.Attr)
+			attr = c.Attr
+		}
+		if c.Ch == 0 {
+			b.WriteByte(' ')
+			continue
+		}
+		b.WriteRune(c.Ch)
+		for _, r := range c.Comb {
+			b.WriteRune(r)
+		}
+	}
+}
+
+var sgrFlags = []struct {
+	flag uint16
+	code string
+}{
+	{AttrBold, "1"}, {AttrFaint, "2"}, {AttrItalic, "3"}, {AttrUnderline, "4"},
+	{AttrBlink, "5"}, {AttrInverse, "7"}, {AttrHidden, "8"}, {AttrStrike, "9"},
+}
+
+func writeSGR(b *bytes.Buffer, a Attr) {
+	b.WriteString("\x1b[0")
+	for _, f := range sgrFlags {
+		if a.Flags&f.flag != 0 {
+			b.WriteString(";" + f.code)
+		}
+	}
+	writeColor(b, a.FG, 30, 90, "38")
+	writeColor(b, a.BG, 40, 100, "48")
+	b.WriteByte('m')
+}
+
+func writeColor(b *bytes.Buffer, c Color, base, bright int, extended string) {
+	switch {
+	case c == DefaultColor:
+	case c.isTrueColor():
+		b.WriteString(";" + extended + ";2;" +
+			strconv.Itoa(int(c>>16&0xff)) + ";" +
+			strconv.Itoa(int(c>>8&0xff)) + ";" +
+			strconv.Itoa(int(c&0xff)))
+	case c < 8:
+		b.WriteString(";" + strconv.Itoa(base+int(c)))
+	case c < 16:
+		b.WriteString(";" + strconv.Itoa(bright+int(c)-8))
+	default:
+		b.WriteString(";" + extended + ";5;" + strconv.Itoa(int(c)))
+	}
+}
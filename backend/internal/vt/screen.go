@@ -0,0 +1,1110 @@
+// Package vt is a small VT100/xterm screen model. It is fed the raw output of
+// a terminal and tracks what that terminal currently shows, so the backend
+// can hand late joiners a compact redraw instead of replaying every byte.
+//
+// It implements the subset of xterm that shells and full-screen programs
+// (vim, less, htop, tmux) rely on: cursor movement, erasing, insert/delete,
+// scroll regions, SGR attributes including 256 and true colour, the
+// alternate screen, DEC line drawing and wide characters. Replies to queries
+// such as DSR are left to the real terminals watching the session.
+package vt
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/width"
+)
+
+const (
+	DefaultRows = 24
+	DefaultCols = 80
+)
+
+// Color is a palette index (0-255), a true colour made by RGB, or
+// DefaultColor.
+type Color int32
+
+const (
+	DefaultColor  Color = -1
+	trueColorFlag Color = 1 << 24
+)
+
+func RGB(r, g, b uint8) Color {
+	return trueColorFlag | Color(r)<<16 | Color(g)<<8 | Color(b)
+}
+
+func (c Color) isTrueColor() bool { return c >= 0 && c&trueColorFlag != 0 }
+
+const (
+	AttrBold uint16 = 1 << iota
+	AttrFaint
+	AttrItalic
+	AttrUnderline
+	AttrBlink
+	AttrInverse
+	AttrHidden
+	AttrStrike
+)
+
+type Attr struct {
+	FG, BG Color
+	Flags  uint16
+}
+
+var defaultAttr = Attr{FG: DefaultColor, BG: DefaultColor}
+
+// Cell is one character cell. A wide character occupies its cell and the
+// following one, which is marked as a continuation.
+type Cell struct {
+	Ch   rune // 0 for a blank cell
+	Comb []rune
+	Attr Attr
+	Wide bool
+	Cont bool
+}
+
+type cursor struct {
+	x, y       int
+	attr       Attr
+	wrapNext   bool
+	originMode bool
+	g0Graphics bool
+	g1Graphics bool
+	shifted    bool
+}
+
+type parserState int
+
+const (
+	stateGround parserState = iota
+	stateEscape
+	stateEscInter
+	stateCSI
+	stateOSC
+	stateOSCEsc
+	stateString
+	stateStringEsc
+)
+
+// Private modes that do not change the screen contents but do change how the
+// terminal behaves (key encoding, mouse reporting, bracketed paste). They
+// are recorded so a snapshot can switch them on in a new viewer.
+var passthroughModes = map[int]bool{
+	1: true, 12: true, 1000: true, 1002: true, 1003: true, 1004: true,
+	1005: true, 1006: true, 1015: true, 2004: true,
+}
+
+const maxOSC = 4096
+
+// Screen tracks the state of one terminal. It is not safe for concurrent use.
+type Screen struct {
+	rows, cols int
+
+	lines     [][]Cell
+	primary   [][]Cell
+	alternate [][]Cell
+	altActive bool
+
+	history    [][]Cell
+	maxHistory int
+
+	cur          cursor
+	saved        cursor
+	savedPrimary cursor
+	top, bottom  int
+	tabs         []bool
+
+	autowrap      bool
+	insert        bool
+	cursorVisible bool
+	modes         map[int]bool
+	title         string
+
+	state        parserState
+	params       []int
+	paramSet     bool
+	private      byte
+	intermediate []byte
+	osc          []byte
+	utf8buf      []byte
+}
+
+// NewScreen returns a screen of the given size that keeps up to maxHistory
+// lines scrolled off the top of the primary screen.
+func NewScreen(rows, cols, maxHistory int) *Screen {
+	if rows <= 0 {
+		rows = DefaultRows
+	}
+	if cols <= 0 {
+		cols = DefaultCols
+	}
+	s := &Screen{maxHistory: maxHistory}
+	s.reset(rows, cols)
+	return s
+}
+
+func (s *Screen) reset(rows, cols int) {
+	s.rows, s.cols = rows, cols
+	s.primary = newGrid(rows, cols)
+	s.alternate = newGrid(rows, cols)
+	s.lines = s.primary
+	s.altActive = false
+	s.history = nil
+	s.cur = cursor{attr: defaultAttr}
+	s.saved = s.cur
+	s.savedPrimary = s.cur
+	s.top, s.bottom = 0, rows-1
+	s.resetTabs()
+	s.autowrap = true
+	s.insert = false
+	s.cursorVisible = true
+	s.modes = make(map[int]bool)
+	s.title = ""
+	s.state = stateGround
+	s.utf8buf = s.utf8buf[:0]
+}
+
+func newGrid(rows, cols int) [][]Cell {
+	g := make([][]Cell, rows)
+	for i := range g {
+		g[i] = newLine(cols, defaultAttr)
+	}
+	return g
+}
+
+func newLine(cols int, attr Attr) []Cell {
+	line := make([]Cell, cols)
+	for i := range line {
+		line[i] = blank(attr)
+	}
+	return line
+}
+
+// blank is an erased cell. Erasing keeps the current background colour, as
+// xterm does.
+func blank(attr Attr) Cell {
+	return Cell{Attr: Attr{FG: DefaultColor, BG: attr.BG}}
+}
+
+func (s *Screen) resetTabs() {
+	s.tabs = make([]bool, s.cols)
+	for i := 8; i < s.cols; i += 8 {
+		s.tabs[i] = true
+	}
+}
+
+func (s *Screen) Size() (rows, cols int) { return s.rows, s.cols }
+
+// Cursor returns the zero-based cursor position.
+func (s *Screen) Cursor() (x, y int) { return s.cur.x, s.cur.y }
+
+func (s *Screen) Title() string { return s.title }
+
+func (s *Screen) AltScreen() bool { return s.altActive }
+
+// Cell returns the cell at the given zero-based position of the visible
+// screen.
+func (s *Screen) Cell(x, y int) Cell {
+	if y < 0 || y >= s.rows || x < 0 || x >= s.cols {
+		return blank(defaultAttr)
+	}
+	return s.lines[y][x]
+}
+
+// Write feeds terminal output into the model. It never fails.
+func (s *Screen) Write(p []byte) (int, error) {
+	for _, b := range p {
+		s.feed(b)
+	}
+	return len(p), nil
+}
+
+func (s *Screen) feed(b byte) {
+	if len(s.utf8buf) > 0 {
+		if b&0xc0 == 0x80 {
+			s.utf8buf = append(s.utf8buf, b)
+			if utf8.FullRune(s.utf8buf) {
+				r, _ := utf8.DecodeRune(s.utf8buf)
+				s.utf8buf = s.utf8buf[:0]
+				s.text(r)
+			}
+			return
+		}
+		s.utf8buf = s.utf8buf[:0]
+		s.text(utf8.RuneError)
+	}
+	if b >= 0x80 && (s.state == stateGround || s.state == stateOSC) {
+		if b >= 0xc2 && b <= 0xf4 {
+			s.utf8buf = append(s.utf8buf, b)
+		} else {
+			s.text(utf8.RuneError)
+		}
+		return
+	}
+
+	switch s.state {
+	case stateGround:
+		switch {
+		case b == 0x1b:
+			s.state = stateEscape
+			s.intermediate = s.intermediate[:0]
+		case b < 0x20 || b == 0x7f:
+			s.control(b)
+		default:
+			s.print(rune(b))
+		}
+
+	case stateEscape:
+		switch {
+		case b == 0x18 || b == 0x1a:
+			s.state = stateGround
+		case b == 0x1b:
+		case b < 0x20:
+			s.control(b)
+		case b == '[':
+			s.state = stateCSI
+			s.params = s.params[:0]
+			s.paramSet = false
+			s.private = 0
+		case b == ']':
+			s.state = stateOSC
+			s.osc = s.osc[:0]
+		case b == 'P' || b == 'X' || b == '^' || b == '_':
+			s.state = stateString
+		case b >= 0x20 && b <= 0x2f:
+			s.intermediate = append(s.intermediate, b)
+			s.state = stateEscInter
+		default:
+			s.state = stateGround
+			s.escape(b)
+		}
+
+	case stateEscInter:
+		switch {
+		case b == 0x18 || b == 0x1a:
+			s.state = stateGround
+		case b < 0x20:
+			s.control(b)
+		case b >= 0x20 && b <= 0x2f:
+			s.intermediate = append(s.intermediate, b)
+		default:
+			s.state = stateGround
+			s.escapeIntermediate(b)
+		}
+
+	case stateCSI:
+		switch {
+		case b == 0x18 || b == 0x1a:
+			s.state = stateGround
+		case b == 0x1b:
+			s.state = stateEscape
+			s.intermediate = s.intermediate[:0]
+		case b < 0x20:
+			s.control(b)
+		case b >= '0' && b <= '9':
+			if !s.paramSet {
+				s.params = append(s.params, 0)
+				s.paramSet = true
+			}
+			last := len(s.params) - 1
+			if s.params[last] < 1<<16 {
+				s.params[last] = s.params[last]*10 + int(b-'0')
+			}
+		case b == ';' || b == ':':
+			if !s.paramSet {
+				s.params = append(s.params, 0)
+			}
+			s.paramSet = false
+		case b >= '<' && b <= '?':
+			s.private = b
+		case b >= 0x20 && b <= 0x2f:
+			s.intermediate = append(s.intermediate, b)
+		case b >= 0x40 && b <= 0x7e:
+			s.state = stateGround
+			s.csi(b)
+		default:
+			s.state = stateGround
+		}
+
+	case stateOSC:
+		switch b {
+		case 0x07:
+			s.state = stateGround
+			s.oscDispatch()
+		case 0x1b:
+			s.state = stateOSCEsc
+		case 0x18, 0x1a:
+			s.state = stateGround
+		default:
+			if len(s.osc) < maxOSC {
+				s.osc = append(s.osc, b)
+			}
+		}
+
+	case stateOSCEsc:
+		s.oscDispatch()
+		s.state = stateEscape
+		s.intermediate = s.intermediate[:0]
+		if b == '\\' {
+			s.state = stateGround
+			return
+		}
+		s.feed(b)
+
+	case stateString:
+		switch b {
+		case 0x1b:
+			s.state = stateStringEsc
+		case 0x18, 0x1a:
+			s.state = stateGround
+		}
+
+	case stateStringEsc:
+		if b == '\\' {
+			s.state = stateGround
+			return
+		}
+		s.state = stateEscape
+		s.intermediate = s.intermediate[:0]
+		s.feed(b)
+	}
+}
+
+// text handles a decoded non-ASCII rune in whatever state the parser is in.
+func (s *Screen) text(r rune) {
+	switch s.state {
+	case stateGround:
+		s.print(r)
+	case stateOSC:
+		if len(s.osc) < maxOSC {
+			s.osc = utf8.AppendRune(s.osc, r)
+		}
+	}
+}
+
+func (s *Screen) control(b byte) {
+	switch b {
+	case '\b':
+		if s.cur.x > 0 {
+			s.cur.x--
+		}
+		s.cur.wrapNext = false
+	case '\t':
+		s.tabForward(1)
+	case '\n', '\v', '\f':
+		s.linefeed()
+	case '\r':
+		s.cur.x = 0
+		s.cur.wrapNext = false
+	case 0x0e:
+		s.cur.shifted = true
+	case 0x0f:
+		s.cur.shifted = false
+	}
+}
+
+func (s *Screen) escape(b byte) {
+	switch b {
+	case '7':
+		s.saved = s.cur
+	case '8':
+		s.restoreCursor(s.saved)
+	case 'D':
+		s.linefeed()
+	case 'E':
+		s.cur.x = 0
+		s.linefeed()
+	case 'M':
+		s.reverseIndex()
+	case 'H':
+		if s.cur.x < s.cols {
+			s.tabs[s.cur.x] = true
+		}
+	case 'c':
+		s.reset(s.rows, s.cols)
+	}
+}
+
+func (s *Screen) escapeIntermediate(b byte) {
+	if len(s.intermediate) != 1 {
+		return
+	}
+	switch s.intermediate[0] {
+	case '(':
+		s.cur.g0Graphics = b == '0'
+	case ')':
+		s.cur.g1Graphics = b == '0'
+	case '#':
+		if b == '8' {
+			for y := range s.lines {
+				for x := range s.lines[y] {
+					s.lines[y][x] = Cell{Ch: 'E', Attr: defaultAttr}
+				}
+			}
+		}
+	}
+}
+
+func (s *Screen) oscDispatch() {
+	i := 0
+	for i < len(s.osc) && s.osc[i] >= '0' && s.osc[i] <= '9' {
+		i++
+	}
+	if i == 0 || i >= len(s.osc) || s.osc[i] != ';' {
+		return
+	}
+	switch string(s.osc[:i]) {
+	case "0", "2":
+		s.title = string(s.osc[i+1:])
+	}
+}
+
+// param returns the n-th CSI parameter, or def when it is missing or zero.
+func (s *Screen) param(n, def int) int {
+	if n < len(s.params) && s.params[n] != 0 {
+		return s.params[n]
+	}
+	return def
+}
+
+func (s *Screen) csi(final byte) {
+	if len(s.intermediate) > 0 {
+		// DECSCUSR, DECSTR and friends: nothing we track.
+		return
+	}
+	if s.private != 0 && s.private != '?' {
+		return
+	}
+	if s.private == '?' {
+		switch final {
+		case 'h':
+			s.setPrivateModes(true)
+		case 'l':
+			s.setPrivateModes(false)
+		case 'J':
+			s.eraseDisplay(s.param(0, 0))
+		case 'K':
+			s.eraseLine(s.param(0, 0))
+		}
+		return
+	}
+
+	n := s.param(0, 1)
+	switch final {
+	case '@':
+		s.insertChars(n)
+	case 'A':
+		s.moveUp(n)
+	case 'B', 'e':
+		s.moveDown(n)
+	case 'C', 'a':
+		s.moveTo(s.cur.x+n, s.cur.y)
+	case 'D':
+		s.moveTo(s.cur.x-n, s.cur.y)
+	case 'E':
+		s.moveDown(n)
+		s.cur.x = 0
+	case 'F':
+		s.moveUp(n)
+		s.cur.x = 0
+	case 'G', '`':
+		s.moveTo(n-1, s.cur.y)
+	case 'H', 'f':
+		y := s.param(0, 1) - 1
+		if s.cur.originMode {
+			y += s.top
+		}
+		s.moveTo(s.param(1, 1)-1, y)
+	case 'I':
+		s.tabForward(n)
+	case 'Z':
+		s.tabBackward(n)
+	case 'J':
+		s.eraseDisplay(s.param(0, 0))
+	case 'K':
+		s.eraseLine(s.param(0, 0))
+	case 'L':
+		s.insertLines(n)
+	case 'M':
+		s.deleteLines(n)
+	case 'P':
+		s.deleteChars(n)
+	case 'S':
+		s.scrollUp(s.top, s.bottom, n)
+	case 'T':
+		if len(s.params) <= 1 {
+			s.scrollDown(s.top, s.bottom, n)
+		}
+	case 'X':
+		s.eraseChars(n)
+	case 'd':
+		y := n - 1
+		if s.cur.originMode {
+			y += s.top
+		}
+		s.moveTo(s.cur.x, y)
+	case 'g':
+		switch s.param(0, 0) {
+		case 0:
+			if s.cur.x < s.cols {
+				s.tabs[s.cur.x] = false
+			}
+		case 3:
+			s.tabs = make([]bool, s.cols)
+		}
+	case 'h':
+		s.setModes(true)
+	case 'l':
+		s.setModes(false)
+	case 'm':
+		s.sgr()
+	case 'r':
+		top, bottom := s.param(0, 1)-1, s.param(1, s.rows)-1
+		if bottom >= s.rows {
+			bottom = s.rows - 1
+		}
+		if top < bottom {
+			s.top, s.bottom = top, bottom
+			s.cur.x, s.cur.y = 0, 0
+			if s.cur.originMode {
+				s.cur.y = s.top
+			}
+			s.cur.wrapNext = false
+		}
+	case 's':
+		s.saved = s.cur
+	case 'u':
+		s.restoreCursor(s.saved)
+	}
+}
+
+func (s *Screen) setModes(on bool) {
+	for _, p := range s.params {
+		if p == 4 {
+			s.insert = on
+		}
+	}
+}
+
+func (s *Screen) setPrivateModes(on bool) {
+	for _, p := range s.params {
+		switch p {
+		case 6:
+			s.cur.originMode = on
+			s.cur.x, s.cur.y = 0, 0
+			if on {
+				s.cur.y = s.top
+			}
+			s.cur.wrapNext = false
+		case 7:
+			s.autowrap = on
+		case 25:
+			s.cursorVisible = on
+		case 47, 1047:
+			s.switchScreen(on, p == 1047)
+		case 1048:
+			if on {
+				s.saved = s.cur
+			} else {
+				s.restoreCursor(s.saved)
+			}
+		case 1049:
+			if on {
+				s.savedPrimary = s.cur
+				s.switchScreen(true, true)
+			} else {
+				s.switchScreen(false, false)
+				s.restoreCursor(s.savedPrimary)
+			}
+		default:
+			if passthroughModes[p] {
+				if on {
+					s.modes[p] = true
+				} else {
+					delete(s.modes, p)
+				}
+			}
+		}
+	}
+}
+
+func (s *Screen) switchScreen(alt, clear bool) {
+	if alt == s.altActive {
+		return
+	}
+	s.altActive = alt
+	if alt {
+		s.lines = s.alternate
+		if clear {
+			for y := range s.lines {
+				s.lines[y] = newLine(s.cols, s.cur.attr)
+			}
+		}
+	} else {
+		s.lines = s.primary
+	}
+}
+
+func (s *Screen) restoreCursor(c cursor) {
+	s.cur = c
+	s.cur.x = clamp(s.cur.x, 0, s.cols-1)
+	s.cur.y = clamp(s.cur.y, 0, s.rows-1)
+}
+
+func (s *Screen) sgr() {
+	if len(s.params) == 0 {
+		s.cur.attr = defaultAttr
+		return
+	}
+	a := &s.cur.attr
+	for i := 0; i < len(s.params); i++ {
+		p := s.params[i]
+		switch {
+		case p == 0:
+			*a = defaultAttr
+		case p == 1:
+			a.Flags |= AttrBold
+		case p == 2:
+			a.Flags |= AttrFaint
+		case p == 3:
+			a.Flags |= AttrItalic
+		case p == 4 || p == 21:
+			a.Flags |= AttrUnderline
+		case p == 5 || p == 6:
+			a.Flags |= AttrBlink
+		case p == 7:
+			a.Flags |= AttrInverse
+		case p == 8:
+			a.Flags |= AttrHidden
+		case p == 9:
+			a.Flags |= AttrStrike
+		case p == 22:
+			a.Flags &^= AttrBold | AttrFaint
+		case p == 23:
+			a.Flags &^= AttrItalic
+		case p == 24:
+			a.Flags &^= AttrUnderline
+		case p == 25:
+			a.Flags &^= AttrBlink
+		case p == 27:
+			a.Flags &^= AttrInverse
+		case p == 28:
+			a.Flags &^= AttrHidden
+		case p == 29:
+			a.Flags &^= AttrStrike
+		case p >= 30 && p <= 37:
+			a.FG = Color(p - 30)
+		case p == 38:
+			a.FG, i = s.extendedColor(i, a.FG)
+		case p == 39:
+			a.FG = DefaultColor
+		case p >= 40 && p <= 47:
+			a.BG = Color(p - 40)
+		case p == 48:
+			a.BG, i = s.extendedColor(i, a.BG)
+		case p == 49:
+			a.BG = DefaultColor
+		case p >= 90 && p <= 97:
+			a.FG = Color(p - 90 + 8)
+		case p >= 100 && p <= 107:
+			a.BG = Color(p - 100 + 8)
+		}
+	}
+}
+
+// extendedColor parses the arguments of SGR 38/48 starting after index i and
+// returns the colour and the index of the last parameter consumed.
+func (s *Screen) extendedColor(i int, old Color) (Color, int) {
+	if i+1 >= len(s.params) {
+		return old, i
+	}
+	switch s.params[i+1] {
+	case 5:
+		if i+2 < len(s.params) {
+			return Color(s.params[i+2] & 0xff), i + 2
+		}
+	case 2:
+		if i+4 < len(s.params) {
+			return RGB(uint8(s.params[i+2]), uint8(s.params[i+3]), uint8(s.params[i+4])), i + 4
+		}
+	}
+	return old, len(s.params)
+}
+
+// decGraphics maps the DEC special graphics set used for line drawing.
+var decGraphics = map[rune]rune{
+	'`': '◆', 'a': '▒', 'f': '°', 'g': '±', 'j': '┘', 'k': '┐', 'l': '┌',
+	'm': '└', 'n': '┼', 'o': '⎺', 'p': '⎻', 'q': '─', 'r': '⎼', 's': '⎽',
+	't': '├', 'u': '┤', 'v': '┴', 'w': '┬', 'x': '│', 'y': '≤', 'z': '≥',
+	'{': 'π', '|': '≠', '}': '£', '~': '·',
+}
+
+func runeWidth(r rune) int {
+	switch {
+	case r == 0:
+		return 0
+	case unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r), r == 0x200b, r == 0x200d:
+		return 0
+	}
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	// Most emoji are wide in xterm.js even though East Asian Width calls
+	// them neutral.
+	if r >= 0x1f300 && r <= 0x1faff {
+		return 2
+	}
+	return 1
+}
+
+func (s *Screen) print(r rune) {
+	graphics := s.cur.g0Graphics
+	if s.cur.shifted {
+		graphics = s.cur.g1Graphics
+	}
+	if graphics {
+		if g, ok := decGraphics[r]; ok {
+			r = g
+		}
+	}
+
+	w := runeWidth(r)
+	if w == 0 {
+		s.combine(r)
+		return
+	}
+
+	if s.cur.wrapNext && s.autowrap {
+		s.cur.x = 0
+		s.linefeed()
+	}
+	s.cur.wrapNext = false
+	if w == 2 && s.cur.x == s.cols-1 {
+		if !s.autowrap || s.cols < 2 {
+			return
+		}
+		s.lines[s.cur.y][s.cur.x] = blank(s.cur.attr)
+		s.cur.x = 0
+		s.linefeed()
+	}
+
+	line := s.lines[s.cur.y]
+	if s.insert {
+		copy(line[s.cur.x+w:], line[s.cur.x:])
+	}
+	s.clearWide(s.cur.x, s.cur.y)
+	line[s.cur.x] = Cell{Ch: r, Attr: s.cur.attr, Wide: w == 2}
+	if w == 2 {
+		s.clearWide(s.cur.x+1, s.cur.y)
+		line[s.cur.x+1] = Cell{Attr: s.cur.attr, Cont: true}
+	}
+
+	if s.cur.x+w >= s.cols {
+		s.cur.x = s.cols - 1
+		s.cur.wrapNext = true
+	} else {
+		s.cur.x += w
+	}
+}
+
+// combine attaches a zero-width rune to the character before the cursor.
+func (s *Screen) combine(r rune) {
+	x := s.cur.x
+	if !s.cur.wrapNext {
+		x--
+	}
+	if x < 0 {
+		return
+	}
+	line := s.lines[s.cur.y]
+	if line[x].Cont && x > 0 {
+		x--
+	}
+	if line[x].Ch != 0 && len(line[x].Comb) < 8 {
+		line[x].Comb = append(line[x].Comb, r)
+	}
+}
+
+// clearWide blanks the other half of a wide character about to be partly
+// overwritten at (x, y).
+func (s *Screen) clearWide(x, y int) {
+	if x < 0 || x >= s.cols {
+		return
+	}
+	line := s.lines[y]
+	if line[x].Wide && x+1 < s.cols {
+		line[x+1] = blank(line[x].Attr)
+	}
+	if line[x].Cont && x > 0 {
+		line[x-1] = blank(line[x-1].Attr)
+	}
+}
+
+func (s *Screen) linefeed() {
+	s.cur.wrapNext = false
+	switch {
+	case s.cur.y == s.bottom:
+		s.scrollUp(s.top, s.bottom, 1)
+	case s.cur.y < s.rows-1:
+		s.cur.y++
+	}
+}
+
+func (s *Screen) reverseIndex() {
+	s.cur.wrapNext = false
+	switch {
+	case s.cur.y == s.top:
+		s.scrollDown(s.top, s.bottom, 1)
+	case s.cur.y > 0:
+		s.cur.y--
+	}
+}
+
+func (s *Screen) scrollUp(top, bottom, n int) {
+	n = clamp(n, 0, bottom-top+1)
+	if top == 0 && !s.altActive {
+		for _, line := range s.lines[:n] {
+			s.pushHistory(line)
+		}
+	}
+	copy(s.lines[top:bottom+1], s.lines[top+n:bottom+1])
+	for y := bottom - n + 1; y <= bottom; y++ {
+		s.lines[y] = newLine(s.cols, s.cur.attr)
+	}
+}
+
+func (s *Screen) scrollDown(top, bottom, n int) {
+	n = clamp(n, 0, bottom-top+1)
+	copy(s.lines[top+n:bottom+1], s.lines[top:bottom+1-n])
+	for y := top; y < top+n; y++ {
+		s.lines[y] = newLine(s.cols, s.cur.attr)
+	}
+}
+
+func (s *Screen) pushHistory(line []Cell) {
+	if s.maxHistory <= 0 {
+		return
+	}
+	end := lineEnd(line)
+	kept := make([]Cell, end)
+	copy(kept, line[:end])
+	if len(s.history) >= s.maxHistory {
+		copy(s.history, s.history[1:])
+		s.history = s.history[:len(s.history)-1]
+	}
+	s.history = append(s.history, kept)
+}
+
+func (s *Screen) moveTo(x, y int) {
+	s.cur.x = clamp(x, 0, s.cols-1)
+	s.cur.y = clamp(y, 0, s.rows-1)
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) moveUp(n int) {
+	min := 0
+	if s.cur.y >= s.top {
+		min = s.top
+	}
+	s.cur.y = clamp(s.cur.y-n, min, s.rows-1)
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) moveDown(n int) {
+	max := s.rows - 1
+	if s.cur.y <= s.bottom {
+		max = s.bottom
+	}
+	s.cur.y = clamp(s.cur.y+n, 0, max)
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) tabForward(n int) {
+	for ; n > 0 && s.cur.x < s.cols-1; n-- {
+		s.cur.x++
+		for s.cur.x < s.cols-1 && !s.tabs[s.cur.x] {
+			s.cur.x++
+		}
+	}
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) tabBackward(n int) {
+	for ; n > 0 && s.cur.x > 0; n-- {
+		s.cur.x--
+		for s.cur.x > 0 && !s.tabs[s.cur.x] {
+			s.cur.x--
+		}
+	}
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) eraseCells(y, from, to int) {
+	line := s.lines[y]
+	from, to = clamp(from, 0, s.cols), clamp(to, 0, s.cols)
+	if from < to {
+		s.clearWide(from, y)
+		s.clearWide(to-1, y)
+	}
+	for x := from; x < to; x++ {
+		line[x] = blank(s.cur.attr)
+	}
+}
+
+func (s *Screen) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		s.eraseCells(s.cur.y, s.cur.x, s.cols)
+		for y := s.cur.y + 1; y < s.rows; y++ {
+			s.eraseCells(y, 0, s.cols)
+		}
+	case 1:
+		for y := 0; y < s.cur.y; y++ {
+			s.eraseCells(y, 0, s.cols)
+		}
+		s.eraseCells(s.cur.y, 0, s.cur.x+1)
+	case 2:
+		for y := 0; y < s.rows; y++ {
+			s.eraseCells(y, 0, s.cols)
+		}
+	case 3:
+		s.history = nil
+	}
+}
+
+func (s *Screen) eraseLine(mode int) {
+	switch mode {
+	case 0:
+		s.eraseCells(s.cur.y, s.cur.x, s.cols)
+	case 1:
+		s.eraseCells(s.cur.y, 0, s.cur.x+1)
+	case 2:
+		s.eraseCells(s.cur.y, 0, s.cols)
+	}
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) eraseChars(n int) {
+	s.eraseCells(s.cur.y, s.cur.x, s.cur.x+n)
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) insertChars(n int) {
+	line := s.lines[s.cur.y]
+	n = clamp(n, 0, s.cols-s.cur.x)
+	s.clearWide(s.cur.x, s.cur.y)
+	copy(line[s.cur.x+n:], line[s.cur.x:])
+	for x := s.cur.x; x < s.cur.x+n; x++ {
+		line[x] = blank(s.cur.attr)
+	}
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) deleteChars(n int) {
+	line := s.lines[s.cur.y]
+	n = clamp(n, 0, s.cols-s.cur.x)
+	s.clearWide(s.cur.x, s.cur.y)
+	copy(line[s.cur.x:], line[s.cur.x+n:])
+	for x := s.cols - n; x < s.cols; x++ {
+		line[x] = blank(s.cur.attr)
+	}
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) insertLines(n int) {
+	if s.cur.y < s.top || s.cur.y > s.bottom {
+		return
+	}
+	s.scrollDown(s.cur.y, s.bottom, n)
+	s.cur.x = 0
+	s.cur.wrapNext = false
+}
+
+func (s *Screen) deleteLines(n int) {
+	if s.cur.y < s.top || s.cur.y > s.bottom {
+		return
+	}
+	n = clamp(n, 0, s.bottom-s.cur.y+1)
+	copy(s.lines[s.cur.y:s.bottom+1], s.lines[s.cur.y+n:s.bottom+1])
+	for y := s.bottom - n + 1; y <= s.bottom; y++ {
+		s.lines[y] = newLine(s.cols, s.cur.attr)
+	}
+	s.cur.x = 0
+	s.cur.wrapNext = false
+}
+
+// Resize changes the screen size without reflowing text. When the primary
+// screen loses rows, lines above the cursor move into history so the cursor
+// line stays visible, as in xterm.
+func (s *Screen) Resize(rows, cols int) {
+	if rows <= 0 || cols <= 0 || (rows == s.rows && cols == s.cols) {
+		return
+	}
+
+	drop := 0
+	if rows < s.rows && s.cur.y >= rows {
+		drop = s.cur.y - rows + 1
+	}
+	if !s.altActive {
+		for _, line := range s.primary[:drop] {
+			s.pushHistory(line)
+		}
+	}
+	s.primary = resizeGrid(s.primary, rows, cols, drop)
+	altDrop := 0
+	if s.altActive {
+		altDrop = drop
+	}
+	s.alternate = resizeGrid(s.alternate, rows, cols, altDrop)
+	if s.altActive {
+		s.lines = s.alternate
+	} else {
+		s.lines = s.primary
+	}
+
+	s.cur.y -= drop
+	s.rows, s.cols = rows, cols
+	s.top, s.bottom = 0, rows-1
+	s.resetTabs()
+	s.restoreCursor(s.cur)
+	s.cur.wrapNext = false
+	s.saved.x, s.saved.y = clamp(s.saved.x, 0, cols-1), clamp(s.saved.y, 0, rows-1)
+	s.savedPrimary.x, s.savedPrimary.y = clamp(s.savedPrimary.x, 0, cols-1), clamp(s.savedPrimary.y, 0, rows-1)
+}
+
+func resizeGrid(g [][]Cell, rows, cols, drop int) [][]Cell {
+	g = g[drop:]
+	out := make([][]Cell, rows)
+	for y := range out {
+		line := newLine(cols, defaultAttr)
+		if y < len(g) {
+			copy(line, g[y])
+			if last := line[cols-1]; last.Wide {
+				line[cols-1] = blank(last.Attr)
+			}
+		}
+		out[y] = line
+	}
+	return out
+}
+
+// lineEnd returns the length of line without trailing blank cells.
+func lineEnd(line []Cell) int {
+	end := len(line)
+	for end > 0 && line[end-1].Ch == 0 && !line[end-1].Cont && line[end-1].Attr == defaultAttr {
+		end--
+	}
+	return end
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
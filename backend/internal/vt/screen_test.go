@@ -0,0 +1,132 @@
+package vt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScreenText(t *testing.T) {
+	tests := []struct {
+		name  string
+		rows  int
+		cols  int
+		input string
+		want  string
+	}{
+		{"plain", 3, 10, "hello\r\nworld", "hello\nworld\n"},
+		{"autowrap", 3, 4, "abcdef", "abcd\nef\n"},
+		{"scrolls", 2, 10, "one\r\ntwo\r\nthree", "two\nthree"},
+		{"carriage return overwrites", 1, 10, "abc\rX", "Xbc"},
+		{"backspace", 1, 10, "abc\b\bZ", "aZc"},
+		{"tab", 1, 20, "a\tb", "a       b"},
+		{"cursor position", 3, 10, "\x1b[2;3Hx", "\n  x\n"},
+		{"erase line", 1, 10, "abcdef\x1b[3D\x1b[K", "abc"},
+		{"erase display", 2, 10, "abc\r\ndef\x1b[2J", "\n"},
+		{"insert and delete chars", 1, 10, "abcd\x1b[3G\x1b[2@XY\x1b[1P", "abXYd"},
+		{"delete line", 3, 10, "1\r\n2\r\n3\x1b[2;1H\x1b[M", "1\n3\n"},
+		{"scroll region", 4, 10, "top\x1b[2;3r\x1b[3;1Ha\r\nb\r\nc\x1b[r", "top\nb\nc\n"},
+		{"reverse index", 2, 10, "a\r\nb\x1b[H\x1bMz", "z\na"},
+		{"utf8", 1, 10, "café ☃", "café ☃"},
+		{"wide characters", 1, 10, "日本x", "日本x"},
+		{"combining mark", 1, 10, "e\u0301!", "e\u0301!"},
+		{"dec line drawing", 1, 10, "\x1b(0lqk\x1b(Bx", "┌─┐x"},
+		{"sgr does not print", 1, 10, "\x1b[1;38;2;1;2;3mhi\x1b[0m", "hi"},
+		{"osc title", 1, 10, "\x1b]0;title\x07ok", "ok"},
+		{"alternate screen", 2, 10, "shell\x1b[?1049hvim\x1b[?1049l", "shell\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScreen(tt.rows, tt.cols, 100)
+			s.Write([]byte(tt.input))
+			if got := s.Text(); got != tt.want {
+				t.Errorf("Text() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScreenSplitWrites(t *testing.T) {
+	input := []byte("\x1b[31mcafé\x1b]2;t\x1b\\ ☃\x1b[0m")
+	for i := 0; i <= len(input); i++ {
+		s := NewScreen(1, 20, 0)
+		s.Write(input[:i])
+		s.Write(input[i:])
+		if got := s.Text(); got != "café ☃" {
+			t.Fatalf("split at %d: Text() = %q", i, got)
+		}
+		if s.Title() != "t" {
+			t.Fatalf("split at %d: Title() = %q", i, s.Title())
+		}
+	}
+}
+
+func TestScreenAttributes(t *testing.T) {
+	s := NewScreen(1, 10, 0)
+	s.Write([]byte("\x1b[1;4;31;48;5;200ma\x1b[22;39mb"))
+	if got := s.Cell(0, 0).Attr; got != (Attr{FG: 1, BG: 200, Flags: AttrBold | AttrUnderline}) {
+		t.Errorf("first cell attr = %+v", got)
+	}
+	if got := s.Cell(1, 0).Attr; got != (Attr{FG: DefaultColor, BG: 200, Flags: AttrUnderline}) {
+		t.Errorf("second cell attr = %+v", got)
+	}
+}
+
+func TestScreenHistory(t *testing.T) {
+	s := NewScreen(2, 10, 2)
+	s.Write([]byte("1\r\n2\r\n3\r\n4\r\n5"))
+	if len(s.history) != 2 || s.history[0][0].Ch != '2' || s.history[1][0].Ch != '3' {
+		t.Fatalf("history = %v, want lines 2 and 3", s.history)
+	}
+}
+
+func TestScreenResizeKeepsCursorLine(t *testing.T) {
+	s := NewScreen(4, 10, 10)
+	s.Write([]byte("a\r\nb\r\nc\r\nprompt$ "))
+	s.Resize(2, 5)
+	if got := s.Text(); got != "c\npromp" {
+		t.Errorf("Text() after resize = %q", got)
+	}
+	if x, y := s.Cursor(); x != 4 || y != 1 {
+		t.Errorf("Cursor() = %d,%d, want 4,1", x, y)
+	}
+}
+
+// TestScreenANSIRoundTrip checks that feeding a snapshot into a fresh screen
+// of the same size reproduces the original.
+func TestScreenANSIRoundTrip(t *testing.T) {
+	inputs := []string{
+		"plain $ ",
+		"\x1b[1;32muser\x1b[0m:\x1b[34m~\x1b[0m$ ls\r\nfile\r\n$ ",
+		"line\r\n\x1b[?1049h\x1b[H\x1b[7mstatus\x1b[0m\x1b[3;5Hedit",
+		"\x1b[2;3r\x1b[3;1Hregion",
+		"\x1b[?2004h\x1b[?25l\x1b[48;2;10;20;30m  bg  ",
+		"日本語\x1b(0q",
+	}
+	for _, input := range inputs {
+		orig := NewScreen(4, 12, 10)
+		orig.Write([]byte(input))
+		replay := NewScreen(4, 12, 10)
+		replay.Write(orig.ANSI())
+
+		if got, want := replay.Text(), orig.Text(); got != want {
+			t.Errorf("%q: Text() = %q, want %q", input, got, want)
+		}
+		if got, want := replay.cur, orig.cur; got != want {
+			t.Errorf("%q: cursor = %+v, want %+v", input, got, want)
+		}
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 12; x++ {
+				if got, want := replay.Cell(x, y).Attr, orig.Cell(x, y).Attr; got != want {
+					t.Errorf("%q: attr at %d,%d = %+v, want %+v", input, x, y, got, want)
+				}
+			}
+		}
+		if replay.altActive != orig.altActive || replay.cursorVisible != orig.cursorVisible ||
+			replay.top != orig.top || replay.bottom != orig.bottom || len(replay.modes) != len(orig.modes) {
+			t.Errorf("%q: modes differ after round trip", input)
+		}
+		if strings.Contains(replay.Text(), "\x1b") {
+			t.Errorf("%q: escape sequence leaked into text", input)
+		}
+	}
+}
@@ -1,66 +1,170 @@
 package websocket
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/Ayush-Vish/shellsync/backend/internal/auth"
 	"github.com/Ayush-Vish/shellsync/backend/internal/types"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
+// Encodings a client can negotiate with the encoding query parameter. Text
+// sends PTY bytes as JSON strings, which replaces invalid UTF-8. Base64 is
+// binary-safe and marks each pty_output/pty_input with "encoding": "base64".
+const (
+	encodingText   = "text"
+	encodingBase64 = "base64"
+)
+
+// flowAck is the flow query parameter of clients that acknowledge the output
+// they have rendered with ack messages. Other clients count as having
+// consumed output once it is written to their socket.
+const flowAck = "ack"
+
+// A client that has not consumed its output for clientStallTimeout is
+// disconnected. The slowest viewer paces a terminal, so one that stopped
+// reading (a dead connection, a frozen tab) must not hold everyone up for
+// long; it can reconnect and catch up from the replay.
+const clientStallTimeout = 30 * time.Second
+
+// maxClientQueueBytes bounds the output queued for one client. Flow control
+// keeps it far lower; the limit only matters for agents that do not take
+// part in it.
+const maxClientQueueBytes = 8 << 20
 
 type client struct {
-	conn      *websocket.Conn
-	writeChan chan interface{} // Channel for messages to be written
-	mu        sync.Mutex       // Mutex for connection state
-	closed    bool             // Flag to indicate if client is closed
+	id       string
+	conn     *websocket.Conn
+	encoding string // Encoding used for PTY data
+	acks     bool   // Client acknowledges rendered output
+
+	mu     sync.Mutex // Guards the fields below
+	closed bool       // Flag to indicate if client is closed
+	// queue holds the messages waiting for writeLoop, queued the PTY bytes
+	// among them. wake is signalled when either changes or the client
+	// closes.
+	queue  []outgoing
+	queued int
+	wake   chan struct{}
+	// unacked holds, by terminal, output written to an acknowledging
+	// client that it has not acknowledged yet.
+	unacked map[string][]outgoing
+}
+
+// outgoing is a message on its way to one client.
+type outgoing struct {
+	msg        map[string]interface{}
+	terminalID string
+	size       int // PTY bytes carried, counted against acknowledgements
+	delivery   *types.Delivery
+	written    time.Time
 }
 
 type Hub struct {
-	service  types.PTYService
-	clients  map[string]*client // Changed to store client struct
-	sessions map[string]map[string]bool
+	service types.PTYService
+	// sessions holds the connections of each session. Client IDs are only
+	// unique within their session, and a client can be connected more than
+	// once, from several tabs.
+	sessions map[string]map[*client]bool
 	mu       sync.RWMutex
+	// origins are the normalized origins of the pages allowed to connect.
+	origins  map[string]bool
+	upgrader websocket.Upgrader
 }
 
-func NewHub(service types.PTYService) *Hub {
-	return &Hub{
+// NewHub returns a hub that accepts WebSocket connections from pages served
+// from allowedOrigins, such as the frontend's URL.
+func NewHub(service types.PTYService, allowedOrigins []string) (*Hub, error) {
+	h := &Hub{
 		service:  service,
-		clients:  make(map[string]*client),
-		sessions: make(map[string]map[string]bool),
+		sessions: make(map[string]map[*client]bool),
+		origins:  make(map[string]bool),
+	}
+	for _, origin := range allowedOrigins {
+		normalized, err := normalizeOrigin(origin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed origin: %w", err)
+		}
+		h.origins[normalized] = true
 	}
+	h.upgrader.CheckOrigin = h.originAllowed
+	return h, nil
 }
 
 func (h *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	sessionID := r.URL.Query().Get("session_id")
 	clientID := r.URL.Query().Get("client_id")
+	encoding := r.URL.Query().Get("encoding")
+	flow := r.URL.Query().Get("flow")
 
 	log.Printf("New WebSocket connection attempt. SessionID: %s, ClientID: %s", sessionID, clientID)
-	if sessionID == "" || clientID == "" {
-		http.Error(w, "session_id and client_id are required", http.StatusBadRequest)
+	if sessionID == "" {
+		http.Error(w, "session_id is required", http.StatusBadRequest)
+		return
+	}
+	if encoding == "" {
+		encoding = encodingText
+	}
+	if encoding != encodingText && encoding != encodingBase64 {
+		http.Error(w, "unsupported encoding", http.StatusBadRequest)
+		return
+	}
+	if flow != "" && flow != flowAck {
+		http.Error(w, "unsupported flow", http.StatusBadRequest)
+		return
+	}
+	// Acknowledgements count raw PTY bytes, which only base64 preserves.
+	if flow == flowAck && encoding != encodingBase64 {
+		http.Error(w, "flow=ack requires encoding=base64", http.StatusBadRequest)
+		return
+	}
+
+	// Otherwise any website a participant visits could open a socket to
+	// the backend from their browser.
+	if !h.originAllowed(r) {
+		log.Printf("Rejected WebSocket connection of client %s to session %s: origin %q is not allowed", clientID, sessionID, r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	claims, err := h.service.VerifyJoinToken(sessionID, clientID, r.URL.Query().Get("token"))
+	if err != nil {
+		log.Printf("Rejected WebSocket connection of client %s to session %s: %v", clientID, sessionID, err)
+		http.Error(w, err.Error(), auth.HTTPStatus(err))
 		return
 	}
+	// The client_id of a shared link is ignored: the server names the
+	// client and hands it a token for that name to rejoin with.
+	var token string
+	if claims.ClientID == "" {
+		claims, token = h.service.AssignClientID(claims)
+		log.Printf("Named client %s in session %s (it asked for %q)", claims.ClientID, sessionID, clientID)
+	}
+	clientID = claims.ClientID
 
 	h.ensureSessionExists(sessionID)
 
 	if _, exists := h.service.GetSession(sessionID); !exists {
 		log.Printf("Attempt to connect to non-existent session ID: %s", sessionID)
-		h.service.AddClientToSession(sessionID, "host")
+		h.service.AddClientToSession(sessionID, "host", claims.Role)
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade failed for Client %s: %v", clientID, err)
 		return
 	}
 
-	h.registerClient(conn, sessionID, clientID)
-	go h.readLoop(conn, sessionID, clientID)
+	c := h.registerClient(conn, sessionID, clientID, claims.Role, token, encoding, flow == flowAck)
+	go h.readLoop(c, sessionID, clientID)
 }
 
 func (h *Hub) ensureSessionExists(sessionID string) {
@@ -68,78 +172,315 @@ func (h *Hub) ensureSessionExists(sessionID string) {
 	defer h.mu.Unlock()
 
 	if h.sessions[sessionID] == nil {
-		h.sessions[sessionID] = make(map[string]bool)
+		h.sessions[sessionID] = make(map[*client]bool)
 		log.Printf("Created session %s in WebSocket hub", sessionID)
 	}
 }
 
-func (h *Hub) registerClient(conn *websocket.Conn, sessionID, clientID string) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+// registerClient adds the client to the session with the role of its join
+// token, unless the owner gave it another, and greets it with a joined
+// message: its ID, its role and, if set, the token to rejoin with.
+func (h *Hub) registerClient(conn *websocket.Conn, sessionID, clientID, role, token, encoding string, acks bool) *client {
+	if h.service.AddClientToSession(sessionID, clientID, role) {
+		role = h.service.ClientRole(sessionID, clientID)
+	}
 
+	// Lock order is session, then hub, matching the service's output path.
+	// Holding the session lock while the client is added and its snapshot
+	// and replay are queued guarantees no output chunk is missed or
+	// delivered twice.
+	session, exists := h.service.GetSession(sessionID)
+	if exists {
+		session.Mu.RLock()
+	}
+
+	h.mu.Lock()
 	c := &client{
-		conn:      conn,
-		writeChan: make(chan interface{}, 100),
-		closed:    false,
+		id:       clientID,
+		conn:     conn,
+		encoding: encoding,
+		acks:     acks,
+		wake:     make(chan struct{}, 1),
+		unacked:  make(map[string][]outgoing),
 	}
 
-	h.clients[clientID] = c
 	if h.sessions[sessionID] == nil {
-		h.sessions[sessionID] = make(map[string]bool)
+		h.sessions[sessionID] = make(map[*client]bool)
 	}
-	h.sessions[sessionID][clientID] = true
+	h.sessions[sessionID][c] = true
+	joined := types.Message{Type: "joined", ClientID: clientID, Role: role, Token: token, Sender: "server"}
+	c.send(normalizeMessage(joined, c.encoding), joined)
+	if exists {
+		h.sendSessionState(c, session)
+		h.replayScrollback(c, session)
+		session.Mu.RUnlock()
+	}
+	h.announceRoleLocked(sessionID, clientID, role)
+	h.mu.Unlock()
 
-	h.service.AddClientToSession(sessionID, clientID)
 	log.Printf("Client %s registered to session %s", clientID, sessionID)
 
-	go h.writeLoop(c, clientID)
+	go h.writeLoop(c)
+	return c
 }
 
-func (h *Hub) unregisterClient(clientID, sessionID string) {
+// announceRoleLocked tells the other clients in the session that clientID
+// joined with role, or left if role is empty, so the owner knows whose role
+// it can change. It must be called with the hub lock held.
+func (h *Hub) announceRoleLocked(sessionID, clientID, role string) {
+	msg := types.Message{Type: "role_changed", ClientID: clientID, Role: role, Sender: "server"}
+	for c := range h.sessions[sessionID] {
+		if c.id != clientID {
+			c.send(normalizeMessage(msg, c.encoding), msg)
+		}
+	}
+}
+
+// sendSessionState queues the session_state snapshot, so the client can
+// restore its canvas before any terminal output arrives. It must be called
+// with the session lock held.
+func (h *Hub) sendSessionState(c *client, session *types.Session) {
+	msg := types.Message{
+		Type:   "session_state",
+		Sender: "server",
+		State:  session.SnapshotLocked(),
+	}
+	c.send(normalizeMessage(msg, c.encoding), msg)
+}
+
+// replayScrollback queues a redraw (or the recent output) of every terminal
+// in the session, oldest terminal first, ahead of any live output. It must be called with the
+// session lock held.
+func (h *Hub) replayScrollback(c *client, session *types.Session) {
+	terminals := make([]*types.Terminal, 0, len(session.Terminals))
+	for _, terminal := range session.Terminals {
+		terminals = append(terminals, terminal)
+	}
+	sort.Slice(terminals, func(i, j int) bool {
+		return terminals[i].CreatedAt.Before(terminals[j].CreatedAt)
+	})
+
+	for _, terminal := range terminals {
+		data := terminal.ReplayLocked()
+		if len(data) == 0 {
+			continue
+		}
+		msg := types.Message{
+			Type:       "pty_output",
+			TerminalID: terminal.ID,
+			Data:       data,
+			Sender:     "pty_agent",
+			Replay:     true,
+		}
+		c.send(normalizeMessage(msg, c.encoding), msg)
+	}
+}
+
+// unregisterClient removes and closes c. The others are told the client
+// left once its last connection is gone.
+func (h *Hub) unregisterClient(c *client, sessionID string) {
+	clientID := c.id
 	h.mu.Lock()
-	defer h.mu.Unlock()
+	delete(h.sessions[sessionID], c)
+	last := true
+	for other := range h.sessions[sessionID] {
+		last = last && other.id != clientID
+	}
+	if len(h.sessions[sessionID]) == 0 {
+		delete(h.sessions, sessionID)
+	}
+	if last {
+		h.announceRoleLocked(sessionID, clientID, "")
+	}
+	log.Printf("Client %s unregistered from session %s", clientID, sessionID)
+	h.mu.Unlock()
+	c.shutdown()
 
-	if c, ok := h.clients[clientID]; ok {
-		c.mu.Lock()
-		c.closed = true
-		close(c.writeChan)
-		c.conn.Close()
-		c.mu.Unlock()
-		delete(h.clients, clientID)
-		if h.sessions[sessionID] != nil {
-			delete(h.sessions[sessionID], clientID)
-			if len(h.sessions[sessionID]) == 0 {
-				delete(h.sessions, sessionID)
-			}
+	// The service takes the session lock, which must not be acquired while
+	// holding the hub lock. It counts the client's connections too.
+	h.service.RemoveClientFromSession(sessionID, clientID)
+}
+
+// send queues a message for writeLoop. Nothing is dropped: output is bounded
+// by flow control, and a client too far behind anyway is disconnected.
+func (c *client) send(msg map[string]interface{}, m types.Message) {
+	size := 0
+	if m.Type == "pty_output" {
+		size = len(m.Data)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	if c.queued+size > maxClientQueueBytes {
+		log.Printf("Client %s is more than %d bytes behind, disconnecting it", c.id, maxClientQueueBytes)
+		c.shutdownLocked()
+		return
+	}
+	m.Delivery.Hold()
+	c.queue = append(c.queue, outgoing{msg: msg, terminalID: m.TerminalID, size: size, delivery: m.Delivery})
+	c.queued += size
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// reply queues a message for this connection only.
+func (c *client) reply(m types.Message) {
+	c.send(normalizeMessage(m, c.encoding), m)
+}
+
+// next takes the first queued message, if any.
+func (c *client) next() (outgoing, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.queue) == 0 {
+		return outgoing{}, false
+	}
+	out := c.queue[0]
+	c.queue[0] = outgoing{}
+	c.queue = c.queue[1:]
+	c.queued -= out.size
+	return out, true
+}
+
+// sending records that out is about to be written to the socket. Output to
+// an acknowledging client is consumed only once it says so, which it may do
+// before the write returns, so out must be waiting for the ack by then.
+func (c *client) sending(out outgoing) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || !c.acks || out.size == 0 {
+		out.delivery.Release()
+		return
+	}
+	out.written = time.Now()
+	c.unacked[out.terminalID] = append(c.unacked[out.terminalID], out)
+}
+
+// ack consumes n bytes of a terminal's output, oldest first.
+func (c *client) ack(terminalID string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.unacked[terminalID]
+	for n > 0 && len(pending) > 0 {
+		if n < pending[0].size {
+			pending[0].size -= n
+			break
 		}
-		log.Printf("Client %s unregistered from session %s", clientID, sessionID)
+		n -= pending[0].size
+		pending[0].delivery.Release()
+		pending = pending[1:]
+	}
+	if len(pending) == 0 {
+		delete(c.unacked, terminalID)
+	} else {
+		c.unacked[terminalID] = pending
 	}
 }
 
-func (h *Hub) writeLoop(c *client, clientID string) {
-	for msg := range c.writeChan {
-		c.mu.Lock()
-		if c.closed {
-			c.mu.Unlock()
-			return
+// stalled reports whether output written to the client has gone
+// unacknowledged for longer than clientStallTimeout.
+func (c *client) stalled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pending := range c.unacked {
+		if len(pending) > 0 && time.Since(pending[0].written) > clientStallTimeout {
+			return true
 		}
-		if err := c.conn.WriteJSON(msg); err != nil {
-			log.Printf("Error writing message to client %s: %v", clientID, err)
-			c.mu.Unlock()
-			h.unregisterClient(clientID, "")
+	}
+	return false
+}
+
+func (c *client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// shutdown closes the connection, which also ends readLoop, and lets go of
+// everything the client still held so the terminals it was pacing resume.
+func (c *client) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shutdownLocked()
+}
+
+func (c *client) shutdownLocked() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	for _, out := range c.queue {
+		out.delivery.Release()
+	}
+	for _, pending := range c.unacked {
+		for _, out := range pending {
+			out.delivery.Release()
+		}
+	}
+	c.queue, c.queued, c.unacked = nil, 0, nil
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (h *Hub) writeLoop(c *client) {
+	ticker := time.NewTicker(clientStallTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.wake:
+		case <-ticker.C:
+			if c.stalled() {
+				log.Printf("Client %s has not acknowledged output for %s, disconnecting it", c.id, clientStallTimeout)
+				c.shutdown()
+				return
+			}
+		}
+		for {
+			out, ok := c.next()
+			if !ok {
+				break
+			}
+			// The write deadline catches a client that stopped reading its
+			// socket, which would otherwise stall the terminals it views.
+			c.conn.SetWriteDeadline(time.Now().Add(clientStallTimeout))
+			c.sending(out)
+			if err := c.conn.WriteJSON(out.msg); err != nil {
+				log.Printf("Error writing message to client %s: %v", c.id, err)
+				// Releases out along with everything else the client held.
+				c.shutdown()
+				return
+			}
+		}
+		if c.isClosed() {
 			return
 		}
-		c.mu.Unlock()
 	}
 }
 
-func normalizeMessage(msg types.Message) map[string]interface{} {
+func normalizeMessage(msg types.Message, encoding string) map[string]interface{} {
 	result := map[string]interface{}{
 		"type":    msg.Type,
 		"content": msg.Content,
 		"sender":  msg.Sender,
 	}
 
+	if msg.Data != nil {
+		if encoding == encodingBase64 {
+			result["content"] = base64.StdEncoding.EncodeToString(msg.Data)
+			result["encoding"] = encodingBase64
+		} else {
+			result["content"] = string(msg.Data)
+		}
+	}
+
 	if msg.TerminalID != "" {
 		result["terminalId"] = msg.TerminalID
 	}
@@ -149,18 +490,52 @@ func normalizeMessage(msg types.Message) map[string]interface{} {
 	if msg.Error != "" {
 		result["error"] = msg.Error
 	}
+	if msg.Replay {
+		result["replay"] = true
+	}
+	if msg.ReadOnly {
+		result["readOnly"] = true
+	}
+	if msg.Bytes > 0 {
+		result["bytes"] = msg.Bytes
+	}
+	if msg.State != nil {
+		result["session"] = msg.State
+	}
+	if msg.Type == "agent_notice" && msg.Notice != nil {
+		result["notice"] = msg.Notice
+	}
+	if msg.AgentStatus != "" {
+		result["status"] = msg.AgentStatus
+		if msg.AgentLatency > 0 {
+			result["latencyMs"] = types.LatencyMs(msg.AgentLatency)
+		}
+	}
+	if msg.Type == "role_changed" || msg.Type == "joined" {
+		result["clientId"] = msg.ClientID
+		result["role"] = msg.Role
+	}
+	if msg.Token != "" {
+		result["token"] = msg.Token
+	}
+	if msg.Type == "terminal_exited" {
+		result["exitCode"] = msg.ExitCode
+		if msg.Signal != "" {
+			result["signal"] = msg.Signal
+		}
+	}
 
 	return result
 }
 
-func (h *Hub) readLoop(conn *websocket.Conn, sessionID, clientID string) {
+func (h *Hub) readLoop(c *client, sessionID, clientID string) {
 	defer func() {
-		h.unregisterClient(clientID, sessionID)
+		h.unregisterClient(c, sessionID)
 	}()
 
 	for {
 		var rawMsg map[string]interface{}
-		if err := conn.ReadJSON(&rawMsg); err != nil {
+		if err := c.conn.ReadJSON(&rawMsg); err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Error reading from client %s: %v", clientID, err)
 			}
@@ -173,6 +548,18 @@ func (h *Hub) readLoop(conn *websocket.Conn, sessionID, clientID string) {
 			Sender:  clientID,
 		}
 
+		switch getString(rawMsg, "encoding") {
+		case encodingBase64:
+			data, err := base64.StdEncoding.DecodeString(msg.Content)
+			if err != nil {
+				log.Printf("Invalid base64 content from client %s: %v", clientID, err)
+				continue
+			}
+			msg.Data = data
+		default:
+			msg.Data = []byte(msg.Content)
+		}
+
 		if terminalId := getString(rawMsg, "terminalId"); terminalId != "" {
 			msg.TerminalID = terminalId
 		} else if terminalId := getString(rawMsg, "terminal_id"); terminalId != "" {
@@ -185,21 +572,57 @@ func (h *Hub) readLoop(conn *websocket.Conn, sessionID, clientID string) {
 			msg.FrontendID = frontendId
 		}
 
+		if msg.Type == "ack" {
+			// Acks arrive for every few kilobytes of output and are not
+			// worth a log line each.
+			n, err := strconv.Atoi(msg.Content)
+			if err != nil || n <= 0 || msg.TerminalID == "" {
+				log.Printf("Received invalid ack from client %s", clientID)
+				continue
+			}
+			c.ack(msg.TerminalID, n)
+			continue
+		}
+
 		log.Printf("Received message from client %s: Type=%s, TerminalID=%s, Content=%s",
 			clientID, msg.Type, msg.TerminalID, msg.Content)
 
+		// The role is looked up for every message, as the owner can change
+		// it at any time.
+		role := h.service.ClientRole(sessionID, clientID)
+		if reason := forbidden(role, msg.Type); reason != "" {
+			log.Printf("Refused %s from client %s with role %q", msg.Type, clientID, role)
+			h.refuse(c, msg, reason)
+			continue
+		}
+
 		switch msg.Type {
 		case "pty_input":
 			if msg.TerminalID == "" {
 				log.Printf("Received pty_input without terminal_id from client %s", clientID)
 				continue
 			}
-			log.Printf("Forwarding pty_input to agent: TerminalID=%s, Content=%s", msg.TerminalID, msg.Content)
-			h.service.ForwardInputToAgent(sessionID, msg.TerminalID, []byte(msg.Content))
+			log.Printf("Forwarding pty_input to agent: TerminalID=%s, Bytes=%d", msg.TerminalID, len(msg.Data))
+			if err := h.service.ForwardInputToAgent(sessionID, msg.TerminalID, clientID, msg.Data); err != nil {
+				c.reply(types.Message{
+					Type:       "terminal_error",
+					TerminalID: msg.TerminalID,
+					Error:      "Input not delivered: " + err.Error(),
+					Sender:     "server",
+				})
+				// The refused input is no longer outstanding either.
+				c.reply(types.Message{
+					Type:       "input_ack",
+					TerminalID: msg.TerminalID,
+					Bytes:      len(msg.Data),
+					Sender:     "server",
+				})
+			}
 
 		case "create_terminal":
 			var payload struct {
 				FrontendID string `json:"frontendId"`
+				types.TerminalOptions
 			}
 
 			if err := json.Unmarshal([]byte(msg.Content), &payload); err != nil {
@@ -213,7 +636,65 @@ func (h *Hub) readLoop(conn *websocket.Conn, sessionID, clientID string) {
 			}
 
 			log.Printf("Client %s requested a new terminal for session %s with FrontendID %s", clientID, sessionID, payload.FrontendID)
-			h.service.RequestNewTerminal(sessionID, payload.FrontendID)
+			h.service.RequestNewTerminal(sessionID, payload.FrontendID, payload.TerminalOptions)
+
+		case "close_terminal":
+			if msg.TerminalID == "" {
+				log.Printf("Received close_terminal without terminal_id from client %s", clientID)
+				continue
+			}
+			log.Printf("Client %s requested to close terminal %s in session %s", clientID, msg.TerminalID, sessionID)
+			h.service.CloseTerminal(sessionID, msg.TerminalID)
+
+		case "signal":
+			if msg.TerminalID == "" || msg.Content == "" {
+				log.Printf("Received signal without terminal_id or signal name from client %s", clientID)
+				continue
+			}
+			log.Printf("Client %s sent %s to terminal %s in session %s", clientID, msg.Content, msg.TerminalID, sessionID)
+			h.service.SignalTerminal(sessionID, msg.TerminalID, msg.Content)
+
+		case "resize":
+			// The smallest window sets the size of the PTY, so a viewer's
+			// window would shrink it for everyone; only those who can type
+			// size it.
+			if role != auth.RoleOwner && role != auth.RoleEditor {
+				continue
+			}
+			if msg.TerminalID == "" {
+				log.Printf("Received resize without terminal_id from client %s", clientID)
+				continue
+			}
+			var payload struct {
+				Rows uint16 `json:"rows"`
+				Cols uint16 `json:"cols"`
+			}
+			if err := json.Unmarshal([]byte(msg.Content), &payload); err != nil {
+				log.Printf("Error unmarshalling resize payload from client %s: %v", clientID, err)
+				continue
+			}
+			h.service.ResizeTerminal(sessionID, msg.TerminalID, clientID, payload.Rows, payload.Cols)
+
+		case "set_role":
+			var payload struct {
+				ClientID string `json:"clientId"`
+				Role     string `json:"role"`
+			}
+			if err := json.Unmarshal([]byte(msg.Content), &payload); err != nil {
+				log.Printf("Error unmarshalling set_role payload from client %s: %v", clientID, err)
+				continue
+			}
+			if err := h.service.SetClientRole(sessionID, payload.ClientID, payload.Role); err != nil {
+				h.refuse(c, msg, "Role not changed: "+err.Error())
+				continue
+			}
+			log.Printf("Client %s made %s a %s in session %s", clientID, payload.ClientID, payload.Role, sessionID)
+			h.BroadcastToSession(sessionID, types.Message{
+				Type:     "role_changed",
+				ClientID: payload.ClientID,
+				Role:     payload.Role,
+				Sender:   clientID,
+			})
 
 		default:
 			log.Printf("Received unknown message type '%s' from client %s", msg.Type, clientID)
@@ -221,6 +702,54 @@ func (h *Hub) readLoop(conn *websocket.Conn, sessionID, clientID string) {
 	}
 }
 
+// forbidden returns why a client with role may not send a message of
+// msgType, or "" if it may. Viewers can only watch; changing roles is up to
+// the owner.
+func forbidden(role, msgType string) string {
+	switch msgType {
+	case "pty_input", "create_terminal", "close_terminal", "signal":
+		if role != auth.RoleOwner && role != auth.RoleEditor {
+			return "Viewers cannot use the terminals"
+		}
+	case "set_role":
+		if role != auth.RoleOwner {
+			return "Only the owner can change roles"
+		}
+	}
+	return ""
+}
+
+// refuse tells the connection msg came from that it was not carried out.
+func (h *Hub) refuse(c *client, msg types.Message, reason string) {
+	frontendID := msg.FrontendID
+	if msg.Type == "create_terminal" {
+		// The frontend ID is in the payload, and lets the client drop the
+		// window it opened for the terminal.
+		var payload struct {
+			FrontendID string `json:"frontendId"`
+		}
+		if json.Unmarshal([]byte(msg.Content), &payload) == nil {
+			frontendID = payload.FrontendID
+		}
+	}
+	c.reply(types.Message{
+		Type:       "terminal_error",
+		TerminalID: msg.TerminalID,
+		FrontendID: frontendID,
+		Error:      reason,
+		Sender:     "server",
+	})
+	// Refused input is no longer outstanding either.
+	if msg.Type == "pty_input" && msg.TerminalID != "" {
+		c.reply(types.Message{
+			Type:       "input_ack",
+			TerminalID: msg.TerminalID,
+			Bytes:      len(msg.Data),
+			Sender:     "server",
+		})
+	}
+}
+
 func getString(m map[string]interface{}, key string) string {
 	if val, ok := m[key]; ok {
 		if str, ok := val.(string); ok {
@@ -230,6 +759,18 @@ func getString(m map[string]interface{}, key string) string {
 	return ""
 }
 
+// SendToClient queues a message for every connection of a single client of
+// a session, such as an acknowledgement of its input.
+func (h *Hub) SendToClient(sessionID, clientID string, message types.Message) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.sessions[sessionID] {
+		if c.id == clientID {
+			c.reply(message)
+		}
+	}
+}
+
 func (h *Hub) BroadcastToSession(sessionID string, message types.Message) {
 	h.mu.RLock()
 	sessionClients, ok := h.sessions[sessionID]
@@ -245,23 +786,17 @@ func (h *Hub) BroadcastToSession(sessionID string, message types.Message) {
 		}
 	}
 
-	normalizedMsg := normalizeMessage(message)
-	log.Printf("Broadcasting to session %s: %+v", sessionID, normalizedMsg)
-
-	for clientID := range sessionClients {
-		c, clientOk := h.clients[clientID]
-		if clientOk {
-			c.mu.Lock()
-			if !c.closed {
-				select {
-				case c.writeChan <- normalizedMsg:
+	log.Printf("Broadcasting to session %s: Type=%s, TerminalID=%s", sessionID, message.Type, message.TerminalID)
 
-				default:
-					log.Printf("Write channel for client %s is full, dropping message", clientID)
-				}
-			}
-			c.mu.Unlock()
+	// Clients in one session may use different encodings; normalize once per encoding.
+	normalized := make(map[string]map[string]interface{})
+	for c := range sessionClients {
+		normalizedMsg, ok := normalized[c.encoding]
+		if !ok {
+			normalizedMsg = normalizeMessage(message, c.encoding)
+			normalized[c.encoding] = normalizedMsg
 		}
+		c.send(normalizedMsg, message)
 	}
 	h.mu.RUnlock()
 }
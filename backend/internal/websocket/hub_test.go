@@ -0,0 +1,469 @@
+package websocket
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Ayush-Vish/shellsync/backend/internal/auth"
+	"github.com/Ayush-Vish/shellsync/backend/internal/types"
+	"github.com/gorilla/websocket"
+)
+
+// fakeService is enough of a PTYService for the hub to register clients.
+type fakeService struct {
+	types.PTYService
+}
+
+func (fakeService) AddClientToSession(sessionID, clientID, role string) bool { return true }
+func (fakeService) GetSession(sessionID string) (*types.Session, bool)       { return nil, false }
+func (fakeService) RemoveClientFromSession(sessionID, clientID string)       {}
+func (fakeService) ForwardInputToAgent(_, _, _ string, _ []byte) error       { return nil }
+func (fakeService) ClientRole(sessionID, clientID string) string             { return auth.RoleEditor }
+func (fakeService) VerifyJoinToken(sessionID, clientID, token string) (auth.Claims, error) {
+	return auth.Claims{SessionID: sessionID, ClientID: clientID, Role: auth.RoleEditor}, nil
+}
+
+func newHub(t *testing.T, service types.PTYService, allowedOrigins ...string) *Hub {
+	t.Helper()
+	h, err := NewHub(service, allowedOrigins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func dial(t *testing.T, h *Hub, query string) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleWebSocket))
+	t.Cleanup(srv.Close)
+	before := clientCount(h)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?"+query, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if clientCount(h) > before {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client was not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func clientCount(h *Hub) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for _, clients := range h.sessions {
+		n += len(clients)
+	}
+	return n
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestBroadcastFloodReachesSlowClient floods one terminal with far more
+// messages than a client can take at once. Every chunk must arrive, in
+// order, and stay held until the client acknowledges it.
+func TestBroadcastFloodReachesSlowClient(t *testing.T) {
+	const chunks = 2000
+
+	h := newHub(t, fakeService{})
+	conn := dial(t, h, "session_id=s&client_id=c&encoding=base64&flow=ack")
+	readType(t, conn, "joined")
+
+	var released atomic.Int64
+	for i := 0; i < chunks; i++ {
+		d := types.NewDelivery(func() { released.Add(1) })
+		h.BroadcastToSession("s", types.Message{
+			Type:       "pty_output",
+			TerminalID: "t",
+			Data:       []byte(fmt.Sprintf("chunk %05d\n", i)),
+			Delivery:   d,
+		})
+		d.Release()
+	}
+	if n := released.Load(); n != 0 {
+		t.Fatalf("%d chunks released before the client acknowledged any", n)
+	}
+
+	for i := 0; i < chunks; i++ {
+		var msg struct {
+			Type       string `json:"type"`
+			TerminalID string `json:"terminalId"`
+			Content    string `json:"content"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("read chunk %d: %v", i, err)
+		}
+		data, err := base64.StdEncoding.DecodeString(msg.Content)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("chunk %05d\n", i); string(data) != want {
+			t.Fatalf("chunk %d = %q, want %q", i, data, want)
+		}
+		ack := map[string]string{"type": "ack", "terminalId": "t", "content": strconv.Itoa(len(data))}
+		if err := conn.WriteJSON(ack); err != nil {
+			t.Fatalf("ack chunk %d: %v", i, err)
+		}
+	}
+
+	waitFor(t, "all chunks to be released", func() bool { return released.Load() == chunks })
+}
+
+// TestDisconnectReleasesHeldOutput checks that a client going away lets go of
+// the output it was holding, so the terminal it paced can continue.
+func TestDisconnectReleasesHeldOutput(t *testing.T) {
+	h := newHub(t, fakeService{})
+	conn := dial(t, h, "session_id=s&client_id=c&encoding=base64&flow=ack")
+
+	var released atomic.Int64
+	for i := 0; i < 10; i++ {
+		d := types.NewDelivery(func() { released.Add(1) })
+		h.BroadcastToSession("s", types.Message{Type: "pty_output", TerminalID: "t", Data: []byte("x"), Delivery: d})
+		d.Release()
+	}
+	conn.Close()
+
+	waitFor(t, "held output to be released", func() bool { return released.Load() == 10 })
+}
+
+// TestSameClientIDInTwoSessions checks that a message for a client only
+// reaches the client of that ID in the session it was meant for.
+func TestSameClientIDInTwoSessions(t *testing.T) {
+	h := newHub(t, fakeService{})
+	first := dial(t, h, "session_id=s1&client_id=c")
+	second := dial(t, h, "session_id=s2&client_id=c")
+	readType(t, first, "joined")
+	readType(t, second, "joined")
+
+	h.SendToClient("s2", "c", types.Message{Type: "input_ack", TerminalID: "t", Bytes: 3})
+	if msg := readType(t, second, "input_ack"); msg["bytes"] != float64(3) {
+		t.Fatalf("input_ack = %v", msg)
+	}
+	first.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var msg map[string]interface{}
+	if err := first.ReadJSON(&msg); err == nil {
+		t.Fatalf("client of the other session got %v", msg)
+	}
+}
+
+// TestClientInTwoTabs checks that a client connected twice gets messages on
+// both connections, and on the other once one closes.
+func TestClientInTwoTabs(t *testing.T) {
+	h := newHub(t, fakeService{})
+	first := dial(t, h, "session_id=s&client_id=c")
+	second := dial(t, h, "session_id=s&client_id=c")
+	readType(t, first, "joined")
+	readType(t, second, "joined")
+
+	h.SendToClient("s", "c", types.Message{Type: "input_ack", TerminalID: "t", Bytes: 1})
+	readType(t, first, "input_ack")
+	readType(t, second, "input_ack")
+
+	first.Close()
+	waitFor(t, "the first tab to be unregistered", func() bool { return clientCount(h) == 1 })
+	h.BroadcastToSession("s", types.Message{Type: "agent_status", AgentStatus: types.AgentConnected})
+	readType(t, second, "agent_status")
+}
+
+// tokenService checks join tokens like the real service does.
+type tokenService struct {
+	fakeService
+	signer *auth.Signer
+}
+
+func (s tokenService) VerifyJoinToken(sessionID, clientID, token string) (auth.Claims, error) {
+	claims, err := s.signer.Verify(token, time.Now())
+	if err == nil && claims.SessionID != sessionID {
+		err = auth.ErrWrongSession
+	}
+	if err == nil && clientID != "" && claims.ClientID != "" && claims.ClientID != clientID {
+		err = auth.ErrWrongClient
+	}
+	return claims, err
+}
+
+func (s tokenService) AssignClientID(claims auth.Claims) (auth.Claims, string) {
+	claims.ClientID = "named"
+	return claims, s.signer.Issue(claims, time.Hour)
+}
+
+// TestJoinTokenRequired checks that the upgrade is refused, with the
+// matching status, unless the token is valid for the session.
+func TestJoinTokenRequired(t *testing.T) {
+	signer := auth.NewSigner([]byte("test key"))
+	srv := httptest.NewServer(http.HandlerFunc(newHub(t, tokenService{signer: signer}).HandleWebSocket))
+	t.Cleanup(srv.Close)
+
+	valid := signer.Issue(auth.Claims{SessionID: "s", Role: auth.RoleEditor}, time.Hour)
+	tests := []struct {
+		name, token string
+		status      int
+	}{
+		{"valid", valid, http.StatusSwitchingProtocols},
+		{"missing", "", http.StatusUnauthorized},
+		{"tampered", "x" + valid, http.StatusUnauthorized},
+		{"malformed", "garbage", http.StatusBadRequest},
+		{"expired", signer.Issue(auth.Claims{SessionID: "s", Role: auth.RoleEditor}, -time.Minute), http.StatusUnauthorized},
+		{"other session", signer.Issue(auth.Claims{SessionID: "other", Role: auth.RoleEditor}, time.Hour), http.StatusForbidden},
+		{"own client", signer.Issue(auth.Claims{SessionID: "s", ClientID: "c", Role: auth.RoleEditor}, time.Hour), http.StatusSwitchingProtocols},
+		{"other client", signer.Issue(auth.Claims{SessionID: "s", ClientID: "owner", Role: auth.RoleOwner}, time.Hour), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?session_id=s&client_id=c&token=" + tt.token
+		conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+// roleService hands out the role named by the token and keeps the roles of
+// the clients like the real service does.
+type roleService struct {
+	fakeService
+	mu      sync.Mutex
+	roles   map[string]string
+	named   int
+	inputs  int
+	resizes int
+}
+
+// VerifyJoinToken takes a role for a token, or "role:clientID" for the
+// token of a client named by AssignClientID. Like the owner's link, the
+// owner's token is for the client that shows it.
+func (s *roleService) VerifyJoinToken(sessionID, clientID, token string) (auth.Claims, error) {
+	role, id, _ := strings.Cut(token, ":")
+	if role == auth.RoleOwner {
+		id = clientID
+	}
+	return auth.Claims{SessionID: sessionID, ClientID: id, Role: role}, nil
+}
+
+func (s *roleService) AssignClientID(claims auth.Claims) (auth.Claims, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.named++
+	claims.ClientID = "named-" + strconv.Itoa(s.named)
+	return claims, claims.Role + ":" + claims.ClientID
+}
+
+func (s *roleService) AddClientToSession(sessionID, clientID, role string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles[clientID] = role
+	return true
+}
+
+func (s *roleService) ClientRole(sessionID, clientID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.roles[clientID]
+}
+
+func (s *roleService) SetClientRole(sessionID, clientID, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles[clientID] = role
+	return nil
+}
+
+func (s *roleService) ForwardInputToAgent(_, _, _ string, _ []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inputs++
+	return nil
+}
+
+func (s *roleService) ResizeTerminal(_, _, _ string, _, _ uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resizes++
+}
+
+// readType reads messages until one of type want arrives.
+func readType(t *testing.T, conn *websocket.Conn, want string) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", want, err)
+		}
+		if msg["type"] == want {
+			return msg
+		}
+	}
+}
+
+// TestRoles checks that a viewer can neither type nor change roles, nor
+// pass for the owner, and that the owner's role changes reach everyone and
+// take effect.
+func TestRoles(t *testing.T) {
+	svc := &roleService{roles: make(map[string]string)}
+	h := newHub(t, svc)
+	owner := dial(t, h, "session_id=s&client_id=o&token="+auth.RoleOwner)
+	viewer := dial(t, h, "session_id=s&client_id=o&token="+auth.RoleViewer)
+
+	if msg := readType(t, owner, "joined"); msg["clientId"] != "o" || msg["role"] != auth.RoleOwner || msg["token"] != nil {
+		t.Fatalf("owner joined as %v", msg)
+	}
+	// The viewer asked for the owner's ID, but is named by the server.
+	msg := readType(t, viewer, "joined")
+	v, _ := msg["clientId"].(string)
+	if v == "" || v == "o" || msg["role"] != auth.RoleViewer || msg["token"] != auth.RoleViewer+":"+v {
+		t.Fatalf("viewer joined as %v", msg)
+	}
+	if role := svc.ClientRole("s", "o"); role != auth.RoleOwner {
+		t.Fatalf("owner is now %s", role)
+	}
+
+	input := map[string]string{"type": "pty_input", "terminalId": "t", "content": "ls\n"}
+	if err := viewer.WriteJSON(input); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readType(t, viewer, "terminal_error"); msg["terminalId"] != "t" {
+		t.Fatalf("refusal %v is not about the terminal", msg)
+	}
+	if msg := readType(t, viewer, "input_ack"); msg["bytes"] != float64(3) {
+		t.Fatalf("refused input acknowledged as %v bytes", msg["bytes"])
+	}
+
+	promote := map[string]string{"type": "set_role", "content": `{"clientId":"` + v + `","role":"editor"}`}
+	if err := viewer.WriteJSON(promote); err != nil {
+		t.Fatal(err)
+	}
+	readType(t, viewer, "terminal_error")
+	if role := svc.ClientRole("s", v); role != auth.RoleViewer {
+		t.Fatalf("viewer made itself %s", role)
+	}
+
+	if err := owner.WriteJSON(promote); err != nil {
+		t.Fatal(err)
+	}
+	// The owner first hears of the viewer joining.
+	if msg := readType(t, owner, "role_changed"); msg["clientId"] != v || msg["role"] != auth.RoleViewer {
+		t.Fatalf("join announced as %v", msg)
+	}
+	for _, conn := range []*websocket.Conn{owner, viewer} {
+		if msg := readType(t, conn, "role_changed"); msg["clientId"] != v || msg["role"] != auth.RoleEditor {
+			t.Fatalf("role_changed = %v", msg)
+		}
+	}
+	if err := viewer.WriteJSON(input); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the editor's input", func() bool {
+		svc.mu.Lock()
+		defer svc.mu.Unlock()
+		return svc.inputs == 1
+	})
+}
+
+// TestViewerResizeIgnored checks that a viewer's window does not size the
+// terminals, as the smallest window would shrink them for everyone, while
+// an editor's does.
+func TestViewerResizeIgnored(t *testing.T) {
+	svc := &roleService{roles: make(map[string]string)}
+	h := newHub(t, svc)
+	resize := map[string]string{"type": "resize", "terminalId": "t", "content": `{"rows":10,"cols":20}`}
+	input := map[string]string{"type": "pty_input", "terminalId": "t", "content": "x"}
+	resizes := func() int {
+		svc.mu.Lock()
+		defer svc.mu.Unlock()
+		return svc.resizes
+	}
+
+	viewer := dial(t, h, "session_id=s&token="+auth.RoleViewer)
+	readType(t, viewer, "joined")
+	// Messages are handled in order, so once the input that follows is
+	// refused the resize has been dealt with.
+	for _, msg := range []map[string]string{resize, input} {
+		if err := viewer.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readType(t, viewer, "terminal_error")
+	if n := resizes(); n != 0 {
+		t.Fatalf("viewer resized the terminal %d times", n)
+	}
+
+	editor := dial(t, h, "session_id=s&token="+auth.RoleEditor)
+	readType(t, editor, "joined")
+	if err := editor.WriteJSON(resize); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the editor's resize", func() bool { return resizes() == 1 })
+}
+
+// TestOriginAllowlist checks that only pages from the allowed origins, and
+// programs that send no origin, can open a socket.
+func TestOriginAllowlist(t *testing.T) {
+	h := newHub(t, fakeService{}, "http://localhost:3000", "https://shellsync.example/")
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleWebSocket))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		origin string
+		status int
+	}{
+		{"http://localhost:3000", http.StatusSwitchingProtocols},
+		{"HTTP://LOCALHOST:3000", http.StatusSwitchingProtocols},
+		{"https://shellsync.example", http.StatusSwitchingProtocols},
+		{"https://shellsync.example:443", http.StatusSwitchingProtocols},
+		{"", http.StatusSwitchingProtocols},
+		{"http://localhost:3001", http.StatusForbidden},
+		{"https://localhost:3000", http.StatusForbidden},
+		{"http://shellsync.example", http.StatusForbidden},
+		{"http://localhost:3000.evil.example", http.StatusForbidden},
+		{"https://evil.example", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?session_id=s&client_id=c" + strconv.Itoa(i)
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("origin %q: %v", tt.origin, err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("origin %q: status %d, want %d", tt.origin, resp.StatusCode, tt.status)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// normalizeOrigin reduces an origin, or the URL of a site, to the
+// scheme://host[:port] form browsers send in the Origin header, in lower case
+// and without the scheme's default port.
+func normalizeOrigin(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("%q is not an http or https origin", raw)
+	}
+	host := strings.ToLower(u.Host)
+	if scheme == "http" {
+		host = strings.TrimSuffix(host, ":80")
+	} else {
+		host = strings.TrimSuffix(host, ":443")
+	}
+	return scheme + "://" + host, nil
+}
+
+// originAllowed reports whether a WebSocket upgrade may come from the page
+// that sent r. Browsers always send Origin with a WebSocket request, so one
+// without it comes from a program rather than a web page, and only needs its
+// join token.
+func (h *Hub) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	normalized, err := normalizeOrigin(origin)
+	return err == nil && h.origins[normalized]
+}
@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	controller "github.com/Ayush-Vish/shellsync/client/controller"
+	"github.com/spf13/cobra"
+)
+
+// daemonStartTimeout is how long `shellsync daemon` waits for the detached
+// agent to have a session before giving up on it.
+const daemonStartTimeout = 30 * time.Second
+
+var (
+	socketPath string
+	pidFile    string
+	logFile    string
+	foreground bool
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run the agent in the background",
+	Long: `Run the agent in the background. The agent detaches from the terminal,
+writes its pid file and answers "shellsync status" and "shellsync stop" on
+a local control socket. Its output goes to the log file.`,
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if foreground {
+			return runDaemon()
+		}
+		return startDaemon()
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:           "status",
+	Short:         "Show the session served by the background agent",
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		status, err := controller.QueryStatus(socketPath)
+		if err != nil {
+			return err
+		}
+		printStatus(status)
+		return nil
+	},
+}
+
+var stopCmd = &cobra.Command{
+	Use:           "stop",
+	Short:         "Close the background agent's terminals and stop it",
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := controller.RequestStop(socketPath); err != nil {
+			return err
+		}
+		fmt.Println("Agent stopped.")
+		return nil
+	},
+}
+
+func init() {
+	dir := runtimeDir()
+	for _, cmd := range []*cobra.Command{daemonCmd, statusCmd, stopCmd} {
+		cmd.Flags().StringVar(&socketPath, "socket", filepath.Join(dir, "agent.sock"), "Control socket of the background agent")
+		rootCmd.AddCommand(cmd)
+	}
+	daemonCmd.Flags().StringVar(&pidFile, "pid-file", filepath.Join(dir, "agent.pid"), "File to write the agent's process ID to")
+	daemonCmd.Flags().StringVar(&logFile, "log-file", filepath.Join(dir, "agent.log"), "File the agent logs to")
+	daemonCmd.Flags().BoolVar(&foreground, "foreground", false, "Run in this process instead of detaching, e.g. under a service manager")
+}
+
+// runtimeDir holds the control socket, pid file and log by default.
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "shellsync")
+	}
+	return filepath.Join(os.TempDir(), "shellsync-"+strconv.Itoa(os.Getuid()))
+}
+
+// prepareDirs creates the directories of the daemon's files. The default
+// runtime directory may sit in a shared temp directory, so it must be ours
+// and private.
+func prepareDirs(paths ...string) error {
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+		if dir != runtimeDir() {
+			continue
+		}
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || info.Mode().Perm()&0o077 != 0 || !ownedByUs(info) {
+			return fmt.Errorf("%s is not a private directory", dir)
+		}
+	}
+	return nil
+}
+
+func openLogFile() (*os.File, error) {
+	if err := prepareDirs(logFile); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+}
+
+// startDaemon starts the agent again as a detached process and waits until
+// it has a session to share.
+func startDaemon() error {
+	if status, err := controller.QueryStatus(socketPath); err == nil {
+		return fmt.Errorf("an agent is already running (pid %d)", status.PID)
+	}
+	if err := prepareDirs(socketPath, pidFile); err != nil {
+		return err
+	}
+	out, err := openLogFile()
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	child := exec.Command(exe, append(os.Args[1:], "--foreground")...)
+	child.Stdout = out
+	child.Stderr = out
+	child.SysProcAttr = detachedProcess()
+	if err := child.Start(); err != nil {
+		return fmt.Errorf("failed to start the agent: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- child.Wait() }()
+
+	deadline := time.After(daemonStartTimeout)
+	for {
+		select {
+		case <-exited:
+			return fmt.Errorf("the agent exited during startup, see %s", logFile)
+		case <-deadline:
+			return fmt.Errorf("the agent did not start within %s, see %s", daemonStartTimeout, logFile)
+		case <-time.After(100 * time.Millisecond):
+		}
+		status, err := controller.QueryStatus(socketPath)
+		if err != nil || status.URL == "" {
+			continue
+		}
+		fmt.Printf("Agent running in the background (pid %d).\n", status.PID)
+		controller.PrintURLs(status.URL, status.EditorURL, status.ViewerURL)
+		fmt.Printf("Logs go to %s. Run \"shellsync stop\" to stop it.\n", logFile)
+		return nil
+	}
+}
+
+// runDaemon is the detached agent itself.
+func runDaemon() error {
+	if status, err := controller.QueryStatus(socketPath); err == nil {
+		return fmt.Errorf("an agent is already running (pid %d)", status.PID)
+	}
+	if err := prepareDirs(socketPath, pidFile); err != nil {
+		return err
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(pidFile, []byte(pid+"\n"), 0o644); err != nil {
+		return err
+	}
+	defer func() {
+		// Leave the file alone if another agent has taken it over.
+		if data, err := os.ReadFile(pidFile); err == nil && strings.TrimSpace(string(data)) == pid {
+			os.Remove(pidFile)
+		}
+	}()
+
+	cfg := agentConfig
+	cfg.ControlSocket = socketPath
+	return controller.Start(host, port, cfg)
+}
+
+func printStatus(status *controller.Status) {
+	state := "connected to"
+	if !status.Connected {
+		state = "reconnecting to"
+	}
+	fmt.Printf("Session:   %s (%s %s)\n", status.SessionID, state, status.Backend)
+	fmt.Printf("URL:       %s\n", status.URL)
+	fmt.Printf("Editors:   %s\n", status.EditorURL)
+	fmt.Printf("Viewers:   %s\n", status.ViewerURL)
+	fmt.Printf("Agent:     pid %d, up %s\n", status.PID, time.Since(status.StartedAt).Round(time.Second))
+	fmt.Printf("Terminals: %d\n", len(status.Terminals))
+	for _, t := range status.Terminals {
+		if t.Tmux != "" {
+			fmt.Printf("  %s  tmux %s (pid %d)\n", t.ID, t.Tmux, t.PID)
+			continue
+		}
+		fmt.Printf("  %s  %s (pid %d)\n", t.ID, t.Command, t.PID)
+	}
+	fmt.Printf("Output:    %d bytes from %d reads in %d messages (%d saved by coalescing)\n",
+		status.Output.Bytes, status.Output.Reads, status.Output.Messages, status.Output.Saved())
+	fmt.Printf("Guests:    %d\n", len(status.Guests))
+	for _, guest := range status.Guests {
+		fmt.Printf("  %s\n", guest)
+	}
+}
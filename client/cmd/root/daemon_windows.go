@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// detachedProcess starts the agent without a console, so it survives the
+// console that started it being closed.
+func detachedProcess() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS,
+		HideWindow:    true,
+	}
+}
+
+// Windows has no uid to compare; the directory is checked for its mode only.
+func ownedByUs(info os.FileInfo) bool {
+	return true
+}
@@ -2,7 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
 
 	controller "github.com/Ayush-Vish/shellsync/client/controller"
 	"github.com/common-nighthawk/go-figure"
@@ -11,6 +13,7 @@ import (
 
 var host string
 var port int
+var agentConfig = controller.DefaultConfig()
 
 var rootCmd = &cobra.Command{
 	Use:   "shellsync",
@@ -19,13 +22,49 @@ var rootCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		myFigure := figure.NewFigure("ShellSync", "doom", true)
 		myFigure.Print()
-		controller.Start(host, port)
+		if agentConfig.Attach {
+			// Log lines would land in the middle of the host's shell.
+			out, err := openLogFile()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer out.Close()
+			log.SetOutput(out)
+			fmt.Printf("Logs go to %s. Exit the shell to stop sharing.\n", logFile)
+		}
+		if err := controller.Start(host, port, agentConfig); err != nil {
+			log.Fatal(err)
+		}
 	},
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringVar(&host, "host", "localhost", "Host to connect to")
 	rootCmd.PersistentFlags().IntVar(&port, "port", 5001, "Port to connect to")
+	rootCmd.PersistentFlags().StringVar(&agentConfig.DefaultShell, "shell", agentConfig.DefaultShell, "Shell to start when neither the request nor $SHELL names one")
+	rootCmd.PersistentFlags().DurationVar(&agentConfig.CoalesceDelay, "coalesce-delay", agentConfig.CoalesceDelay, "How long PTY output may wait to be merged into one message (0 disables coalescing)")
+	rootCmd.PersistentFlags().IntVar(&agentConfig.CoalesceMaxBytes, "coalesce-max-bytes", agentConfig.CoalesceMaxBytes, "Send merged PTY output once it reaches this many bytes")
+	rootCmd.PersistentFlags().IntVar(&agentConfig.OutputWindow, "output-window", agentConfig.OutputWindow, "Output per terminal that may be unconsumed by viewers before the PTY is paused (0 disables output flow control)")
+	rootCmd.PersistentFlags().IntVar(&agentConfig.InputWindow, "input-window", agentConfig.InputWindow, "Input per terminal the backend may send ahead of it being written (0 disables input flow control)")
+	rootCmd.PersistentFlags().StringSliceVar(&agentConfig.AllowedOverrides, "allow-override", agentConfig.AllowedOverrides, "Terminal options remote collaborators may override (command, cwd, env, term)")
+	rootCmd.PersistentFlags().BoolVar(&agentConfig.TmuxBacked, "tmux-backed", false, "Run every terminal in a tmux session, so shells survive the agent and are adopted when it starts again")
+	rootCmd.PersistentFlags().StringVar(&agentConfig.TmuxSocket, "tmux-socket", agentConfig.TmuxSocket, "Socket name of the tmux server for --tmux-backed terminals")
+	rootCmd.PersistentFlags().DurationVar(&agentConfig.IdleTimeout, "idle-timeout", 0, "End the session after this long without input or output on any terminal (0 disables)")
+	rootCmd.PersistentFlags().DurationVar(&agentConfig.MaxLifetime, "max-lifetime", 0, "End the session once it is this old (0 disables)")
+	rootCmd.PersistentFlags().DurationVar(&agentConfig.PolicyWarning, "policy-warning", agentConfig.PolicyWarning, "How long before --idle-timeout or --max-lifetime ends the session to warn everyone")
+	rootCmd.PersistentFlags().IntVar(&agentConfig.MaxTerminals, "max-terminals", agentConfig.MaxTerminals, "Terminals the agent runs at once before it refuses to create more (0 means no limit)")
+	rootCmd.PersistentFlags().IntVar(&agentConfig.Limits.MaxProcesses, "limit-processes", 0, "Processes each terminal may run, enforced with cgroup v2 (0 means no limit)")
+	rootCmd.PersistentFlags().IntVar(&agentConfig.Limits.MaxOpenFiles, "limit-open-files", 0, "Files each process in a terminal may have open (0 means no limit)")
+	rootCmd.PersistentFlags().DurationVar(&agentConfig.Limits.CPUTime, "limit-cpu", 0, "CPU time each process in a terminal may use (0 means no limit)")
+	rootCmd.PersistentFlags().Int64Var(&agentConfig.Limits.MemoryMB, "limit-memory-mb", 0, "Memory each terminal may use in MiB, enforced with cgroup v2 (0 means no limit)")
+	rootCmd.PersistentFlags().StringVar(&agentConfig.Limits.Cgroup, "limit-cgroup", "", "cgroup v2 directory without processes of its own to create the terminals' cgroups in (default the agent's own cgroup)")
+	rootCmd.PersistentFlags().BoolVar(&agentConfig.TLS.Insecure, "insecure", false, "Connect to the server without TLS, sending everything in the clear")
+	rootCmd.PersistentFlags().StringVar(&agentConfig.TLS.CAFile, "tls-ca", "", "CA certificates to verify the server with instead of the system's")
+	rootCmd.PersistentFlags().StringVar(&agentConfig.TLS.CertFile, "tls-cert", "", "Client certificate for servers that require mutual TLS")
+	rootCmd.PersistentFlags().StringVar(&agentConfig.TLS.KeyFile, "tls-key", "", "Key of the client certificate")
+	rootCmd.PersistentFlags().StringVar(&agentConfig.TLS.ServerName, "tls-server-name", "", "Name the server's certificate must be for (defaults to --host)")
+	rootCmd.Flags().BoolVar(&agentConfig.Attach, "attach", false, "Work in the shared default terminal from this terminal")
+	rootCmd.Flags().StringVar(&logFile, "log-file", filepath.Join(runtimeDir(), "agent.log"), "File the agent logs to in attached mode")
 
 }
 
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/Ayush-Vish/shellsync/client/runner"
+	"github.com/spf13/cobra"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run [flags] -- command [args...]",
+	Short: "Run a command and share its output",
+	Long: `Run a command in a new session and share its output live as a read-only
+terminal, for example "shellsync run -- make test". The output shows here
+as well, and shellsync exits with the command's exit status once it
+finishes.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// Log lines would land in the middle of the command's output.
+		out, err := openLogFile()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(out)
+		fmt.Printf("Logs go to %s.\n", logFile)
+		status := runner.Run(host, port, agentConfig, args)
+		out.Close()
+		os.Exit(status)
+	},
+}
+
+func init() {
+	runCmd.Flags().StringVar(&logFile, "log-file", filepath.Join(runtimeDir(), "agent.log"), "File the agent logs to")
+	// Flags after the command's name are the command's own.
+	runCmd.Flags().SetInterspersed(false)
+	rootCmd.AddCommand(runCmd)
+}
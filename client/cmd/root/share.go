@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"log"
+
+	controller "github.com/Ayush-Vish/shellsync/client/controller"
+	"github.com/common-nighthawk/go-figure"
+	"github.com/spf13/cobra"
+)
+
+var shareTarget string
+
+var shareCmd = &cobra.Command{
+	Use:   "share",
+	Short: "Share an existing tmux pane",
+	Long: `Share an existing tmux session, window or pane as the session's default
+terminal, for example "shellsync share --tmux work:1". Guests see its
+window and can type into it while you keep working in it; stopping the
+agent leaves the pane as it was. Which pane of the window is active is up
+to you; signals from guests go to the pane you shared.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		myFigure := figure.NewFigure("ShellSync", "doom", true)
+		myFigure.Print()
+		cfg := agentConfig
+		cfg.TmuxShare = shareTarget
+		if err := controller.Start(host, port, cfg); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	shareCmd.Flags().StringVar(&shareTarget, "tmux", "", "tmux target to share: session, session:window or session:window.pane")
+	shareCmd.MarkFlagRequired("tmux")
+	rootCmd.AddCommand(shareCmd)
+}
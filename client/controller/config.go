@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+)
+
+// Overrides a remote collaborator can request in create_terminal.
+const (
+	OverrideCommand = "command"
+	OverrideCwd     = "cwd"
+	OverrideEnv     = "env"
+	OverrideTerm    = "term"
+)
+
+const defaultTerm = "xterm-256color"
+
+// Config holds the agent settings that come from command-line flags.
+type Config struct {
+	// DefaultShell is used when the request has no command and $SHELL is unset.
+	DefaultShell string
+	// AllowedOverrides lists the Override* names remote collaborators may set.
+	AllowedOverrides []string
+	// CoalesceDelay is how long PTY output may wait to be merged with later
+	// reads into one message. Zero sends every read immediately.
+	CoalesceDelay time.Duration
+	// CoalesceMaxBytes sends a merged message as soon as it reaches this size.
+	CoalesceMaxBytes int
+	// OutputWindow is how much output per terminal may be on its way to the
+	// viewers before the PTY is no longer read. InputWindow is how much
+	// input per terminal the backend may send ahead of it being written to
+	// the PTY. Zero turns flow control off in that direction.
+	OutputWindow int
+	InputWindow  int
+	// Attach shows the default terminal in the terminal the agent runs in
+	// and lets the host type into it.
+	Attach bool
+	// TmuxBacked runs every terminal in a session on the tmux server
+	// TmuxSocket, so shells survive the agent and a later agent adopts them.
+	TmuxBacked bool
+	TmuxSocket string
+	// TmuxShare is an existing tmux session, session:window or
+	// session:window.pane to share as the default terminal.
+	TmuxShare string
+	// IdleTimeout stops the agent once no terminal has had input or output
+	// for that long, and MaxLifetime once the session is that old. Users
+	// are warned PolicyWarning before. Zero disables a policy.
+	IdleTimeout   time.Duration
+	MaxLifetime   time.Duration
+	PolicyWarning time.Duration
+	// MaxTerminals is how many terminals the agent runs at once before it
+	// refuses to create more. Zero means no limit.
+	MaxTerminals int
+	// Limits caps what the shell of each terminal may use.
+	Limits ShellLimits
+	// Job is a command to run, instead of a shell, as the session's only
+	// terminal. Viewers can only watch it, and the agent stops once it
+	// exits.
+	Job []string
+	// TLS secures the link to the backend.
+	TLS TLSConfig
+	// ControlSocket is the Unix socket Start answers status and stop
+	// requests on. Empty means no control socket.
+	ControlSocket string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		DefaultShell:     "/bin/sh",
+		AllowedOverrides: []string{OverrideCwd, OverrideTerm},
+		CoalesceDelay:    5 * time.Millisecond,
+		CoalesceMaxBytes: 32 * 1024,
+		OutputWindow:     256 * 1024,
+		InputWindow:      64 * 1024,
+		TmuxSocket:       "shellsync",
+		PolicyWarning:    time.Minute,
+		MaxTerminals:     16,
+	}
+}
+
+func (c Config) allows(override string) bool {
+	for _, o := range c.AllowedOverrides {
+		if strings.EqualFold(strings.TrimSpace(o), override) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOverrides rejects a request that sets an option this agent does not
+// let remote collaborators change.
+func (c Config) checkOverrides(req *pb.CreateTerminalRequest) error {
+	requested := map[string]bool{
+		OverrideCommand: req.GetCommand() != "" || len(req.GetArgs()) > 0,
+		OverrideCwd:     req.GetCwd() != "",
+		OverrideEnv:     len(req.GetEnv()) > 0,
+		OverrideTerm:    req.GetTerm() != "",
+	}
+	for _, name := range []string{OverrideCommand, OverrideCwd, OverrideEnv, OverrideTerm} {
+		if requested[name] && !c.allows(name) {
+			return fmt.Errorf("overriding %s is not allowed by this agent", name)
+		}
+	}
+	return nil
+}
+
+// command builds the process for a new terminal. Without an explicit command
+// it starts $SHELL, falling back to the configured default shell.
+func (c Config) command(ctx context.Context, req *pb.CreateTerminalRequest) (*exec.Cmd, error) {
+	if err := c.checkOverrides(req); err != nil {
+		return nil, err
+	}
+
+	name := req.GetCommand()
+	if name == "" {
+		name = os.Getenv("SHELL")
+	}
+	if name == "" {
+		name = c.DefaultShell
+	}
+	cmd := exec.CommandContext(ctx, name, req.GetArgs()...)
+	cmd.Dir = req.GetCwd()
+
+	env := os.Environ()
+	term := req.GetTerm()
+	if term == "" && os.Getenv("TERM") == "" {
+		term = defaultTerm
+	}
+	if term != "" {
+		env = setEnv(env, "TERM", term)
+	}
+	for key, value := range req.GetEnv() {
+		env = setEnv(env, key, value)
+	}
+	cmd.Env = env
+	return cmd, nil
+}
+
+// jobCommand builds the process for Job. It runs where the agent was
+// started, with the agent's environment.
+func (c Config) jobCommand(ctx context.Context) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, c.Job[0], c.Job[1:]...)
+	cmd.Env = os.Environ()
+	if os.Getenv("TERM") == "" {
+		cmd.Env = setEnv(cmd.Env, "TERM", defaultTerm)
+	}
+	return cmd
+}
+
+func setEnv(env []string, key, value string) []string {
+	prefix := key + "="
+	for i, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			env[i] = prefix + value
+			return env
+		}
+	}
+	return append(env, prefix+value)
+}
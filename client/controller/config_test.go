@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+)
+
+// TestCheckOverrides checks that remote collaborators can only set the
+// options the agent allows.
+func TestCheckOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		req     *pb.CreateTerminalRequest
+		wantErr bool
+	}{
+		{"nothing requested", nil, &pb.CreateTerminalRequest{}, false},
+		{"default allows cwd", DefaultConfig().AllowedOverrides, &pb.CreateTerminalRequest{Cwd: "/tmp"}, false},
+		{"default allows term", DefaultConfig().AllowedOverrides, &pb.CreateTerminalRequest{Term: "vt100"}, false},
+		{"default denies command", DefaultConfig().AllowedOverrides, &pb.CreateTerminalRequest{Command: "/bin/rm"}, true},
+		{"default denies args alone", DefaultConfig().AllowedOverrides, &pb.CreateTerminalRequest{Args: []string{"-c", "id"}}, true},
+		{"default denies env", DefaultConfig().AllowedOverrides, &pb.CreateTerminalRequest{Env: map[string]string{"LD_PRELOAD": "x.so"}}, true},
+		{"none allowed denies cwd", nil, &pb.CreateTerminalRequest{Cwd: "/tmp"}, true},
+		{"command allowed", []string{OverrideCommand}, &pb.CreateTerminalRequest{Command: "top", Args: []string{"-b"}}, false},
+		{"env allowed", []string{OverrideEnv}, &pb.CreateTerminalRequest{Env: map[string]string{"FOO": "bar"}}, false},
+		{"names are trimmed and case-insensitive", []string{" Command ", "ENV"}, &pb.CreateTerminalRequest{Command: "top", Env: map[string]string{"FOO": "bar"}}, false},
+		{"one denied of several", []string{OverrideCwd}, &pb.CreateTerminalRequest{Cwd: "/tmp", Env: map[string]string{"FOO": "bar"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{AllowedOverrides: tt.allowed}
+			err := cfg.checkOverrides(tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkOverrides() = %v, want error %v", err, tt.wantErr)
+			}
+			// command must refuse exactly what checkOverrides refuses.
+			if _, err := cfg.command(context.Background(), tt.req); (err != nil) != tt.wantErr {
+				t.Fatalf("command() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCommandShellFallback checks which program a terminal starts without a
+// command, and with one.
+func TestCommandShellFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		shell   *string // nil unsets $SHELL
+		command string
+		want    string
+	}{
+		{"shell from environment", ptr("/bin/bash"), "", "/bin/bash"},
+		{"empty shell falls back", ptr(""), "", "/bin/sh"},
+		{"unset shell falls back", nil, "", "/bin/sh"},
+		{"command wins over shell", ptr("/bin/bash"), "/bin/cat", "/bin/cat"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SHELL", "")
+			if tt.shell == nil {
+				os.Unsetenv("SHELL")
+			} else {
+				os.Setenv("SHELL", *tt.shell)
+			}
+			cfg := Config{DefaultShell: "/bin/sh", AllowedOverrides: []string{OverrideCommand}}
+			cmd, err := cfg.command(context.Background(), &pb.CreateTerminalRequest{Command: tt.command})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd.Args[0] != tt.want {
+				t.Fatalf("started %q, want %q", cmd.Args[0], tt.want)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string { return &s }
@@ -0,0 +1,254 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The control socket lets local commands such as `shellsync status` and
+// `shellsync stop` talk to a running agent. Each connection carries one
+// request and one response, both a line of JSON.
+const (
+	controlStatus = "status"
+	controlStop   = "stop"
+
+	controlTimeout = 5 * time.Second
+	// shutdownGrace is how long a stopping agent waits for its terminals to
+	// exit and for their exits to reach the backend.
+	shutdownGrace = 5 * time.Second
+)
+
+type controlRequest struct {
+	Command string `json:"command"`
+}
+
+type controlResponse struct {
+	Status *Status `json:"status,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Status describes a running agent.
+type Status struct {
+	PID       int              `json:"pid"`
+	Backend   string           `json:"backend"`
+	SessionID string           `json:"sessionId"`
+	URL       string           `json:"url"`
+	EditorURL string           `json:"editorUrl"`
+	ViewerURL string           `json:"viewerUrl"`
+	StartedAt time.Time        `json:"startedAt"`
+	Connected bool             `json:"connected"`
+	Terminals []TerminalStatus `json:"terminals"`
+	// Guests are the browser clients in the session, as last reported by
+	// the backend.
+	Guests []string `json:"guests"`
+	// Output counts the output of all terminals so far.
+	Output OutputStats `json:"output"`
+}
+
+type TerminalStatus struct {
+	ID      string `json:"id"`
+	Command string `json:"command"`
+	PID     int    `json:"pid"`
+	// Tmux is the tmux session or shared pane behind the terminal, if any.
+	Tmux string `json:"tmux,omitempty"`
+}
+
+// ErrNotRunning is returned when no agent answers on the control socket.
+var ErrNotRunning = errors.New("no agent is running")
+
+// ListenControl opens the control socket at path. A socket left behind by an
+// agent that died is replaced; one that still answers is not.
+func ListenControl(path string) (net.Listener, error) {
+	if _, err := QueryStatus(path); err == nil {
+		return nil, fmt.Errorf("an agent is already running on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	return ln, nil
+}
+
+// QueryStatus asks the agent listening on path for its status.
+func QueryStatus(path string) (*Status, error) {
+	resp, err := control(path, controlStatus, controlTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Status, nil
+}
+
+// RequestStop asks the agent listening on path to close its terminals and
+// exit, and waits until it has.
+func RequestStop(path string) error {
+	_, err := control(path, controlStop, controlTimeout+shutdownGrace)
+	return err
+}
+
+func control(path, command string, timeout time.Duration) (*controlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w (%v)", ErrNotRunning, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(controlRequest{Command: command}); err != nil {
+		return nil, err
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("no answer on control socket: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// serveControl answers control requests until ln is closed. wg tracks the
+// connections being served, so a stop request gets its answer out before
+// the process exits.
+func (a *Agent) serveControl(ln net.Listener, wg *sync.WaitGroup) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Agent: Control socket failed: %v", err)
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			a.handleControl(conn)
+		}()
+	}
+}
+
+func (a *Agent) handleControl(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	var req controlRequest
+	var resp controlResponse
+	if err := json.Unmarshal(line, &req); err != nil {
+		resp.Error = "malformed control request"
+	} else {
+		switch req.Command {
+		case controlStatus:
+			resp.Status = a.status()
+		case controlStop:
+			log.Println("Agent: Stop requested on control socket.")
+			a.Stop()
+			<-a.stop
+		default:
+			resp.Error = fmt.Sprintf("unknown control command %q", req.Command)
+		}
+	}
+	conn.SetWriteDeadline(time.Now().Add(controlTimeout))
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// status reports what the agent is serving.
+func (a *Agent) status() *Status {
+	a.linkMu.Lock()
+	connected := a.stream != nil
+	a.linkMu.Unlock()
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	status := &Status{
+		PID:       os.Getpid(),
+		Backend:   a.info.Backend,
+		SessionID: a.info.SessionID,
+		URL:       a.info.URL,
+		EditorURL: a.info.EditorURL,
+		ViewerURL: a.info.ViewerURL,
+		StartedAt: a.info.StartedAt,
+		Connected: connected,
+		Terminals: make([]TerminalStatus, 0, len(a.terminalMap)),
+		Guests:    append([]string{}, a.guests...),
+		Output:    a.OutputStats(),
+	}
+	for backendID, localID := range a.terminalMap {
+		terminal := TerminalStatus{ID: backendID}
+		if t := a.tmux[backendID]; t != nil {
+			terminal.Tmux = t.session
+			if !t.owned() {
+				terminal.Tmux = t.target
+			}
+		}
+		if cmd := a.procs[localID]; cmd != nil {
+			terminal.Command = strings.Join(cmd.Args, " ")
+			if cmd.Process != nil {
+				terminal.PID = cmd.Process.Pid
+			}
+		}
+		status.Terminals = append(status.Terminals, terminal)
+	}
+	sort.Slice(status.Terminals, func(i, j int) bool {
+		return status.Terminals[i].ID < status.Terminals[j].ID
+	})
+	return status
+}
+
+// Stop asks the agent to shut down. It is safe to call more than once.
+func (a *Agent) Stop() {
+	a.quitOnce.Do(func() { close(a.quit) })
+}
+
+// shutdown hangs up every terminal and waits, up to grace, for their exits
+// to be reported, so the session's viewers see the terminals end rather than
+// the agent vanish. Terminals backed by tmux live on in their sessions.
+func (a *Agent) shutdown(grace time.Duration) {
+	for _, backendID := range a.terminalIDs() {
+		if err := a.hangup(backendID); err != nil {
+			log.Printf("Agent: Failed to close terminal %s: %v", backendID, err)
+		}
+	}
+	deadline := time.Now().Add(grace)
+	for len(a.terminalIDs()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// closeStream half-closes the stream to the backend and waits, up to
+// timeout, for the backend to end it. Messages already sent, such as the
+// exits reported by shutdown, are then handled before the agent goes away
+// rather than cut off by the stream being cancelled. The stream is detached
+// first, since sending on it after CloseSend would break it.
+func (a *Agent) closeStream(timeout time.Duration) {
+	a.linkMu.Lock()
+	stream := a.stream
+	a.linkMu.Unlock()
+	if stream == nil {
+		return
+	}
+	a.detach(stream)
+	a.sendMu.Lock()
+	err := stream.CloseSend()
+	a.sendMu.Unlock()
+	if err != nil {
+		return
+	}
+	select {
+	case <-stream.Context().Done():
+	case <-time.After(timeout):
+	}
+}
@@ -2,43 +2,156 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	pb "github.com/Ayush-Vish/shellsync/api/proto"
 	"github.com/creack/pty"
 	"github.com/google/uuid"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 type Agent struct {
 	ptys        map[string]*os.File
+	procs       map[string]*exec.Cmd
 	terminalMap map[string]string   
+	flows       map[string]*termFlow     // keyed by backend ID
+	tmux        map[string]*tmuxTerminal // keyed by backend ID
 	mu          sync.RWMutex
+	cfg         Config
+
+	// The stream to the backend, replaced on every reconnect. ready is
+	// closed while a stream is attached; stop is closed when run returns.
+	linkMu sync.Mutex
+	stream pb.ShellSync_StreamClient
+	ready  chan struct{}
+	stop   chan struct{}
+	sendMu sync.Mutex
+	// attached is set after the first stream to the session came up, so
+	// later streams resume it rather than start it.
+	attached bool
+
+	// Output counters across all terminals, see OutputStats.
+	reads    atomic.Uint64
+	messages atomic.Uint64
+	bytes    atomic.Uint64
+	// lastActivity is when a terminal last had input or output, in Unix
+	// nanoseconds.
+	lastActivity atomic.Int64
+
+	// info and guests are reported by status, under mu.
+	info   sessionInfo
+	guests []string
+	// secret proves to the backend that streams for the session come from
+	// the agent that created it.
+	secret string
+	// quit is closed by Stop.
+	quit     chan struct{}
+	quitOnce sync.Once
+	// local is the host's own TTY in attached mode, nil otherwise.
+	local *localTTY
+	// job is the backend ID of the terminal running Config.Job. jobErr is
+	// how the job ended once jobDone is set, under mu.
+	job     string
+	jobErr  error
+	jobDone bool
+}
+
+// sessionInfo is what the agent knows about the session it serves.
+type sessionInfo struct {
+	Backend   string
+	SessionID string
+	// URL is the owner's link, EditorURL and ViewerURL are the ones to
+	// share.
+	URL       string
+	EditorURL string
+	ViewerURL string
+	StartedAt time.Time
+}
+
+// PrintURLs shows the links to a session: the host's own, which makes its
+// holder the owner, and the ones to hand out to editors and viewers.
+func PrintURLs(owner, editor, viewer string) {
+	fmt.Printf("\nOpen this URL yourself:\n  ► %s ◄\n\n", owner)
+	if editor != "" {
+		fmt.Printf("Share this URL with people who may type:\n  %s\n\n", editor)
+	}
+	if viewer != "" {
+		fmt.Printf("Share this URL with people who may only watch:\n  %s\n\n", viewer)
+	}
+}
+
+// OutputStats counts PTY reads against the TerminalOutput messages actually
+// sent; the difference is what output coalescing saved.
+type OutputStats struct {
+	Reads    uint64 `json:"reads"`
+	Messages uint64 `json:"messages"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+func (s OutputStats) Saved() uint64 {
+	if s.Messages > s.Reads {
+		return 0
+	}
+	return s.Reads - s.Messages
+}
+
+func (a *Agent) OutputStats() OutputStats {
+	return OutputStats{
+		Reads:    a.reads.Load(),
+		Messages: a.messages.Load(),
+		Bytes:    a.bytes.Load(),
+	}
 }
 
-func NewAgent() *Agent {
-	return &Agent{
+func NewAgent(cfg Config) *Agent {
+	a := &Agent{
+		cfg:         cfg,
 		ptys:        make(map[string]*os.File),
+		procs:       make(map[string]*exec.Cmd),
 		terminalMap: make(map[string]string),
+		flows:       make(map[string]*termFlow),
+		tmux:        make(map[string]*tmuxTerminal),
+		ready:       make(chan struct{}),
+		stop:        make(chan struct{}),
+		quit:        make(chan struct{}),
 	}
+	a.touch()
+	return a
 }
 
-func (a *Agent) spawnNewPty(ctx context.Context, stream pb.ShellSync_StreamClient, backendID string) error {
+// spawnNewPty starts a terminal for the backend. ctx bounds the life of the
+// shell, so it must outlive any single stream.
+func (a *Agent) spawnNewPty(ctx context.Context, req *pb.CreateTerminalRequest) error {
+	backendID := req.GetTerminalId()
 	localID := "term-" + uuid.New().String()[:8]
-	cmd := exec.CommandContext(ctx, "/bin/bash")
 
-	ptmx, err := pty.Start(cmd)
+	cmd, err := a.command(ctx, req)
+	release := func() {}
+	if _, tmux := a.tmuxTerminal(backendID); err == nil && !tmux {
+		release, err = prepareShell(a.cfg.Limits, backendID, cmd)
+	}
+	var ptmx *os.File
+	if err == nil {
+		if ptmx, err = pty.Start(cmd); err != nil {
+			release()
+		}
+	}
 	if err != nil {
 		log.Printf("Agent: Failed to start PTY for terminal %s: %v", backendID, err)
+		a.dropTmux(backendID)
 		errorMsg := &pb.ClientUpdate{
 			Payload: &pb.ClientUpdate_TerminalError{
 				TerminalError: &pb.TerminalError{
@@ -47,42 +160,214 @@ func (a *Agent) spawnNewPty(ctx context.Context, stream pb.ShellSync_StreamClien
 				},
 			},
 		}
-		if sendErr := stream.Send(errorMsg); sendErr != nil {
-			log.Printf("Agent: Failed to send terminal error for %s: %v", backendID, sendErr)
-		}
+		a.reply(errorMsg)
 		return err
 	}
 	log.Printf("Agent: New PTY started with ID: %s (maps to backend ID: %s)", localID, backendID)
 
+	flow := newTermFlow(ctx, a.cfg)
 	a.mu.Lock()
 	a.ptys[localID] = ptmx
+	a.procs[localID] = cmd
 	a.terminalMap[backendID] = localID
+	a.flows[backendID] = flow
 	a.mu.Unlock()
+	go a.writeInput(backendID, ptmx, flow.input)
 
 	go func() {
 		defer func() {
+			flow.hangup()
+			flow.input.close()
 			a.mu.Lock()
 			ptmx.Close()
 			delete(a.ptys, localID)
-			delete(a.terminalMap, backendID)
+			delete(a.procs, localID)
 			a.mu.Unlock()
 			log.Printf("Agent: Cleaned up PTY for terminal %s (backend ID %s)", localID, backendID)
+
+			waitErr := cmd.Wait()
+			release()
+			exitCode, signal := exitStatus(waitErr)
+			log.Printf("Agent: Shell for terminal %s exited (code %d, signal %q)", backendID, exitCode, signal)
+			exitMsg := &pb.ClientUpdate{
+				Payload: &pb.ClientUpdate_TerminalExited{
+					TerminalExited: &pb.TerminalExited{
+						TerminalId: backendID,
+						ExitCode:   exitCode,
+						Signal:     signal,
+					},
+				},
+			}
+			if sendErr := a.send(exitMsg); sendErr != nil {
+				log.Printf("Agent: Failed to send exit status for %s: %v", backendID, sendErr)
+			}
+
+			// Keep the terminal listed until its exit has been reported, so
+			// a reconnect in between does not make the backend think it
+			// vanished.
+			a.mu.Lock()
+			delete(a.terminalMap, backendID)
+			delete(a.flows, backendID)
+			delete(a.tmux, backendID)
+			a.mu.Unlock()
+
+			// The host leaving its shell ends the sharing, as closing the
+			// window of a shared terminal would.
+			if a.local.shows(backendID) {
+				a.local.restore()
+				fmt.Println("Shell exited, no longer sharing.")
+				a.Stop()
+			}
+			if backendID == a.job {
+				a.endJob(waitErr)
+			}
 		}()
 
-		buffer := make([]byte, 1024*1024)
+		a.pumpOutput(backendID, ptmx, flow)
+	}()
+
+	creationResp := &pb.ClientUpdate{
+		Payload: &pb.ClientUpdate_TerminalCreatedResponse{
+			TerminalCreatedResponse: &pb.TerminalCreatedResponse{
+				TerminalId: backendID,
+				ReadOnly:   backendID == a.job,
+			},
+		},
+	}
+	a.reply(creationResp)
+	return nil
+}
+
+// framerTimeout is how long output ending in an incomplete UTF-8 or escape
+// sequence is held back waiting for the rest before it is sent anyway.
+const framerTimeout = 10 * time.Millisecond
+
+// pumpOutput forwards PTY output to the backend until the PTY is closed or
+// the agent stops. Messages are cut only on UTF-8 and escape boundaries, and
+// reads arriving within CoalesceDelay of each other are merged into one
+// message of at most about CoalesceMaxBytes, so a command printing thousands
+// of short lines does not turn into thousands of messages. While the
+// terminal is out of output credit the PTY is not read at all.
+func (a *Agent) pumpOutput(backendID string, ptmx *os.File, flow *termFlow) {
+	done := make(chan struct{})
+	defer close(done)
+	chunks := readChunks(ptmx, backendID, done)
+	mirror := a.local.mirror(backendID)
+	if backendID == a.job {
+		// The job's output also shows where it was started, as if it had
+		// run there.
+		mirror = os.Stdout
+	}
+
+	var stats OutputStats
+	defer func() {
+		log.Printf("Agent: Terminal %s output: %d reads, %d messages, %d bytes (%d messages saved)",
+			backendID, stats.Reads, stats.Messages, stats.Bytes, stats.Saved())
+	}()
+
+	send := func(data []byte) bool {
+		if len(data) == 0 {
+			return true
+		}
+		if !flow.output.acquire(len(data), flow.ctx.Done()) {
+			return false
+		}
+		outputMsg := &pb.ClientUpdate{
+			Payload: &pb.ClientUpdate_PtyOutput{
+				PtyOutput: &pb.TerminalOutput{
+					TerminalId: backendID,
+					Data:       data,
+				},
+			},
+		}
+		if sendErr := a.send(outputMsg); sendErr != nil {
+			log.Printf("Agent: Failed to send PTY output for %s: %v", backendID, sendErr)
+			return false
+		}
+		stats.Messages++
+		stats.Bytes += uint64(len(data))
+		a.messages.Add(1)
+		a.bytes.Add(uint64(len(data)))
+		return true
+	}
+
+	var fr framer
+	flush := time.NewTimer(framerTimeout)
+	flush.Stop()
+	defer flush.Stop()
+
+	var batch []byte
+	linger := time.NewTimer(a.cfg.CoalesceDelay)
+	linger.Stop()
+	defer linger.Stop()
+	sendBatch := func() bool {
+		linger.Stop()
+		ok := send(batch)
+		batch = nil
+		return ok
+	}
+
+	for {
+		select {
+		case data, ok := <-chunks:
+			if !ok {
+				batch = append(batch, fr.Flush()...)
+				sendBatch()
+				return
+			}
+			stats.Reads++
+			a.reads.Add(1)
+			a.touch()
+			if mirror != nil {
+				mirror.Write(data)
+			}
+
+			out := fr.Push(data)
+			if fr.Pending() {
+				flush.Reset(framerTimeout)
+			}
+			if a.cfg.CoalesceDelay <= 0 {
+				if !send(out) {
+					return
+				}
+				continue
+			}
+			if len(batch) == 0 && len(out) > 0 {
+				linger.Reset(a.cfg.CoalesceDelay)
+			}
+			batch = append(batch, out...)
+			if len(batch) >= a.cfg.CoalesceMaxBytes && !sendBatch() {
+				return
+			}
+		case <-linger.C:
+			if !sendBatch() {
+				return
+			}
+		case <-flush.C:
+			if fr.Pending() {
+				batch = append(batch, fr.Flush()...)
+				if !sendBatch() {
+					return
+				}
+			}
+		}
+	}
+}
+
+// readChunks reads from the PTY on its own goroutine so the caller can wait
+// for output and timers at the same time. The channel is closed on EOF or
+// error.
+func readChunks(r io.Reader, backendID string, done <-chan struct{}) <-chan []byte {
+	chunks := make(chan []byte)
+	go func() {
+		defer close(chunks)
+		buffer := make([]byte, 32*1024)
 		for {
-			n, err := ptmx.Read(buffer)
+			n, err := r.Read(buffer)
 			if n > 0 {
-				outputMsg := &pb.ClientUpdate{
-					Payload: &pb.ClientUpdate_PtyOutput{
-						PtyOutput: &pb.TerminalOutput{
-							TerminalId: backendID,
-							Data:       buffer[:n],
-						},
-					},
-				}
-				if sendErr := stream.Send(outputMsg); sendErr != nil {
-					log.Printf("Agent: Failed to send PTY output for %s: %v", backendID, sendErr)
+				select {
+				case chunks <- append([]byte(nil), buffer[:n]...):
+				case <-done:
 					return
 				}
 			}
@@ -94,46 +379,212 @@ func (a *Agent) spawnNewPty(ctx context.Context, stream pb.ShellSync_StreamClien
 			}
 		}
 	}()
+	return chunks
+}
 
-	creationResp := &pb.ClientUpdate{
-		Payload: &pb.ClientUpdate_TerminalCreatedResponse{
-			TerminalCreatedResponse: &pb.TerminalCreatedResponse{TerminalId: backendID},
-		},
+// closeTerminal closes a terminal for good. A tmux session the agent owns is
+// ended with it; a shared tmux pane is only let go of.
+func (a *Agent) closeTerminal(backendID string) error {
+	if backendID == a.job {
+		return errReadOnly
 	}
-	return stream.Send(creationResp)
+	if t, ok := a.tmuxTerminal(backendID); ok && t.owned() {
+		if err := t.kill(); err != nil {
+			log.Printf("Agent: Failed to end tmux session of terminal %s: %v", backendID, err)
+		} else {
+			// The client exits with its session, possibly before it is hung
+			// up, so the terminal may already be gone.
+			a.hangup(backendID)
+			return nil
+		}
+	}
+	return a.hangup(backendID)
 }
 
-func startStream(client pb.ShellSyncClient, sessionID string) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// hangup hangs up a terminal the way closing a terminal window does: the
+// shell gets SIGHUP and the PTY master is closed. The PTY goroutine then
+// reports the exit status to the backend. For a terminal backed by tmux
+// this only detaches the client.
+func (a *Agent) hangup(backendID string) error {
+	a.mu.RLock()
+	localID, found := a.terminalMap[backendID]
+	ptmx, ok := a.ptys[localID]
+	cmd := a.procs[localID]
+	a.mu.RUnlock()
+
+	if !found || !ok {
+		return fmt.Errorf("unknown terminal ID: %s", backendID)
+	}
+	// Output still waiting for credit is of no interest anymore.
+	if flow, ok := a.flow(backendID); ok {
+		flow.hangup()
+	}
+	if cmd != nil && cmd.Process != nil {
+		if err := cmd.Process.Signal(syscall.SIGHUP); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			log.Printf("Agent: Failed to send SIGHUP to terminal %s: %v", backendID, err)
+		}
+	}
+	return ptmx.Close()
+}
 
-	stream, err := client.Stream(ctx)
+// signalTerminal delivers the named signal to the foreground job of a
+// terminal. Names are accepted with or without the SIG prefix, or as numbers.
+func (a *Agent) signalTerminal(backendID, name string) error {
+	if backendID == a.job {
+		return errReadOnly
+	}
+	sig, err := parseSignal(name)
 	if err != nil {
 		return err
 	}
-	log.Println("Stream started")
 
-	initialMsg := &pb.ClientUpdate{
-		Payload: &pb.ClientUpdate_InitialMessage{
-			InitialMessage: &pb.InitialAgentMessage{SessionId: sessionID},
-		},
+	a.mu.RLock()
+	localID, found := a.terminalMap[backendID]
+	ptmx, ok := a.ptys[localID]
+	cmd := a.procs[localID]
+	a.mu.RUnlock()
+
+	if !found || !ok {
+		return fmt.Errorf("unknown terminal ID: %s", backendID)
 	}
-	if err := stream.Send(initialMsg); err != nil {
-		return fmt.Errorf("agent: failed to send initial session ID message: %w", err)
+	if t, ok := a.tmuxTerminal(backendID); ok {
+		pgid, err := t.foregroundGroup()
+		if err == nil {
+			err = signalGroup(pgid, sig)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to send %s: %w", name, err)
+		}
+		return nil
+	}
+	if err := signalForeground(ptmx, cmd, sig); err != nil {
+		return fmt.Errorf("failed to send %s: %w", name, err)
 	}
+	return nil
+}
 
-	agent := NewAgent()
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+	if sig, ok := signals[name]; ok {
+		return sig, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		for _, sig := range signals {
+			if int(sig) == n {
+				return sig, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unsupported signal %q", name)
+}
 
+// exitStatus converts the result of cmd.Wait into the exit code and signal
+// name reported in TerminalExited.
+func exitStatus(err error) (int32, string) {
+	if err == nil {
+		return 0, ""
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return -1, ""
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return -1, status.Signal().String()
+	}
+	return int32(exitErr.ExitCode()), ""
+}
 
+// startTerminals opens the terminals a new session starts with: the job if
+// there is one, the tmux sessions an earlier agent left behind, if terminals
+// are backed by tmux, or else the default terminal.
+func (a *Agent) startTerminals(ctx context.Context) error {
+	if a.job != "" {
+		if err := a.spawnNewPty(ctx, &pb.CreateTerminalRequest{TerminalId: a.job}); err != nil {
+			a.endJob(err)
+			return fmt.Errorf("agent: failed to start %s: %w", a.cfg.Job[0], err)
+		}
+		return nil
+	}
+	if a.cfg.TmuxBacked && a.adoptTmuxSessions(ctx) > 0 {
+		return nil
+	}
 	defaultBackendID := "term-" + uuid.New().String()[:8]
-	if err := agent.spawnNewPty(ctx, stream, defaultBackendID); err != nil {
+	if a.cfg.TmuxShare != "" {
+		shared, err := sharedTmuxTerminal(a.cfg.TmuxShare)
+		if err != nil {
+			return fmt.Errorf("agent: failed to share tmux pane: %w", err)
+		}
+		a.mu.Lock()
+		a.tmux[defaultBackendID] = shared
+		a.mu.Unlock()
+	}
+	if a.local != nil {
+		a.local.backendID = defaultBackendID
+	}
+	if err := a.spawnNewPty(ctx, &pb.CreateTerminalRequest{TerminalId: defaultBackendID}); err != nil {
 		return fmt.Errorf("agent: failed to spawn initial terminal: %w", err)
 	}
+	if a.local != nil {
+		if err := a.attachLocal(defaultBackendID); err != nil {
+			log.Printf("Agent: Failed to attach the local terminal: %v", err)
+		}
+	}
+	return nil
+}
+
+// startStream attaches the agent to its session over a new stream and serves
+// it until the stream breaks. The first stream also starts the default
+// terminal; later ones tell the backend which terminals are still open so it
+// can resume the session.
+func (a *Agent) startStream(ctx context.Context, client pb.ShellSyncClient, sessionID string) error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.Stream(streamCtx)
+	if err != nil {
+		return err
+	}
+
+	resume := a.attached
+	initialMsg := &pb.ClientUpdate{
+		Payload: &pb.ClientUpdate_InitialMessage{
+			InitialMessage: &pb.InitialAgentMessage{
+				SessionId:    sessionID,
+				Resume:       resume,
+				TerminalIds:  a.terminalIDs(),
+				OutputWindow: uint32(max(a.cfg.OutputWindow, 0)),
+				InputWindow:  uint32(max(a.cfg.InputWindow, 0)),
+				AgentSecret:  a.secret,
+			},
+		},
+	}
+	a.sendMu.Lock()
+	err = stream.Send(initialMsg)
+	a.sendMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("agent: failed to send initial session ID message: %w", err)
+	}
+	a.resetOutputCredit()
+	a.attach(stream)
+	defer a.detach(stream)
+	a.attached = true
+	if resume {
+		log.Println("Stream resumed")
+	} else {
+		log.Println("Stream started")
+		if err := a.startTerminals(ctx); err != nil {
+			return err
+		}
+	}
+
+	var hb heartbeat
+	hb.heard()
+	go hb.watch(streamCtx, cancel)
 
 	for {
 		msgFromServer, err := stream.Recv()
 		if err != nil {
-			if ctx.Err() != nil {
+			if streamCtx.Err() != nil {
 				log.Println("Agent: Context cancelled, stopping.")
 			} else if err == io.EOF {
 				log.Println("Agent: Server closed the stream.")
@@ -142,44 +593,170 @@ func startStream(client pb.ShellSyncClient, sessionID string) error {
 			}
 			return err
 		}
+		hb.heard()
 
 		switch payload := msgFromServer.Payload.(type) {
+		case *pb.ServerUpdate_Ping:
+			hb.setTimeout(time.Duration(payload.Ping.GetTimeoutMs()) * time.Millisecond)
+			a.reply(&pb.ClientUpdate{
+				Payload: &pb.ClientUpdate_Pong{Pong: payload.Ping},
+			})
+
 		case *pb.ServerUpdate_PtyInput:
 			input := payload.PtyInput
-			agent.mu.RLock()
-			localID, found := agent.terminalMap[input.GetTerminalId()]
-			ptmx, ok := agent.ptys[localID]
-			agent.mu.RUnlock()
+			if flow, ok := a.flow(input.GetTerminalId()); ok {
+				flow.input.push(input.GetData())
+			} else {
+				log.Printf("Agent: Received input for unknown terminal ID: %s", input.GetTerminalId())
+			}
+
+		case *pb.ServerUpdate_OutputCredit:
+			credit := payload.OutputCredit
+			if flow, ok := a.flow(credit.GetTerminalId()); ok {
+				flow.output.grant(int(credit.GetBytes()))
+			}
+
+		case *pb.ServerUpdate_Resize:
+			resize := payload.Resize
+			a.mu.RLock()
+			localID, found := a.terminalMap[resize.GetTerminalId()]
+			ptmx, ok := a.ptys[localID]
+			a.mu.RUnlock()
 
 			if found && ok {
-				if _, writeErr := ptmx.Write(input.GetData()); writeErr != nil {
-					log.Printf("Agent: Failed to write to PTY %s (backend ID %s): %v", localID, input.GetTerminalId(), writeErr)
+				size := &pty.Winsize{Rows: uint16(resize.GetRows()), Cols: uint16(resize.GetCols())}
+				if err := pty.Setsize(ptmx, size); err != nil {
+					log.Printf("Agent: Failed to resize PTY %s (backend ID %s): %v", localID, resize.GetTerminalId(), err)
 				}
 			} else {
-				log.Printf("Agent: Received input for unknown terminal ID: %s", input.GetTerminalId())
+				log.Printf("Agent: Received resize for unknown terminal ID: %s", resize.GetTerminalId())
+			}
+
+		case *pb.ServerUpdate_CloseTerminalRequest:
+			backendID := payload.CloseTerminalRequest.GetTerminalId()
+			log.Printf("Agent: Received request to close terminal with backend ID: %s", backendID)
+			if err := a.closeTerminal(backendID); err != nil {
+				log.Printf("Agent: Failed to close terminal: %v", err)
+				errorMsg := &pb.ClientUpdate{
+					Payload: &pb.ClientUpdate_TerminalError{
+						TerminalError: &pb.TerminalError{
+							TerminalId: backendID,
+							Error:      err.Error(),
+						},
+					},
+				}
+				a.reply(errorMsg)
+			}
+
+		case *pb.ServerUpdate_Signal:
+			backendID := payload.Signal.GetTerminalId()
+			log.Printf("Agent: Received %s for terminal with backend ID: %s", payload.Signal.GetSignal(), backendID)
+			if err := a.signalTerminal(backendID, payload.Signal.GetSignal()); err != nil {
+				log.Printf("Agent: Failed to signal terminal: %v", err)
+				errorMsg := &pb.ClientUpdate{
+					Payload: &pb.ClientUpdate_TerminalError{
+						TerminalError: &pb.TerminalError{
+							TerminalId: backendID,
+							Error:      err.Error(),
+						},
+					},
+				}
+				a.reply(errorMsg)
 			}
 
 		case *pb.ServerUpdate_CreateTerminalRequest:
-			backendID := payload.CreateTerminalRequest.GetTerminalId()
-			if backendID == "" {
-				backendID = "term-" + uuid.New().String()[:8]
+			req := payload.CreateTerminalRequest
+			if a.job != "" {
+				a.reply(&pb.ClientUpdate{
+					Payload: &pb.ClientUpdate_TerminalError{
+						TerminalError: &pb.TerminalError{
+							TerminalId: req.GetTerminalId(),
+							Error:      "this agent only shares the output of " + a.cfg.Job[0],
+						},
+					},
+				})
+				continue
+			}
+			if max := a.cfg.MaxTerminals; max > 0 && len(a.terminalIDs()) >= max {
+				a.reply(&pb.ClientUpdate{
+					Payload: &pb.ClientUpdate_TerminalError{
+						TerminalError: &pb.TerminalError{
+							TerminalId: req.GetTerminalId(),
+							Error:      fmt.Sprintf("this agent allows at most %d terminals", max),
+						},
+					},
+				})
+				continue
 			}
-			log.Printf("Agent: Received request to create terminal with backend ID: %s", backendID)
-			if err := agent.spawnNewPty(ctx, stream, backendID); err != nil {
+			if req.GetTerminalId() == "" {
+				req.TerminalId = "term-" + uuid.New().String()[:8]
+			}
+			log.Printf("Agent: Received request to create terminal with backend ID: %s", req.GetTerminalId())
+			if err := a.spawnNewPty(ctx, req); err != nil {
 				log.Printf("Agent: Failed to spawn new terminal: %v", err)
 			}
 
+		case *pb.ServerUpdate_Participants:
+			a.mu.Lock()
+			a.guests = payload.Participants.GetClientIds()
+			a.mu.Unlock()
+
 		case *pb.ServerUpdate_ServerHello:
 			log.Printf("Agent: Server says: %s", payload.ServerHello)
 		}
 	}
 }
 
-func Start(host string, port int) {
+// Start creates a session on the backend at host:port and serves it until
+// the backend forgets the session or the agent is stopped, by SIGINT,
+// SIGTERM, a stop request on the control socket or the idle timeout and
+// maximum lifetime policies. Stopping hangs up the terminals first, so
+// viewers see them exit. In attached mode the agent also stops when the
+// host exits the default terminal, and with a job once the job exits; Start
+// then returns how it ended, an *exec.ExitError if it failed.
+func Start(host string, port int, cfg Config) error {
+	agent := NewAgent(cfg)
+	if len(cfg.Job) > 0 {
+		agent.job = "term-" + uuid.New().String()[:8]
+	}
+	if cfg.TmuxShare != "" {
+		if _, err := sharedTmuxTerminal(cfg.TmuxShare); err != nil {
+			return err
+		}
+	}
+	if err := cfg.Limits.check(); err != nil {
+		return err
+	}
+	if cfg.TmuxBacked && cfg.Limits.enabled() {
+		log.Printf("Agent: Limits do not apply to the shells of tmux-backed terminals")
+	}
+	if cfg.Attach {
+		local, err := newLocalTTY()
+		if err != nil {
+			return err
+		}
+		agent.local = local
+		defer local.restore()
+	}
+	var controlConns sync.WaitGroup
+	if cfg.ControlSocket != "" {
+		ln, err := ListenControl(cfg.ControlSocket)
+		if err != nil {
+			return err
+		}
+		go agent.serveControl(ln, &controlConns)
+		defer controlConns.Wait()
+		defer ln.Close()
+	}
+
+	creds, err := cfg.TLS.credentials()
+	if err != nil {
+		return err
+	}
 	serverUrl := host + ":" + strconv.Itoa(port)
-	conn, err := grpc.NewClient(serverUrl, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(serverUrl, grpc.WithTransportCredentials(creds))
 	if err != nil {
-		log.Fatalf("Failed to connect to gRPC server: %v", err)
+		return fmt.Errorf("failed to connect to gRPC server: %w", err)
 	}
 	defer conn.Close()
 
@@ -198,12 +775,49 @@ func Start(host string, port int) {
 		Host: agentName,
 	})
 	if err != nil {
-		log.Fatalf("Session creation failed: %v", err)
+		return fmt.Errorf("session creation failed: %w", err)
 	}
 	log.Printf("Session %s created successfully.", resp.GetSessionId())
-	fmt.Printf("\nShare this URL:\n  ► %s ◄\n\n", resp.GetFrontendUrl())
+	PrintURLs(resp.GetFrontendUrl(), resp.GetEditorUrl(), resp.GetViewerUrl())
+
+	started := time.Now()
+	agent.mu.Lock()
+	agent.info = sessionInfo{
+		Backend:   serverUrl,
+		SessionID: resp.GetSessionId(),
+		URL:       resp.GetFrontendUrl(),
+		EditorURL: resp.GetEditorUrl(),
+		ViewerURL: resp.GetViewerUrl(),
+		StartedAt: started,
+	}
+	agent.secret = resp.GetAgentSecret()
+	agent.mu.Unlock()
+
+	// Terminals are bound to ctx, so it is only cancelled once they have
+	// been hung up properly.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+	go func() {
+		select {
+		case sig := <-interrupts:
+			log.Printf("Agent: Received %s, stopping.", sig)
+		case <-agent.quit:
+		case <-ctx.Done():
+			return
+		}
+		agent.shutdown(shutdownGrace)
+		agent.closeStream(shutdownGrace)
+		cancel()
+	}()
+	go agent.enforcePolicies(ctx, started)
 
-	if err := startStream(client, resp.GetSessionId()); err != nil {
-		log.Fatalf("Stream failed: %v", err)
+	err = agent.run(ctx, client, resp.GetSessionId())
+	if errors.Is(err, context.Canceled) {
+		log.Println("Agent: Stopped.")
+		return agent.jobResult()
 	}
+	return fmt.Errorf("stream failed: %w", err)
 }
@@ -1,34 +1,21 @@
 package controller
 
 import (
-	"github.com/Ayush-Vish/shellsync/api/proto"
+	"bytes"
+	"context"
+	"os"
+	"strings"
 	"testing"
-)
+	"time"
 
-func TestCreateSession(t *testing.T) {
-	type args struct {
-		client proto.ShellSyncClient
-	}
-	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
-	}{
-		// TODO: Add test cases.
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := CreateSession(tt.args.client); (err != nil) != tt.wantErr {
-				t.Errorf("CreateSession() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
-}
+	"github.com/Ayush-Vish/shellsync/api/proto"
+)
 
 func TestStart(t *testing.T) {
 	type args struct {
 		host string
 		port int
+		cfg  Config
 	}
 	tests := []struct {
 		name string
@@ -38,14 +25,16 @@ func TestStart(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			Start(tt.args.host, tt.args.port)
+			Start(tt.args.host, tt.args.port, tt.args.cfg)
 		})
 	}
 }
 
 func Test_startStream(t *testing.T) {
 	type args struct {
-		client proto.ShellSyncClient
+		client    proto.ShellSyncClient
+		sessionID string
+		cfg       Config
 	}
 	tests := []struct {
 		name    string
@@ -56,9 +45,108 @@ func Test_startStream(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := startStream(tt.args.client); (err != nil) != tt.wantErr {
+			agent := NewAgent(tt.args.cfg)
+			if err := agent.startStream(context.Background(), tt.args.client, tt.args.sessionID); (err != nil) != tt.wantErr {
 				t.Errorf("startStream() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+// pumpPipe runs pumpOutput on a pipe and returns its write end and the
+// messages the agent sends.
+func pumpPipe(t *testing.T, agent *Agent) (*os.File, chan *proto.ClientUpdate) {
+	t.Helper()
+	stream := &fakeBackendStream{sent: make(chan *proto.ClientUpdate, 1024)}
+	agent.attach(stream)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	flow := newTermFlow(context.Background(), agent.cfg)
+	t.Cleanup(flow.hangup)
+	go agent.pumpOutput("t", r, flow)
+	return w, stream.sent
+}
+
+// collect returns the output messages the agent sent, until want bytes have
+// arrived.
+func collect(t *testing.T, sent chan *proto.ClientUpdate, want int) [][]byte {
+	t.Helper()
+	var messages [][]byte
+	total := 0
+	for total < want {
+		select {
+		case msg := <-sent:
+			data := msg.GetPtyOutput().GetData()
+			messages = append(messages, data)
+			total += len(data)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d bytes", total, want)
+		}
+	}
+	return messages
+}
+
+// TestCoalesceMergesBursts checks that reads arriving within CoalesceDelay
+// go out as one message, and that the counters show what was saved.
+func TestCoalesceMergesBursts(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CoalesceDelay = 200 * time.Millisecond
+	cfg.OutputWindow = 0
+	agent := NewAgent(cfg)
+	w, sent := pumpPipe(t, agent)
+
+	var burst strings.Builder
+	for i := 0; i < 20; i++ {
+		line := strings.Repeat("x", i) + "\n"
+		burst.WriteString(line)
+		w.Write([]byte(line))
+		// Let the agent read each line on its own.
+		time.Sleep(time.Millisecond)
+	}
+	messages := collect(t, sent, burst.Len())
+	if len(messages) != 1 || string(messages[0]) != burst.String() {
+		t.Fatalf("burst sent as %d messages, want 1", len(messages))
+	}
+	w.Close()
+
+	stats := agent.OutputStats()
+	if stats.Messages != 1 || stats.Reads < 2 || stats.Saved() != stats.Reads-1 {
+		t.Fatalf("stats = %+v, want several reads in 1 message", stats)
+	}
+}
+
+// TestCoalesceSplitsAtMaxBytes checks that a merged message is sent once it
+// reaches CoalesceMaxBytes, however short the gaps between reads.
+func TestCoalesceSplitsAtMaxBytes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CoalesceDelay = time.Second
+	cfg.CoalesceMaxBytes = 1024
+	cfg.OutputWindow = 0
+	agent := NewAgent(cfg)
+	w, sent := pumpPipe(t, agent)
+
+	var written bytes.Buffer
+	piece := bytes.Repeat([]byte("y"), 100)
+	for written.Len() < 10*cfg.CoalesceMaxBytes {
+		written.Write(piece)
+		w.Write(piece)
+		time.Sleep(time.Millisecond)
+	}
+	w.Close()
+
+	messages := collect(t, sent, written.Len())
+	if len(messages) < 2 {
+		t.Fatalf("%d bytes sent as %d message", written.Len(), len(messages))
+	}
+	for i, msg := range messages[:len(messages)-1] {
+		if len(msg) < cfg.CoalesceMaxBytes || len(msg) >= 2*cfg.CoalesceMaxBytes {
+			t.Fatalf("message %d has %d bytes, want about %d", i, len(msg), cfg.CoalesceMaxBytes)
+		}
+	}
+	if !bytes.Equal(bytes.Join(messages, nil), written.Bytes()) {
+		t.Fatal("output arrived out of order or corrupted")
+	}
+}
@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+)
+
+// termFlow is the flow control state of one terminal. The agent may send
+// OutputWindow bytes of its output before the backend credits some back; when
+// out of credit it stops reading the PTY, so the program writing to it
+// blocks instead of output being lost. Input is written to the PTY by its
+// own goroutine and credited back to the backend once written.
+type termFlow struct {
+	output *credit
+	input  *inputQueue
+	// ctx ends when the terminal is hung up or the agent stops, releasing
+	// an output pump that is waiting for credit.
+	ctx    context.Context
+	hangup context.CancelFunc
+}
+
+func newTermFlow(ctx context.Context, cfg Config) *termFlow {
+	ctx, cancel := context.WithCancel(ctx)
+	return &termFlow{
+		output: newCredit(cfg.OutputWindow),
+		input:  newInputQueue(),
+		ctx:    ctx,
+		hangup: cancel,
+	}
+}
+
+// credit is a window of bytes that may be sent before more is granted. A
+// zero limit means no flow control.
+type credit struct {
+	mu    sync.Mutex
+	avail int
+	limit int
+	// grown is closed, and replaced, whenever avail grows.
+	grown chan struct{}
+}
+
+func newCredit(limit int) *credit {
+	return &credit{avail: limit, limit: limit, grown: make(chan struct{})}
+}
+
+// acquire takes n bytes of credit, waiting while none is left. A send may
+// overdraw the window rather than be split; the next one then waits. It
+// returns false if done is closed first.
+func (c *credit) acquire(n int, done <-chan struct{}) bool {
+	for {
+		c.mu.Lock()
+		if c.limit <= 0 || c.avail > 0 {
+			c.avail -= n
+			c.mu.Unlock()
+			return true
+		}
+		grown := c.grown
+		c.mu.Unlock()
+
+		select {
+		case <-grown:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// grant returns n bytes to the window, never beyond its limit.
+func (c *credit) grant(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.avail = min(c.avail+n, c.limit)
+	close(c.grown)
+	c.grown = make(chan struct{})
+}
+
+// reset refills the window. The backend's accounting starts over with every
+// stream, and output sent on the old one is not credited anymore.
+func (c *credit) reset() {
+	c.grant(c.limit)
+}
+
+// inputQueue holds input for one PTY until its writer gets to it. It is
+// bounded by the input window the backend keeps to.
+type inputQueue struct {
+	mu     sync.Mutex
+	buf    []byte
+	closed bool
+	wake   chan struct{}
+}
+
+func newInputQueue() *inputQueue {
+	return &inputQueue{wake: make(chan struct{}, 1)}
+}
+
+func (q *inputQueue) push(p []byte) {
+	q.mu.Lock()
+	q.buf = append(q.buf, p...)
+	q.mu.Unlock()
+	q.notify()
+}
+
+func (q *inputQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.notify()
+}
+
+func (q *inputQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for input and returns all of it. It returns false once the
+// queue is closed and empty.
+func (q *inputQueue) take() ([]byte, bool) {
+	for {
+		q.mu.Lock()
+		data, closed := q.buf, q.closed
+		q.buf = nil
+		q.mu.Unlock()
+		if len(data) > 0 {
+			return data, true
+		}
+		if closed {
+			return nil, false
+		}
+		<-q.wake
+	}
+}
+
+// writeInput feeds a PTY from its input queue. Writing from the stream's
+// receive loop instead would let a program that is not reading its input
+// stall the loop, and with it the output credit that program may be waiting
+// for.
+func (a *Agent) writeInput(backendID string, ptmx *os.File, q *inputQueue) {
+	for {
+		data, ok := q.take()
+		if !ok {
+			return
+		}
+		if backendID == a.job {
+			// Input that reached the backend before it learnt the job
+			// is read-only is dropped.
+		} else if _, err := ptmx.Write(data); err != nil {
+			log.Printf("Agent: Failed to write to PTY for terminal %s: %v", backendID, err)
+		} else {
+			a.touch()
+		}
+		// Credit the input even if it could not be written, or the
+		// backend's window for this terminal would shrink for good.
+		if a.cfg.InputWindow > 0 {
+			a.reply(&pb.ClientUpdate{
+				Payload: &pb.ClientUpdate_InputCredit{
+					InputCredit: &pb.FlowCredit{TerminalId: backendID, Bytes: uint32(len(data))},
+				},
+			})
+		}
+	}
+}
+
+// flow returns the flow control state of a terminal.
+func (a *Agent) flow(backendID string) (*termFlow, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	flow, ok := a.flows[backendID]
+	return flow, ok
+}
+
+// resetOutputCredit refills every terminal's output window for a new stream.
+func (a *Agent) resetOutputCredit() {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, flow := range a.flows {
+		flow.output.reset()
+	}
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+	"google.golang.org/grpc"
+)
+
+// fakeBackendStream records what the agent sends.
+type fakeBackendStream struct {
+	grpc.ClientStream
+	sent chan *pb.ClientUpdate
+}
+
+func (f *fakeBackendStream) Send(msg *pb.ClientUpdate) error {
+	f.sent <- msg
+	return nil
+}
+
+func (f *fakeBackendStream) Recv() (*pb.ServerUpdate, error) {
+	select {}
+}
+
+func TestCreditWaitsForGrant(t *testing.T) {
+	c := newCredit(10)
+	if !c.acquire(8, nil) || !c.acquire(8, nil) {
+		t.Fatal("acquire within the window blocked")
+	}
+
+	acquired := make(chan bool)
+	go func() { acquired <- c.acquire(1, nil) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquire succeeded with the window overdrawn")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	c.grant(6)
+	select {
+	case <-acquired:
+		t.Fatal("acquire succeeded before the overdraft was paid back")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.grant(100)
+	if !<-acquired {
+		t.Fatal("acquire failed after the grant")
+	}
+	if c.avail != 9 {
+		t.Fatalf("avail = %d after refilling past the limit, want 9", c.avail)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	c.avail = 0
+	if c.acquire(1, done) {
+		t.Fatal("acquire succeeded after done was closed")
+	}
+}
+
+// TestFloodPausesWithoutCredit floods a terminal and checks that the agent
+// stops reading it once its output window is used up, then delivers every
+// byte in order as credit comes back.
+func TestFloodPausesWithoutCredit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.OutputWindow = 16 * 1024
+	cfg.CoalesceDelay = 0
+	agent := NewAgent(cfg)
+	stream := &fakeBackendStream{sent: make(chan *pb.ClientUpdate, 1024)}
+	agent.attach(stream)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	flow := newTermFlow(context.Background(), cfg)
+	defer flow.hangup()
+	go agent.pumpOutput("t", r, flow)
+
+	var flood bytes.Buffer
+	for flood.Len() < 4<<20 {
+		flood.WriteString("the quick brown fox jumps over the lazy dog\n")
+	}
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		w.Write(flood.Bytes())
+		w.Close()
+	}()
+
+	var received bytes.Buffer
+	take := func(timeout time.Duration) bool {
+		select {
+		case msg := <-stream.sent:
+			received.Write(msg.GetPtyOutput().GetData())
+			return true
+		case <-time.After(timeout):
+			return false
+		}
+	}
+
+	for take(100 * time.Millisecond) {
+	}
+	// One read may overdraw the window.
+	if limit := cfg.OutputWindow + 32*1024; received.Len() > limit {
+		t.Fatalf("sent %d bytes without credit, window is %d", received.Len(), cfg.OutputWindow)
+	}
+	select {
+	case <-written:
+		t.Fatal("the whole flood was read without credit")
+	default:
+	}
+
+	credited := 0
+	deadline := time.Now().Add(10 * time.Second)
+	for received.Len() < flood.Len() {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d of %d bytes", received.Len(), flood.Len())
+		}
+		flow.output.grant(received.Len() - credited)
+		credited = received.Len()
+		take(time.Second)
+	}
+	if !bytes.Equal(received.Bytes(), flood.Bytes()) {
+		t.Fatal("flood arrived out of order or corrupted")
+	}
+}
@@ -0,0 +1,169 @@
+package controller
+
+// framer holds back the tail of PTY output that ends in the middle of a UTF-8
+// sequence or an ANSI escape sequence, so every TerminalOutput we send can be
+// rendered on its own. Held bytes are released by the next Push that
+// completes them, or by Flush once the read loop gives up waiting.
+type framer struct {
+	buf []byte
+}
+
+// maxHeld bounds how much output a framer keeps back. A sequence that is
+// still unfinished after this many bytes (a huge OSC 52 clipboard write, or
+// plain garbage) is sent as is rather than stalling the terminal.
+const maxHeld = 64 * 1024
+
+// Push adds data read from the PTY and returns the part that ends on a safe
+// boundary. The returned slice is only valid until the next call.
+func (f *framer) Push(data []byte) []byte {
+	if len(f.buf) == 0 {
+		cut := safeBoundary(data)
+		if cut == len(data) || len(data)-cut > maxHeld {
+			return data
+		}
+		f.buf = append(f.buf, data[cut:]...)
+		return data[:cut]
+	}
+
+	f.buf = append(f.buf, data...)
+	cut := safeBoundary(f.buf)
+	if len(f.buf)-cut > maxHeld {
+		cut = len(f.buf)
+	}
+	out := append([]byte(nil), f.buf[:cut]...)
+	f.buf = append(f.buf[:0], f.buf[cut:]...)
+	return out
+}
+
+// Flush returns everything still held back.
+func (f *framer) Flush() []byte {
+	out := append([]byte(nil), f.buf...)
+	f.buf = f.buf[:0]
+	return out
+}
+
+// Pending reports whether the framer is holding bytes back.
+func (f *framer) Pending() bool {
+	return len(f.buf) > 0
+}
+
+type escState int
+
+const (
+	stateGround    escState = iota
+	stateEscape             // after ESC
+	stateEscInter           // ESC followed by intermediate bytes, e.g. ESC ( B
+	stateCSI                // ESC [ ... final byte
+	stateString             // OSC, DCS, SOS, PM or APC body
+	stateStringEsc          // ESC seen inside a string, expecting \ for ST
+)
+
+// safeBoundary returns the length of the longest prefix of p that does not
+// end inside a UTF-8 character or an escape sequence.
+func safeBoundary(p []byte) int {
+	state := stateGround
+	start := 0 // start of the sequence currently being parsed
+	isOSC := false
+
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		switch state {
+		case stateGround:
+			if b == 0x1b {
+				state, start = stateEscape, i
+				continue
+			}
+			if n := utf8SeqLen(b); n > 1 {
+				if i+n > len(p) {
+					if validContinuation(p[i+1:]) {
+						return i
+					}
+					continue
+				}
+				if validContinuation(p[i+1 : i+n]) {
+					i += n - 1
+				}
+			}
+
+		case stateEscape:
+			switch {
+			case b == '[':
+				state = stateCSI
+			case b == ']' || b == 'P' || b == 'X' || b == '^' || b == '_':
+				state, isOSC = stateString, b == ']'
+			case b >= 0x20 && b <= 0x2f:
+				state = stateEscInter
+			case b == 0x1b:
+				start = i
+			default:
+				state = stateGround
+			}
+
+		case stateEscInter:
+			if b < 0x20 || b > 0x2f {
+				state = stateGround
+			}
+
+		case stateCSI:
+			switch {
+			case b >= 0x40 && b <= 0x7e:
+				state = stateGround
+			case b == 0x1b:
+				state, start = stateEscape, i
+			case b == 0x18 || b == 0x1a:
+				state = stateGround
+			case b < 0x20 || b > 0x3f:
+				// Not a parameter or intermediate byte: the sequence is
+				// malformed, so stop treating it as one.
+				state = stateGround
+			}
+
+		case stateString:
+			switch {
+			case b == 0x07 && isOSC:
+				state = stateGround
+			case b == 0x1b:
+				state = stateStringEsc
+			case b == 0x18 || b == 0x1a:
+				state = stateGround
+			}
+
+		case stateStringEsc:
+			if b == '\\' {
+				state = stateGround
+			} else {
+				// Any other escape aborts the string and starts a new sequence.
+				state, start = stateEscape, i-1
+				i--
+			}
+		}
+	}
+
+	if state != stateGround {
+		return start
+	}
+	return len(p)
+}
+
+// utf8SeqLen returns the length of the UTF-8 sequence introduced by lead, or 1
+// for ASCII, continuation bytes and invalid lead bytes.
+func utf8SeqLen(lead byte) int {
+	switch {
+	case lead&0xe0 == 0xc0 && lead >= 0xc2:
+		return 2
+	case lead&0xf0 == 0xe0:
+		return 3
+	case lead&0xf8 == 0xf0 && lead <= 0xf4:
+		return 4
+	}
+	return 1
+}
+
+func validContinuation(p []byte) bool {
+	for _, b := range p {
+		if b&0xc0 != 0x80 {
+			return false
+		}
+	}
+	return true
+}
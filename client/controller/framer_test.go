@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"bytes"
+	"testing"
+	"unicode/utf8"
+)
+
+var framerSamples = []struct {
+	name string
+	data string
+}{
+	{"ascii", "hello world\r\n"},
+	{"two byte utf8", "café crème"},
+	{"three byte utf8", "price: 5€"},
+	{"four byte utf8", "ok \U0001F600 done"},
+	{"sgr", "\x1b[31mred\x1b[0m plain"},
+	{"sgr 256 colour", "\x1b[38;5;196mhot\x1b[39m"},
+	{"private csi", "\x1b[?1049h\x1b[2J\x1b[H"},
+	{"osc bel", "\x1b]0;my title\x07prompt$ "},
+	{"osc st with utf8", "\x1b]2;tïtle ☃\x1b\\$ "},
+	{"dcs", "\x1bP1$r0m\x1b\\after"},
+	{"charset designation", "\x1b(Bline\x1b(0qqq\x1b(B"},
+	{"mixed", "é\x1b[1;32m✔\x1b[0m \U0001F680\x1b]8;;https://x.y\x1b\\link\x1b]8;;\x1b\\"},
+}
+
+// assertComplete checks that a chunk emitted by the framer can be rendered on
+// its own: it does not end inside an escape sequence or a UTF-8 character.
+func assertComplete(t *testing.T, chunk []byte) {
+	t.Helper()
+	if got := safeBoundary(chunk); got != len(chunk) {
+		t.Fatalf("chunk %q ends inside a sequence (safe boundary %d of %d)", chunk, got, len(chunk))
+	}
+	if !utf8.Valid(chunk) {
+		t.Fatalf("chunk %q is not valid UTF-8", chunk)
+	}
+}
+
+func pushAll(t *testing.T, fr *framer, pieces ...[]byte) []byte {
+	t.Helper()
+	var out []byte
+	for _, piece := range pieces {
+		chunk := fr.Push(piece)
+		assertComplete(t, chunk)
+		out = append(out, chunk...)
+	}
+	return out
+}
+
+func TestFramerEverySingleSplit(t *testing.T) {
+	for _, tt := range framerSamples {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte(tt.data)
+			for i := 0; i <= len(data); i++ {
+				var fr framer
+				got := pushAll(t, &fr, data[:i], data[i:])
+				if fr.Pending() {
+					t.Fatalf("split at %d: framer still holds %q", i, fr.Flush())
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("split at %d: got %q, want %q", i, got, data)
+				}
+			}
+		})
+	}
+}
+
+func TestFramerEveryDoubleSplit(t *testing.T) {
+	for _, tt := range framerSamples {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte(tt.data)
+			for i := 0; i <= len(data); i++ {
+				for j := i; j <= len(data); j++ {
+					var fr framer
+					got := pushAll(t, &fr, data[:i], data[i:j], data[j:])
+					if fr.Pending() || !bytes.Equal(got, data) {
+						t.Fatalf("splits at %d,%d: got %q (pending %v), want %q", i, j, got, fr.Pending(), data)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFramerByteAtATime(t *testing.T) {
+	for _, tt := range framerSamples {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte(tt.data)
+			var fr framer
+			var pieces [][]byte
+			for i := range data {
+				pieces = append(pieces, data[i:i+1])
+			}
+			if got := pushAll(t, &fr, pieces...); !bytes.Equal(got, data) || fr.Pending() {
+				t.Fatalf("got %q (pending %v), want %q", got, fr.Pending(), data)
+			}
+		})
+	}
+}
+
+func TestFramerHoldsIncompleteTail(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantOut  string
+		wantHeld string
+	}{
+		{"csi introducer", "abc\x1b[", "abc", "\x1b["},
+		{"csi parameters", "abc\x1b[38;5;1", "abc", "\x1b[38;5;1"},
+		{"lone escape", "abc\x1b", "abc", "\x1b"},
+		{"open osc", "x\x1b]0;title", "x", "\x1b]0;title"},
+		{"osc waiting for st", "x\x1b]0;title\x1b", "x", "\x1b]0;title\x1b"},
+		{"split euro sign", "5\xe2\x82", "5", "\xe2\x82"},
+		{"split emoji", "\xf0\x9f\x98", "", "\xf0\x9f\x98"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fr framer
+			out := fr.Push([]byte(tt.data))
+			if string(out) != tt.wantOut {
+				t.Errorf("Push() = %q, want %q", out, tt.wantOut)
+			}
+			if held := fr.Flush(); string(held) != tt.wantHeld {
+				t.Errorf("Flush() = %q, want %q", held, tt.wantHeld)
+			}
+			if fr.Pending() {
+				t.Errorf("Pending() after Flush() = true")
+			}
+		})
+	}
+}
+
+func TestFramerDoesNotStallOnGarbage(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"invalid lead bytes", "\xff\xfe\xc0\xc1"},
+		{"stray continuation bytes", "\x80\x81abc"},
+		{"truncated utf8 followed by ascii", "\xe2\x82a"},
+		{"csi aborted by can", "\x1b[12\x18rest"},
+		{"malformed csi", "\x1b[1\x01rest"},
+		{"osc aborted by new escape", "\x1b]0;title\x1b[0m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fr framer
+			if out := fr.Push([]byte(tt.data)); string(out) != tt.data || fr.Pending() {
+				t.Errorf("Push() = %q (pending %v), want everything", out, fr.Pending())
+			}
+		})
+	}
+}
+
+func TestFramerReleasesOversizedSequence(t *testing.T) {
+	var fr framer
+	huge := append([]byte("\x1b]52;c;"), bytes.Repeat([]byte("A"), maxHeld)...)
+	if out := fr.Push(huge[:10]); len(out) != 0 {
+		t.Fatalf("Push() of a short open OSC = %q, want nothing", out)
+	}
+	out := fr.Push(huge[10:])
+	if !bytes.Equal(out, huge) || fr.Pending() {
+		t.Fatalf("oversized OSC was held back: got %d bytes, pending %v", len(out), fr.Pending())
+	}
+}
@@ -0,0 +1,34 @@
+package controller
+
+import "errors"
+
+// A job is a command shared with `shellsync run`: the session's only
+// terminal, which viewers can watch but not type into, signal or close. The
+// agent stops once the job exits.
+
+var (
+	errReadOnly      = errors.New("terminal is read-only")
+	errJobUnfinished = errors.New("agent stopped before the command finished")
+)
+
+// endJob records how the job ended and stops the agent.
+func (a *Agent) endJob(err error) {
+	a.mu.Lock()
+	a.jobErr, a.jobDone = err, true
+	a.mu.Unlock()
+	a.Stop()
+}
+
+// jobResult is what Start returns for an agent that stopped: nil without a
+// job, otherwise how the job ended.
+func (a *Agent) jobResult() error {
+	if a.job == "" {
+		return nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.jobDone {
+		return errJobUnfinished
+	}
+	return a.jobErr
+}
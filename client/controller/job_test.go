@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+)
+
+// TestJobIsReadOnly checks that the job is reported read-only, refuses to
+// be closed or signalled, and that its exit status stops the agent.
+func TestJobIsReadOnly(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Job = []string{"sh", "-c", "sleep 0.2; exit 3"}
+	a := NewAgent(cfg)
+	a.job = "term-job"
+	stream := &fakeBackendStream{sent: make(chan *pb.ClientUpdate, 1024)}
+	a.attach(stream)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := a.startTerminals(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.closeTerminal(a.job); !errors.Is(err, errReadOnly) {
+		t.Errorf("closeTerminal = %v, want %v", err, errReadOnly)
+	}
+	if err := a.signalTerminal(a.job, "INT"); !errors.Is(err, errReadOnly) {
+		t.Errorf("signalTerminal = %v, want %v", err, errReadOnly)
+	}
+
+	readOnly := false
+	timeout := time.After(10 * time.Second)
+	for done := false; !done; {
+		select {
+		case msg := <-stream.sent:
+			if created := msg.GetTerminalCreatedResponse(); created != nil {
+				readOnly = created.GetReadOnly()
+			}
+			done = msg.GetTerminalExited().GetTerminalId() == a.job
+		case <-timeout:
+			t.Fatal("job did not exit")
+		}
+	}
+	if !readOnly {
+		t.Error("job was not reported read-only")
+	}
+
+	select {
+	case <-a.quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent not stopped after the job exited")
+	}
+	var exitErr *exec.ExitError
+	if err := a.jobResult(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("jobResult = %v, want exit status 3", err)
+	}
+}
@@ -0,0 +1,30 @@
+package controller
+
+import "time"
+
+// ShellLimits caps the resources of the shell of each terminal and what it
+// runs. Zero leaves a limit off. The limits are in place before the shell
+// runs; they do not reach the shells of terminals backed by tmux, which run
+// in the tmux server.
+type ShellLimits struct {
+	// MaxProcesses is how many processes may run in the terminal. It needs
+	// the cgroup v2 pids controller and is left off without it:
+	// RLIMIT_NPROC would count all processes of the user, not only the
+	// terminal's.
+	MaxProcesses int
+	// MaxOpenFiles is RLIMIT_NOFILE, per process.
+	MaxOpenFiles int
+	// CPUTime is RLIMIT_CPU, per process, in whole seconds.
+	CPUTime time.Duration
+	// MemoryMB caps the memory of everything in the terminal, in MiB. It
+	// needs cgroup v2 and is left off without it.
+	MemoryMB int64
+	// Cgroup is the cgroup v2 directory the shells' cgroups are created
+	// in, by default the agent's own. It must not have processes of its
+	// own.
+	Cgroup string
+}
+
+func (l ShellLimits) enabled() bool {
+	return l.MaxProcesses > 0 || l.MaxOpenFiles > 0 || l.CPUTime > 0 || l.MemoryMB > 0
+}
@@ -0,0 +1,264 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cgroupRoot = "/sys/fs/cgroup"
+	// cgroupPrefix names the cgroups the agent creates, one per limited
+	// terminal, followed by its backend ID.
+	cgroupPrefix = "shellsync-"
+)
+
+// cgroupSetup is where the cgroups of limited shells are created, with the
+// controllers that could be enabled for them. parent is empty if cgroup v2
+// cannot be used.
+type cgroupSetup struct {
+	once         sync.Once
+	err          error
+	parent       string
+	memory, pids bool
+}
+
+var shellCgroups cgroupSetup
+
+// cgroups sets up shellCgroups in parent, or in the agent's own cgroup if
+// parent is empty, the first time it is needed.
+func cgroups(parent string) *cgroupSetup {
+	shellCgroups.once.Do(func() {
+		if shellCgroups.err = shellCgroups.setUp(parent); shellCgroups.err != nil {
+			log.Printf("Agent: Not using cgroups to limit shells: %v", shellCgroups.err)
+		}
+	})
+	return &shellCgroups
+}
+
+// setUp enables the memory and pids controllers for the children of
+// parent. The agent only ever creates the shells' cgroups there; it does
+// not move itself or anything else. cgroup v2 only hands controllers down
+// from a cgroup without processes of its own, so this fails for the
+// agent's own cgroup unless that is the root.
+func (c *cgroupSetup) setUp(parent string) error {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &fs); err != nil {
+		return err
+	}
+	if fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return errors.New(cgroupRoot + " is not a cgroup v2 hierarchy")
+	}
+	if parent == "" {
+		data, err := os.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if path, ok := strings.CutPrefix(line, "0::"); ok {
+				parent = filepath.Join(cgroupRoot, path)
+			}
+		}
+		if parent == "" {
+			return errors.New("the agent is not in a cgroup v2 cgroup")
+		}
+	}
+	available, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	var enable []string
+	for _, controller := range strings.Fields(string(available)) {
+		if controller == "memory" || controller == "pids" {
+			enable = append(enable, "+"+controller)
+		}
+	}
+	if len(enable) == 0 {
+		return fmt.Errorf("neither the memory nor the pids controller is available in %s", parent)
+	}
+
+	err = writeCgroup(parent, "cgroup.subtree_control", strings.Join(enable, " "))
+	if errors.Is(err, unix.EBUSY) {
+		return fmt.Errorf("cgroup %s has processes in it, so it cannot hold the cgroups of shells; "+
+			"name an empty cgroup you may write to with --limit-cgroup", parent)
+	}
+	if err != nil {
+		return err
+	}
+	c.parent = parent
+	for _, controller := range enable {
+		c.memory = c.memory || controller == "+memory"
+		c.pids = c.pids || controller == "+pids"
+	}
+	return nil
+}
+
+func writeCgroup(dir, file, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0); err != nil {
+		return fmt.Errorf("failed to set %s of cgroup %s: %w", file, dir, err)
+	}
+	return nil
+}
+
+// rlimitWrapper is the argv[0] under which the agent runs itself to start a
+// limited shell: Go cannot set rlimits between fork and exec, and setting
+// them in the agent would limit the agent too. The wrapper is run as
+//
+//	rlimitWrapper <resource>=<value>,... <path> <argv...>
+//
+// and sets the rlimits before it execs path.
+const rlimitWrapper = "shellsync-rlimit"
+
+func init() {
+	if len(os.Args) > 3 && os.Args[0] == rlimitWrapper {
+		os.Exit(execLimited(os.Args[1], os.Args[2], os.Args[3:]))
+	}
+}
+
+var rlimitNames = map[string]string{
+	"nofile": "open files",
+	"cpu":    "CPU time",
+}
+
+var rlimitResources = map[string]int{
+	"nofile": unix.RLIMIT_NOFILE,
+	"cpu":    unix.RLIMIT_CPU,
+}
+
+// execLimited is the rlimit wrapper. It only returns if the shell could not
+// be started, with the exit status to report.
+func execLimited(spec, path string, argv []string) int {
+	for _, setting := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(setting, "=")
+		n, err := strconv.ParseUint(value, 10, 64)
+		resource, ok := rlimitResources[key]
+		if err != nil || !ok {
+			fmt.Fprintf(os.Stderr, "shellsync: bad rlimit %q\n", setting)
+			return 126
+		}
+		// syscall rather than unix: the runtime restores the RLIMIT_NOFILE
+		// it started with on exec unless it was set through syscall.
+		var limit syscall.Rlimit
+		if err := syscall.Getrlimit(resource, &limit); err != nil {
+			fmt.Fprintf(os.Stderr, "shellsync: failed to limit %s of the shell: %v\n", rlimitNames[key], err)
+			return 126
+		}
+		// Without privileges the hard limit cannot be raised, so a larger
+		// limit is capped at it.
+		limit.Cur = min(n, limit.Max)
+		limit.Max = limit.Cur
+		if err := syscall.Setrlimit(resource, &limit); err != nil {
+			fmt.Fprintf(os.Stderr, "shellsync: failed to limit %s of the shell: %v\n", rlimitNames[key], err)
+			return 126
+		}
+	}
+	err := syscall.Exec(path, argv, os.Environ())
+	fmt.Fprintf(os.Stderr, "shellsync: failed to start %s: %v\n", path, err)
+	return 127
+}
+
+// check warns about limits this system cannot enforce, and fails if the
+// cgroup named for the shells cannot be used.
+func (l ShellLimits) check() error {
+	if l.MaxProcesses == 0 && l.MemoryMB == 0 {
+		return nil
+	}
+	cg := cgroups(l.Cgroup)
+	if cg.err != nil && l.Cgroup != "" {
+		return cg.err
+	}
+	if l.MaxProcesses > 0 && !cg.pids {
+		log.Printf("Agent: Shell processes are not limited without the cgroup v2 pids controller")
+	}
+	if l.MemoryMB > 0 && !cg.memory {
+		log.Printf("Agent: Shell memory is not limited without the cgroup v2 memory controller")
+	}
+	return nil
+}
+
+// prepareShell sets cmd up to start the shell of a terminal under the
+// limits: in a cgroup of its own, created before the shell so that it
+// starts inside it, and through the rlimit wrapper. release removes what
+// was set up once the shell has exited or failed to start.
+func prepareShell(l ShellLimits, backendID string, cmd *exec.Cmd) (release func(), err error) {
+	release = func() {}
+	if !l.enabled() || cmd.Err != nil {
+		return release, nil
+	}
+
+	var pids, memory bool
+	var cg *cgroupSetup
+	if l.MaxProcesses > 0 || l.MemoryMB > 0 {
+		cg = cgroups(l.Cgroup)
+		pids = l.MaxProcesses > 0 && cg.pids
+		memory = l.MemoryMB > 0 && cg.memory
+	}
+	if pids || memory {
+		dir := filepath.Join(cg.parent, cgroupPrefix+backendID)
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			return release, fmt.Errorf("failed to create a cgroup for the shell: %w", err)
+		}
+		remove := func() {
+			if err := os.Remove(dir); err != nil {
+				log.Printf("Agent: Failed to remove cgroup of terminal %s: %v", backendID, err)
+			}
+		}
+		var settings [][2]string
+		if pids {
+			settings = append(settings, [2]string{"pids.max", strconv.Itoa(l.MaxProcesses)})
+		}
+		if memory {
+			settings = append(settings, [2]string{"memory.max", strconv.FormatInt(l.MemoryMB<<20, 10)})
+		}
+		for _, setting := range settings {
+			if err := writeCgroup(dir, setting[0], setting[1]); err != nil {
+				remove()
+				return release, err
+			}
+		}
+		fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			remove()
+			return release, fmt.Errorf("failed to open the cgroup of the shell: %w", err)
+		}
+		// The shell is cloned straight into the cgroup (Linux 5.7 and
+		// later), so nothing it runs escapes the limits.
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = fd
+		release = func() {
+			unix.Close(fd)
+			remove()
+		}
+	}
+
+	rlimits := map[string]int64{
+		"nofile": int64(l.MaxOpenFiles),
+		"cpu":    int64((l.CPUTime + time.Second - 1) / time.Second),
+	}
+	var spec []string
+	for name, value := range rlimits {
+		if value > 0 {
+			spec = append(spec, name+"="+strconv.FormatInt(value, 10))
+		}
+	}
+	if len(spec) > 0 {
+		// /proc/self/exe still works if the agent's binary was replaced
+		// since it started.
+		cmd.Args = append([]string{rlimitWrapper, strings.Join(spec, ","), cmd.Path}, cmd.Args...)
+		cmd.Path = "/proc/self/exe"
+	}
+	return release, nil
+}
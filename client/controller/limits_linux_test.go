@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+)
+
+// TestShellLimits checks that a new terminal's shell starts with the
+// configured rlimits and, if SHELLSYNC_TEST_CGROUP names an empty cgroup v2
+// directory to create it in, in a cgroup of its own. Without it the test
+// leaves cgroups alone.
+func TestShellLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Limits = ShellLimits{MaxOpenFiles: 64, CPUTime: 90 * time.Second}
+	if dir := os.Getenv("SHELLSYNC_TEST_CGROUP"); dir != "" {
+		cfg.Limits.MaxProcesses = 32
+		cfg.Limits.Cgroup = dir
+		if err := cfg.Limits.check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := NewAgent(cfg)
+	a.attach(&fakeBackendStream{sent: make(chan *pb.ClientUpdate, 1024)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Setenv("SHELL", "/bin/sh")
+	if err := a.spawnNewPty(ctx, &pb.CreateTerminalRequest{TerminalId: "term-test"}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.hangup("term-test")
+	a.mu.RLock()
+	pid := strconv.Itoa(a.procs[a.terminalMap["term-test"]].Process.Pid)
+	a.mu.RUnlock()
+
+	// The process is in its cgroup from the start, before the wrapper has
+	// even run.
+	if cfg.Limits.Cgroup != "" && cgroups(cfg.Limits.Cgroup).pids {
+		cgroup, err := os.ReadFile("/proc/" + pid + "/cgroup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(strings.TrimSpace(string(cgroup)), "/"+cgroupPrefix+"term-test") {
+			t.Errorf("shell started in cgroup %s", cgroup)
+		}
+		max, err := os.ReadFile(filepath.Join(cfg.Limits.Cgroup, cgroupPrefix+"term-test", "pids.max"))
+		if err != nil || strings.TrimSpace(string(max)) != "32" {
+			t.Errorf("pids.max of the shell's cgroup is %q (%v), want 32", max, err)
+		}
+	}
+
+	// The wrapper sets the rlimits, then execs the shell.
+	self, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if exe, _ := os.Readlink("/proc/" + pid + "/exe"); exe != self {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the wrapper did not exec the shell")
+		}
+	}
+	limits, err := os.ReadFile("/proc/" + pid + "/limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`Max open files +64 +64 +files`,
+		`Max cpu time +90 +90 +seconds`,
+	} {
+		if !regexp.MustCompile(want).Match(limits) {
+			t.Errorf("limits of the shell do not match %q:\n%s", want, limits)
+		}
+	}
+}
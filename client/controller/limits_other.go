@@ -0,0 +1,19 @@
+//go:build !linux
+
+package controller
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func (l ShellLimits) check() error {
+	if l.enabled() {
+		return errors.New("limits on shells are only supported on Linux")
+	}
+	return nil
+}
+
+func prepareShell(l ShellLimits, backendID string, cmd *exec.Cmd) (release func(), err error) {
+	return func() {}, nil
+}
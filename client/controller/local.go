@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+	"golang.org/x/term"
+)
+
+// localTTY shows the default terminal in the terminal the agent was started
+// from, so the host works in the same shell its guests see. The local TTY is
+// put into raw mode: keystrokes go to the shell as they are typed, and the
+// shell's output is copied back unchanged.
+type localTTY struct {
+	in, out *os.File
+	// backendID is the terminal shown. It is set before that terminal is
+	// spawned and not changed afterwards.
+	backendID string
+
+	state       *term.State
+	restoreOnce sync.Once
+}
+
+func newLocalTTY() (*localTTY, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, errors.New("attached mode needs a terminal")
+	}
+	return &localTTY{in: os.Stdin, out: os.Stdout}, nil
+}
+
+// mirror returns where the output of a terminal is copied locally, or nil if
+// it is not shown here.
+func (l *localTTY) mirror(backendID string) io.Writer {
+	if l == nil || l.backendID != backendID {
+		return nil
+	}
+	return l.out
+}
+
+// shows reports whether a terminal is the one shown locally.
+func (l *localTTY) shows(backendID string) bool {
+	return l != nil && l.backendID == backendID
+}
+
+// restore takes the local TTY out of raw mode again.
+func (l *localTTY) restore() {
+	if l == nil {
+		return
+	}
+	l.restoreOnce.Do(func() {
+		if l.state != nil {
+			term.Restore(int(l.in.Fd()), l.state)
+		}
+	})
+}
+
+// attachLocal connects the local TTY to a running terminal.
+func (a *Agent) attachLocal(backendID string) error {
+	a.mu.RLock()
+	ptmx := a.ptys[a.terminalMap[backendID]]
+	a.mu.RUnlock()
+	flow, ok := a.flow(backendID)
+	if ptmx == nil || !ok {
+		return fmt.Errorf("unknown terminal ID: %s", backendID)
+	}
+
+	state, err := term.MakeRaw(int(a.local.in.Fd()))
+	if err != nil {
+		return fmt.Errorf("failed to put the local terminal into raw mode: %w", err)
+	}
+	a.local.state = state
+	go a.local.forwardInput(ptmx, a.touch)
+	go a.watchLocalSize(backendID, flow)
+	return nil
+}
+
+// forwardInput writes local keystrokes to the PTY. They go straight to it
+// rather than through the backend's input window, which only accounts for
+// input the backend sent. touch is called for every keystroke.
+func (l *localTTY) forwardInput(ptmx *os.File, touch func()) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := l.in.Read(buf)
+		if n > 0 {
+			if _, err := ptmx.Write(buf[:n]); err != nil {
+				return
+			}
+			touch()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// watchLocalSize reports the size of the local window to the backend, now
+// and whenever it changes, until the terminal ends. The backend weighs it
+// against the guests' windows and resizes the PTY like for any viewer.
+func (a *Agent) watchLocalSize(backendID string, flow *termFlow) {
+	resized := make(chan os.Signal, 1)
+	notifyResize(resized)
+	defer signal.Stop(resized)
+	for {
+		cols, rows, err := term.GetSize(int(a.local.out.Fd()))
+		if err != nil {
+			log.Printf("Agent: Failed to get the size of the local terminal: %v", err)
+		} else {
+			msg := &pb.ClientUpdate{
+				Payload: &pb.ClientUpdate_HostResize{
+					HostResize: &pb.TerminalResize{TerminalId: backendID, Rows: uint32(rows), Cols: uint32(cols)},
+				},
+			}
+			if err := a.send(msg); err != nil {
+				return
+			}
+		}
+		select {
+		case <-resized:
+		case <-flow.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,6 @@
+package controller
+
+import "os"
+
+// Windows consoles send no signal on resize; the size is reported once.
+func notifyResize(c chan<- os.Signal) {}
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+)
+
+// Policies end a session nobody is using any more: after IdleTimeout without
+// input or output on any terminal, or once the agent has been up for
+// MaxLifetime. The host and the viewers are warned PolicyWarning ahead, and
+// when a policy triggers the agent tells the backend why before it shuts
+// down like on a stop request.
+const (
+	reasonIdle     = "idle_timeout"
+	reasonLifetime = "max_lifetime"
+
+	policyTick = time.Second
+)
+
+// touch records input or output on a terminal, which puts the idle timeout
+// off again.
+func (a *Agent) touch() {
+	a.lastActivity.Store(time.Now().UnixNano())
+}
+
+// policyDeadline returns when the first policy ends a session started at
+// started, and which policy that is. ok is false without policies.
+func (a *Agent) policyDeadline(started time.Time) (deadline time.Time, reason string, ok bool) {
+	if a.cfg.IdleTimeout > 0 {
+		deadline = time.Unix(0, a.lastActivity.Load()).Add(a.cfg.IdleTimeout)
+		reason, ok = reasonIdle, true
+	}
+	if a.cfg.MaxLifetime > 0 {
+		if end := started.Add(a.cfg.MaxLifetime); !ok || end.Before(deadline) {
+			deadline, reason, ok = end, reasonLifetime, true
+		}
+	}
+	return deadline, reason, ok
+}
+
+// enforcePolicies checks the policies of a session started at started
+// until the agent stops. A warning is withdrawn again when activity puts
+// the idle timeout off.
+func (a *Agent) enforcePolicies(ctx context.Context, started time.Time) {
+	if _, _, ok := a.policyDeadline(started); !ok {
+		return
+	}
+	ticker := time.NewTicker(policyTick)
+	defer ticker.Stop()
+	warned := ""
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.quit:
+			return
+		case <-ctx.Done():
+			return
+		}
+		deadline, reason, _ := a.policyDeadline(started)
+		left := time.Until(deadline)
+		switch {
+		case left <= 0:
+			message := a.policyMessage(reason, 0)
+			a.announce(message)
+			a.sendNotice(&pb.AgentNotice{
+				Reason:         reason,
+				Message:        message,
+				DeadlineUnixMs: deadline.UnixMilli(),
+				Final:          true,
+			})
+			a.Stop()
+			return
+		case left <= a.cfg.PolicyWarning:
+			if warned == reason {
+				continue
+			}
+			warned = reason
+			message := a.policyMessage(reason, left)
+			a.announce(message)
+			a.sendNotice(&pb.AgentNotice{
+				Reason:         reason,
+				Message:        message,
+				DeadlineUnixMs: deadline.UnixMilli(),
+			})
+		case warned != "":
+			warned = ""
+			a.announce("The session stays open.")
+			a.sendNotice(&pb.AgentNotice{})
+		}
+	}
+}
+
+// policyMessage explains to users why the session ends in left, or has
+// ended if left is zero.
+func (a *Agent) policyMessage(reason string, left time.Duration) string {
+	ended := left <= 0
+	left = max(left.Round(time.Second), time.Second)
+	switch {
+	case reason == reasonIdle && !ended:
+		return fmt.Sprintf("The session has been idle and ends in %s unless a terminal is used.", left)
+	case reason == reasonIdle:
+		return fmt.Sprintf("The session ended after %s without activity.", a.cfg.IdleTimeout)
+	case !ended:
+		return fmt.Sprintf("The session ends in %s, when it reaches its maximum lifetime of %s.", left, a.cfg.MaxLifetime)
+	default:
+		return fmt.Sprintf("The session ended after its maximum lifetime of %s.", a.cfg.MaxLifetime)
+	}
+}
+
+// announce shows a message to the host: in the shared terminal in attached
+// mode, and otherwise on stderr unless the log already goes there.
+func (a *Agent) announce(message string) {
+	log.Printf("Agent: %s", message)
+	switch {
+	case a.local != nil:
+		fmt.Fprintf(a.local.out, "\r\n[shellsync] %s\r\n", message)
+	case log.Writer() != os.Stderr:
+		fmt.Fprintf(os.Stderr, "[shellsync] %s\n", message)
+	}
+}
+
+// sendNotice passes a notice on to the backend. It gives up after
+// controlTimeout, so a broken link cannot hold off a shutdown.
+func (a *Agent) sendNotice(notice *pb.AgentNotice) {
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		msg := &pb.ClientUpdate{Payload: &pb.ClientUpdate_Notice{Notice: notice}}
+		if err := a.send(msg); err != nil {
+			log.Printf("Agent: Failed to send notice to backend: %v", err)
+		}
+	}()
+	select {
+	case <-sent:
+	case <-time.After(controlTimeout):
+	}
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+)
+
+func TestPolicyDeadline(t *testing.T) {
+	started := time.Now()
+	cfg := DefaultConfig()
+	if _, _, ok := NewAgent(cfg).policyDeadline(started); ok {
+		t.Fatal("deadline without policies")
+	}
+
+	cfg.IdleTimeout = time.Hour
+	cfg.MaxLifetime = 2 * time.Hour
+	a := NewAgent(cfg)
+	if _, reason, _ := a.policyDeadline(started); reason != reasonIdle {
+		t.Errorf("reason = %q, want %q", reason, reasonIdle)
+	}
+	a.lastActivity.Store(started.Add(90 * time.Minute).UnixNano())
+	deadline, reason, _ := a.policyDeadline(started)
+	if reason != reasonLifetime || !deadline.Equal(started.Add(2*time.Hour)) {
+		t.Errorf("policyDeadline = %v, %q, want the maximum lifetime", deadline.Sub(started), reason)
+	}
+}
+
+// TestIdleTimeoutStopsAgent checks that an idle agent warns the backend,
+// then tells it that it is shutting down and stops.
+func TestIdleTimeoutStopsAgent(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.IdleTimeout = 1500 * time.Millisecond
+	cfg.PolicyWarning = time.Second
+	a := NewAgent(cfg)
+	stream := &fakeBackendStream{sent: make(chan *pb.ClientUpdate, 16)}
+	a.attach(stream)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.enforcePolicies(ctx, time.Now())
+
+	var notices []*pb.AgentNotice
+	timeout := time.After(10 * time.Second)
+	for len(notices) < 2 {
+		select {
+		case msg := <-stream.sent:
+			if notice := msg.GetNotice(); notice != nil {
+				notices = append(notices, notice)
+			}
+		case <-timeout:
+			t.Fatalf("got %d notices, want 2", len(notices))
+		}
+	}
+	if notices[0].GetReason() != reasonIdle || notices[0].GetFinal() {
+		t.Errorf("first notice = %v, want an idle warning", notices[0])
+	}
+	if !notices[1].GetFinal() {
+		t.Errorf("second notice = %v, want the final one", notices[1])
+	}
+	select {
+	case <-a.quit:
+	case <-time.After(time.Second):
+		t.Fatal("agent not stopped")
+	}
+}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	reconnectMinDelay = 500 * time.Millisecond
+	reconnectMaxDelay = 30 * time.Second
+	// A stream that stayed up this long counts as healthy, so the next
+	// failure starts backing off from the minimum again.
+	reconnectStableAfter = 10 * time.Second
+)
+
+var errAgentStopped = errors.New("agent stopped")
+
+// run keeps the agent attached to its session, reconnecting with
+// exponential backoff whenever the stream breaks. Terminals live on the
+// agent, not the stream, so shells keep running across reconnects. run
+// returns only when ctx is cancelled or the backend no longer knows the
+// session or refuses the agent.
+func (a *Agent) run(ctx context.Context, client pb.ShellSyncClient, sessionID string) error {
+	defer close(a.stop)
+
+	delay := reconnectMinDelay
+	for {
+		started := time.Now()
+		err := a.startStream(ctx, client, sessionID)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// The session is gone, or it does not accept this agent.
+		if code := status.Code(err); code == codes.NotFound || code == codes.PermissionDenied {
+			return err
+		}
+		if time.Since(started) > reconnectStableAfter {
+			delay = reconnectMinDelay
+		}
+
+		// Full jitter keeps many agents from reconnecting in lockstep after
+		// a backend restart.
+		wait := delay/2 + rand.N(delay/2+1)
+		log.Printf("Agent: Stream to backend lost (%v). Reconnecting in %s.", err, wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+}
+
+// attach makes stream the link used by send and wakes up senders waiting
+// for it.
+func (a *Agent) attach(stream pb.ShellSync_StreamClient) {
+	a.linkMu.Lock()
+	defer a.linkMu.Unlock()
+	a.stream = stream
+	close(a.ready)
+}
+
+// detach forgets stream if it is still the current link. Senders then wait
+// for the next attach.
+func (a *Agent) detach(stream pb.ShellSync_StreamClient) {
+	a.linkMu.Lock()
+	defer a.linkMu.Unlock()
+	if a.stream == stream {
+		a.stream = nil
+		a.ready = make(chan struct{})
+	}
+}
+
+// send delivers msg on the current stream. While the agent is reconnecting
+// it waits instead of dropping the message, so PTY output and exit statuses
+// survive a blip; a PTY whose output is waiting here stops being read, which
+// in turn pauses the program writing to it. gRPC allows one sender per
+// stream at a time, so every message to the backend goes through here.
+func (a *Agent) send(msg *pb.ClientUpdate) error {
+	for {
+		a.linkMu.Lock()
+		stream, ready := a.stream, a.ready
+		a.linkMu.Unlock()
+
+		if stream == nil {
+			select {
+			case <-ready:
+				continue
+			case <-a.stop:
+				return errAgentStopped
+			}
+		}
+
+		a.sendMu.Lock()
+		err := stream.Send(msg)
+		a.sendMu.Unlock()
+		if err == nil {
+			return nil
+		}
+		a.detach(stream)
+	}
+}
+
+// reply sends msg without blocking the caller. The stream's receive loop
+// uses it: waiting there for a reconnect would keep the loop from noticing
+// that the stream is gone.
+func (a *Agent) reply(msg *pb.ClientUpdate) {
+	go func() {
+		if err := a.send(msg); err != nil {
+			log.Printf("Agent: Failed to send reply to backend: %v", err)
+		}
+	}()
+}
+
+// terminalIDs returns the backend IDs of the terminals the agent still has,
+// including ones whose exit has not been reported yet.
+func (a *Agent) terminalIDs() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	ids := make([]string, 0, len(a.terminalMap))
+	for backendID := range a.terminalMap {
+		ids = append(ids, backendID)
+	}
+	return ids
+}
+
+// heartbeat notices a stream that has gone quiet. The backend pings the agent
+// and says how long it waits for a pong; the agent applies the same limit to
+// the backend, so a link that dies without a reset (a sleeping laptop, a NAT
+// dropping state) is torn down and redialled instead of hanging.
+type heartbeat struct {
+	lastHeard atomic.Int64
+	timeout   atomic.Int64
+}
+
+func (h *heartbeat) heard() {
+	h.lastHeard.Store(time.Now().UnixNano())
+}
+
+func (h *heartbeat) setTimeout(d time.Duration) {
+	h.timeout.Store(int64(d))
+}
+
+// watch cancels the stream once nothing has been heard for the timeout the
+// backend announced. Until the first ping arrives there is no timeout.
+func (h *heartbeat) watch(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			timeout := time.Duration(h.timeout.Load())
+			silent := time.Since(time.Unix(0, h.lastHeard.Load()))
+			if timeout > 0 && silent > timeout {
+				log.Printf("Agent: Nothing heard from backend for %s, reconnecting.", silent.Round(time.Second))
+				cancel()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+//go:build !windows
+
+package controller
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// signals lists what the UI may send to a terminal, by name without the SIG
+// prefix.
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// signalForeground delivers sig to the foreground process group of the PTY,
+// which is the job the user is looking at. If the group cannot be read it
+// falls back to the shell's own process group.
+func signalForeground(ptmx *os.File, cmd *exec.Cmd, sig syscall.Signal) error {
+	pgid, err := foregroundGroup(ptmx)
+	if err != nil || pgid <= 0 {
+		if cmd == nil || cmd.Process == nil {
+			return errors.New("terminal has no running process")
+		}
+		if pgid, err = syscall.Getpgid(cmd.Process.Pid); err != nil {
+			return err
+		}
+	}
+	return syscall.Kill(-pgid, sig)
+}
+
+// foregroundGroup asks the PTY for its foreground process group. It goes
+// through SyscallConn because File.Fd would switch the PTY to blocking mode
+// under the reader goroutine.
+func foregroundGroup(ptmx *os.File) (int, error) {
+	rc, err := ptmx.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var pgid int
+	var ioctlErr error
+	if err := rc.Control(func(fd uintptr) {
+		pgid, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+	}); err != nil {
+		return 0, err
+	}
+	return pgid, ioctlErr
+}
+
+// signalGroup delivers sig to a process group.
+func signalGroup(pgid int, sig syscall.Signal) error {
+	return syscall.Kill(-pgid, sig)
+}
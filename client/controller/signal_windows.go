@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Windows has no process groups to signal; the only thing we can do to a
+// hung job is kill the shell.
+var signals = map[string]syscall.Signal{
+	"KILL": syscall.SIGKILL,
+}
+
+func signalForeground(ptmx *os.File, cmd *exec.Cmd, sig syscall.Signal) error {
+	if sig != syscall.SIGKILL {
+		return fmt.Errorf("signal %v is not supported on Windows", sig)
+	}
+	if cmd == nil || cmd.Process == nil {
+		return errors.New("terminal has no running process")
+	}
+	return cmd.Process.Kill()
+}
+
+func signalGroup(pgid int, sig syscall.Signal) error {
+	return fmt.Errorf("signal %v is not supported on Windows", sig)
+}
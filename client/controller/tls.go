@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// TLSConfig is how the link to the backend is secured. Without Insecure
+// the agent only talks to the backend over TLS.
+type TLSConfig struct {
+	// Insecure dials the backend in plaintext, for a backend on the same
+	// machine or a trusted network.
+	Insecure bool
+	// CAFile holds the CAs the backend's certificate is checked against,
+	// instead of the system's.
+	CAFile string
+	// CertFile and KeyFile are the agent's own certificate, for a backend
+	// that asks for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName is the name the backend's certificate must be for, if not
+	// the host dialled.
+	ServerName string
+}
+
+// credentials returns the transport credentials for dialling the backend.
+func (c TLSConfig) credentials() (credentials.TransportCredentials, error) {
+	if c.Insecure {
+		if c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" {
+			return nil, errors.New("TLS options cannot be combined with an insecure connection")
+		}
+		return insecure.NewCredentials(), nil
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("a client certificate needs both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(cfg), nil
+}
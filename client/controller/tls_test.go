@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/Ayush-Vish/shellsync/internal/tlstest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// serve starts a gRPC server on a local port, with TLS if cfg is set, and
+// returns its address by the name its certificates are for.
+func serve(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	if cfg == nil {
+		return tlstest.Serve(t)
+	}
+	return tlstest.Serve(t, grpc.Creds(credentials.NewTLS(cfg)))
+}
+
+// backendTLS returns the TLS config of a backend with a certificate from
+// ca, that asks agents for a certificate signed by clientCA if it is set.
+func backendTLS(t *testing.T, ca, clientCA *tlstest.CA) *tls.Config {
+	t.Helper()
+	certFile, keyFile := ca.Issue(t, "localhost", true)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCA != nil {
+		cfg.ClientCAs = x509.NewCertPool()
+		cfg.ClientCAs.AddCert(clientCA.Cert)
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
+
+func TestTLSConfigOptions(t *testing.T) {
+	ca := tlstest.NewCA(t, "ca")
+	cert, key := ca.Issue(t, "agent", false)
+	tests := []struct {
+		name    string
+		cfg     TLSConfig
+		want    string
+		wantErr bool
+	}{
+		{"tls by default", TLSConfig{}, "tls", false},
+		{"insecure", TLSConfig{Insecure: true}, "insecure", false},
+		{"insecure with a CA", TLSConfig{Insecure: true, CAFile: ca.File}, "", true},
+		{"insecure with a server name", TLSConfig{Insecure: true, ServerName: "localhost"}, "", true},
+		{"insecure with a certificate", TLSConfig{Insecure: true, CertFile: cert, KeyFile: key}, "", true},
+		{"certificate without key", TLSConfig{CertFile: cert}, "", true},
+		{"key without certificate", TLSConfig{KeyFile: key}, "", true},
+		{"missing CA file", TLSConfig{CAFile: ca.File + ".missing"}, "", true},
+		{"CA file without certificates", TLSConfig{CAFile: key}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := tt.cfg.credentials()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("credentials() = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && creds.Info().SecurityProtocol != tt.want {
+				t.Fatalf("credentials() use %q, want %q", creds.Info().SecurityProtocol, tt.want)
+			}
+		})
+	}
+}
+
+// TestTLSConfigHandshake dials backends with the credentials of agents.
+func TestTLSConfigHandshake(t *testing.T) {
+	ca := tlstest.NewCA(t, "ca")
+	other := tlstest.NewCA(t, "other-ca")
+	agentCert, agentKey := ca.Issue(t, "agent", false)
+
+	plainAddr := serve(t, nil)
+	tlsAddr := serve(t, backendTLS(t, ca, nil))
+	mtlsAddr := serve(t, backendTLS(t, ca, ca))
+
+	tests := []struct {
+		name    string
+		addr    string
+		cfg     TLSConfig
+		wantErr bool
+	}{
+		{"insecure on plaintext", plainAddr, TLSConfig{Insecure: true}, false},
+		{"tls refuses plaintext", plainAddr, TLSConfig{CAFile: ca.File}, true},
+		{"tls", tlsAddr, TLSConfig{CAFile: ca.File}, false},
+		{"system CAs do not trust the backend", tlsAddr, TLSConfig{}, true},
+		{"wrong CA", tlsAddr, TLSConfig{CAFile: other.File}, true},
+		{"server name", tlsAddr, TLSConfig{CAFile: ca.File, ServerName: "localhost"}, false},
+		{"wrong server name", tlsAddr, TLSConfig{CAFile: ca.File, ServerName: "backend.example"}, true},
+		{"mutual tls", mtlsAddr, TLSConfig{CAFile: ca.File, CertFile: agentCert, KeyFile: agentKey}, false},
+		{"mutual tls without client certificate", mtlsAddr, TLSConfig{CAFile: ca.File}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := tt.cfg.credentials()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tlstest.Call(t, tt.addr, creds); (err != nil) != tt.wantErr {
+				t.Fatalf("call = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+)
+
+// A terminal can be backed by tmux: its PTY then runs a tmux client instead
+// of the shell, and the shell lives in the tmux server. When the agent exits
+// only the client goes away, and the next agent adopts the sessions left
+// behind. Sharing an existing tmux pane works the same way, through a client
+// attached to the user's own tmux server.
+
+// tmuxSessionPrefix names the sessions of tmux-backed terminals, followed by
+// the terminal's backend ID.
+const tmuxSessionPrefix = "shellsync-"
+
+// tmuxSessionOption is the user option that tags the tmux session of a
+// terminal with the ID of the backend session it belongs to.
+const tmuxSessionOption = "@shellsync-session"
+
+// tmuxServer is the socket of a tmux server: a name as given to tmux -L, or
+// a path as given to -S. The empty name is the user's default server.
+type tmuxServer string
+
+// currentTmuxServer is the server the agent was started in, or the default
+// server outside tmux.
+func currentTmuxServer() tmuxServer {
+	path, _, _ := strings.Cut(os.Getenv("TMUX"), ",")
+	return tmuxServer(path)
+}
+
+func (s tmuxServer) command(ctx context.Context, args ...string) *exec.Cmd {
+	switch {
+	case strings.Contains(string(s), "/"):
+		args = append([]string{"-S", string(s)}, args...)
+	case s != "":
+		args = append([]string{"-L", string(s)}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "tmux", args...)
+	// Inside tmux, TMUX would make the client refuse to attach.
+	cmd.Env = unsetEnv(os.Environ(), "TMUX")
+	return cmd
+}
+
+func (s tmuxServer) output(args ...string) (string, error) {
+	out, err := s.command(context.Background(), args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return "", fmt.Errorf("tmux %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("tmux %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// environment returns the global environment of the server, or the one it
+// starts with if it is not running yet.
+func (s tmuxServer) environment() map[string]bool {
+	env := s.command(context.Background()).Env
+	if out, err := s.output("show-environment", "-g"); err == nil {
+		env = strings.Split(out, "\n")
+	}
+	set := make(map[string]bool, len(env))
+	for _, kv := range env {
+		set[kv] = true
+	}
+	return set
+}
+
+// envArgs returns the -e options that give a shell in the server the
+// environment env: the variables the server does not already pass on with
+// the same value, such as TERM and the overrides of the request.
+func (s tmuxServer) envArgs(env []string) []string {
+	base := s.environment()
+	var args []string
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		// tmux sets these for each pane itself.
+		if key == "TMUX" || key == "TMUX_PANE" || base[kv] {
+			continue
+		}
+		args = append(args, "-e", kv)
+	}
+	return args
+}
+
+// tmuxTerminal is a terminal shown through a tmux client.
+type tmuxTerminal struct {
+	server tmuxServer
+	// session is what the client attaches to.
+	session string
+	// target is the pane shared with `shellsync share --tmux`. It is empty
+	// for a session the agent created and owns.
+	target string
+}
+
+func (t *tmuxTerminal) owned() bool {
+	return t.target == ""
+}
+
+// newTmuxSession starts shell, with its environment, in a new detached
+// session for a terminal of the backend session sessionID.
+func newTmuxSession(server tmuxServer, sessionID, backendID string, shell *exec.Cmd) (*tmuxTerminal, error) {
+	t := &tmuxTerminal{server: server, session: tmuxSessionPrefix + backendID}
+	args := []string{"new-session", "-d", "-s", t.session, "-x", "80", "-y", "24"}
+	if shell.Dir != "" {
+		args = append(args, "-c", shell.Dir)
+	}
+	args = append(args, server.envArgs(shell.Env)...)
+	args = append(args, "--", shell.Path)
+	args = append(args, shell.Args[1:]...)
+	if _, err := server.output(args...); err != nil {
+		return nil, err
+	}
+	if err := t.tag(sessionID); err != nil {
+		t.kill()
+		return nil, err
+	}
+	// The viewers have their own chrome; a status line would only take a
+	// row from the terminal.
+	if _, err := server.output("set-option", "-t", "="+t.session+":", "status", "off"); err != nil {
+		log.Printf("Agent: Failed to turn off the tmux status line of %s: %v", t.session, err)
+	}
+	return t, nil
+}
+
+// tag marks the session as belonging to the backend session sessionID, so
+// only an agent of that session, or one taking over from it, adopts it.
+func (t *tmuxTerminal) tag(sessionID string) error {
+	_, err := t.server.output("set-option", "-t", "="+t.session+":", tmuxSessionOption, sessionID)
+	return err
+}
+
+// sharedTmuxTerminal checks that target, a tmux session, session:window or
+// session:window.pane, exists on the user's tmux server.
+func sharedTmuxTerminal(target string) (*tmuxTerminal, error) {
+	session, _, _ := splitTmuxTarget(target)
+	if session == "" {
+		return nil, fmt.Errorf("invalid tmux target %q", target)
+	}
+	t := &tmuxTerminal{server: currentTmuxServer(), target: target}
+	if _, err := t.server.output("has-session", "-t", "="+session); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// splitTmuxTarget splits session:window.pane into its parts.
+func splitTmuxTarget(target string) (session, window, pane string) {
+	session, rest, _ := strings.Cut(target, ":")
+	window, pane, _ = strings.Cut(rest, ".")
+	return session, window, pane
+}
+
+// attach returns the client that shows the terminal in a PTY. A shared pane
+// is shown through a session grouped with the user's, so the client can
+// look at the shared window without switching the window the user's own
+// clients show; the grouped session goes away with the client. The pane is
+// not selected, as the active pane of a window is the same for every
+// client: the client shows the pane's window, and signals go to the pane
+// by its target.
+func (t *tmuxTerminal) attach(ctx context.Context, backendID, term string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if t.owned() {
+		cmd = t.server.command(ctx, "attach-session", "-t", "="+t.session)
+	} else {
+		t.session = tmuxSessionPrefix + "view-" + backendID
+		session, window, _ := splitTmuxTarget(t.target)
+		args := []string{
+			"new-session", "-t", "=" + session, "-s", t.session,
+			";", "set-option", "destroy-unattached", "on",
+		}
+		if window != "" {
+			args = append(args, ";", "select-window", "-t", ":"+window)
+		}
+		cmd = t.server.command(ctx, args...)
+	}
+	if term != "" {
+		cmd.Env = setEnv(cmd.Env, "TERM", term)
+	}
+	return cmd
+}
+
+// kill ends a session the agent owns, and the shell in it.
+func (t *tmuxTerminal) kill() error {
+	if !t.owned() {
+		return nil
+	}
+	_, err := t.server.output("kill-session", "-t", "="+t.session)
+	return err
+}
+
+// pane is the target of the terminal's pane: the active pane of an owned
+// session, or the shared pane.
+func (t *tmuxTerminal) pane() string {
+	if t.owned() {
+		return "=" + t.session + ":"
+	}
+	return "=" + t.target
+}
+
+// foregroundGroup finds the foreground process group of the terminal's
+// pane. The PTY's own foreground group is only the tmux client.
+func (t *tmuxTerminal) foregroundGroup() (int, error) {
+	out, err := t.server.output("display-message", "-p", "-t", t.pane(), "#{pane_pid}")
+	if err != nil {
+		return 0, err
+	}
+	ps, err := exec.Command("ps", "-o", "tpgid=", "-p", out).Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the foreground job of pane process %s: %w", out, err)
+	}
+	pgid, err := strconv.Atoi(strings.TrimSpace(string(ps)))
+	if err != nil || pgid <= 0 {
+		return 0, errors.New("the pane has no foreground job")
+	}
+	return pgid, nil
+}
+
+// command builds the process a new terminal runs in its PTY: the shell, a
+// tmux client for a terminal backed by tmux, or the job.
+func (a *Agent) command(ctx context.Context, req *pb.CreateTerminalRequest) (*exec.Cmd, error) {
+	backendID := req.GetTerminalId()
+	if backendID == a.job {
+		return a.cfg.jobCommand(ctx), nil
+	}
+	t, ok := a.tmuxTerminal(backendID)
+	if !ok && a.cfg.TmuxBacked {
+		shell, err := a.cfg.command(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		a.mu.RLock()
+		sessionID := a.info.SessionID
+		a.mu.RUnlock()
+		if t, err = newTmuxSession(tmuxServer(a.cfg.TmuxSocket), sessionID, backendID, shell); err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		a.tmux[backendID] = t
+		a.mu.Unlock()
+		ok = true
+	}
+	if !ok {
+		return a.cfg.command(ctx, req)
+	}
+	if err := a.cfg.checkOverrides(req); err != nil {
+		return nil, err
+	}
+	term := req.GetTerm()
+	if term == "" && os.Getenv("TERM") == "" {
+		term = defaultTerm
+	}
+	return t.attach(ctx, backendID, term), nil
+}
+
+// dropTmux forgets the tmux side of a terminal that failed to start, ending
+// its session if the agent owns it.
+func (a *Agent) dropTmux(backendID string) {
+	a.mu.Lock()
+	t, ok := a.tmux[backendID]
+	delete(a.tmux, backendID)
+	a.mu.Unlock()
+	if ok {
+		if err := t.kill(); err != nil {
+			log.Printf("Agent: Failed to end tmux session of terminal %s: %v", backendID, err)
+		}
+	}
+}
+
+func (a *Agent) tmuxTerminal(backendID string) (*tmuxTerminal, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	t, ok := a.tmux[backendID]
+	return t, ok
+}
+
+// adoptTmuxSessions takes over the sessions of tmux-backed terminals an
+// earlier agent left behind and reports how many there were. Only sessions
+// tagged by an agent are candidates: those of this agent's own session, and
+// those of another session that no tmux client is attached to any more,
+// because the agent that served them is gone. Adopted sessions are tagged
+// with this agent's session.
+func (a *Agent) adoptTmuxSessions(ctx context.Context) int {
+	server := tmuxServer(a.cfg.TmuxSocket)
+	// tmux prints control characters such as tabs as underscores, but
+	// neither the names of these sessions nor the tags have spaces.
+	out, err := server.output("list-sessions", "-F", "#{session_name} #{session_attached} #{"+tmuxSessionOption+"}")
+	if err != nil {
+		// Also what tmux says when its server is not running.
+		return 0
+	}
+	a.mu.RLock()
+	sessionID := a.info.SessionID
+	a.mu.RUnlock()
+	adopted := 0
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		name, attached, owner := fields[0], fields[1], fields[2]
+		backendID, ok := strings.CutPrefix(name, tmuxSessionPrefix)
+		if !ok || !strings.HasPrefix(backendID, "term-") || owner == "" {
+			continue
+		}
+		if owner != sessionID && attached != "0" {
+			continue
+		}
+		t := &tmuxTerminal{server: server, session: name}
+		if err := t.tag(sessionID); err != nil {
+			log.Printf("Agent: Failed to adopt tmux session %s: %v", name, err)
+			continue
+		}
+		a.mu.Lock()
+		a.tmux[backendID] = t
+		a.mu.Unlock()
+		log.Printf("Agent: Adopting tmux session %s of session %s", name, owner)
+		if err := a.spawnNewPty(ctx, &pb.CreateTerminalRequest{TerminalId: backendID}); err != nil {
+			log.Printf("Agent: Failed to adopt tmux session %s: %v", name, err)
+			continue
+		}
+		adopted++
+	}
+	return adopted
+}
+
+func unsetEnv(env []string, key string) []string {
+	prefix := key + "="
+	kept := env[:0:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, prefix) {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
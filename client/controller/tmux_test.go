@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	pb "github.com/Ayush-Vish/shellsync/api/proto"
+)
+
+func TestSplitTmuxTarget(t *testing.T) {
+	tests := []struct {
+		target, session, window, pane string
+	}{
+		{"work", "work", "", ""},
+		{"work:1", "work", "1", ""},
+		{"work:editor.2", "work", "editor", "2"},
+		{":1", "", "1", ""},
+	}
+	for _, tt := range tests {
+		session, window, pane := splitTmuxTarget(tt.target)
+		if session != tt.session || window != tt.window || pane != tt.pane {
+			t.Errorf("splitTmuxTarget(%q) = %q, %q, %q, want %q, %q, %q",
+				tt.target, session, window, pane, tt.session, tt.window, tt.pane)
+		}
+	}
+}
+
+// waitExited waits for the agent to report that a terminal exited.
+func waitExited(t *testing.T, stream *fakeBackendStream, backendID string) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-stream.sent:
+			if msg.GetTerminalExited().GetTerminalId() == backendID {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("terminal %s did not exit", backendID)
+		}
+	}
+}
+
+// TestTmuxTerminalOutlivesAgent checks that hanging up a tmux-backed
+// terminal leaves its shell running, that a new agent adopts it, but not a
+// session no agent tagged, and that closing it for good ends the session.
+func TestTmuxTerminalOutlivesAgent(t *testing.T) {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		t.Skip("tmux is not installed")
+	}
+	t.Setenv("TMUX_TMPDIR", t.TempDir())
+	cfg := DefaultConfig()
+	cfg.TmuxBacked = true
+	cfg.AllowedOverrides = []string{OverrideEnv}
+	server := tmuxServer(cfg.TmuxSocket)
+	t.Cleanup(func() { server.output("kill-server") })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := NewAgent(cfg)
+	first.info.SessionID = "first"
+	stream := &fakeBackendStream{sent: make(chan *pb.ClientUpdate, 1024)}
+	first.attach(stream)
+	req := &pb.CreateTerminalRequest{TerminalId: "term-test", Env: map[string]string{"SHELLSYNC_TEST": "1"}}
+	if err := first.spawnNewPty(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	session := "=" + tmuxSessionPrefix + "term-test"
+	if env, err := server.output("show-environment", "-t", session, "SHELLSYNC_TEST"); err != nil || env != "SHELLSYNC_TEST=1" {
+		t.Fatalf("session environment has %q (%v), want the requested variable", env, err)
+	}
+	if err := first.hangup("term-test"); err != nil {
+		t.Fatal(err)
+	}
+	waitExited(t, stream, "term-test")
+	if _, err := server.output("has-session", "-t", session); err != nil {
+		t.Fatalf("session ended with the agent's client: %v", err)
+	}
+
+	if _, err := server.output("new-session", "-d", "-s", tmuxSessionPrefix+"term-stray"); err != nil {
+		t.Fatal(err)
+	}
+
+	second := NewAgent(cfg)
+	second.info.SessionID = "second"
+	second.attach(stream)
+	if n := second.adoptTmuxSessions(ctx); n != 1 {
+		t.Fatalf("adopted %d sessions, want 1", n)
+	}
+	if owner, err := server.output("show-options", "-v", "-t", session+":", tmuxSessionOption); owner != "second" {
+		t.Fatalf("adopted session is tagged %q (%v), want second", owner, err)
+	}
+	if err := second.closeTerminal("term-test"); err != nil {
+		t.Fatal(err)
+	}
+	waitExited(t, stream, "term-test")
+	if _, err := server.output("has-session", "-t", session); err == nil {
+		t.Fatal("session still exists after the terminal was closed")
+	}
+}
@@ -1,6 +1,46 @@
 package runner
 
-func Run(){
-	
-	
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	controller "github.com/Ayush-Vish/shellsync/client/controller"
+)
+
+// Exit statuses of Run besides the command's own, as a shell reports them.
+const (
+	exitFailure  = 1
+	exitNotFound = 127
+	exitSignaled = 128
+)
+
+// Run runs argv in a new session on the backend at host:port. Its output is
+// shared with the session's viewers as a read-only terminal and shown on
+// stdout. Run returns the status to exit with: the command's own, 128 plus
+// the signal number if a signal killed it, 127 if it could not be found and
+// 1 if the session failed.
+func Run(host string, port int, cfg controller.Config, argv []string) int {
+	if _, err := exec.LookPath(argv[0]); err != nil {
+		fmt.Fprintln(os.Stderr, "shellsync run:", err)
+		return exitNotFound
+	}
+	cfg.Job = argv
+
+	err := controller.Start(host, port, cfg)
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return exitSignaled + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	default:
+		fmt.Fprintln(os.Stderr, "shellsync run:", err)
+		return exitFailure
+	}
 }
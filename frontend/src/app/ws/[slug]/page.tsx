@@ -1,19 +1,37 @@
 'use client';
 
-import React, { useState, useRef, useCallback } from 'react';
+import React, { useState, useRef, useCallback, useEffect } from 'react';
 import InfiniteCanvas, { CanvasRef } from '@/components/canvas/InfiniteCanvas';
 import {  Maximize, TerminalIcon, Loader2 } from 'lucide-react';
 import DraggableTerminal from "@/components/terminal/DraggableTerminal";
 import { useParams, useSearchParams } from "next/navigation";
-import { useTerminalSocket, SocketMessage } from "@/hooks/useSocket";
+import { useTerminalSocket, storedToken, SocketMessage, AgentStatus, AgentNotice, Role } from "@/hooks/useSocket";
+
+export type TerminalChunk = string | Uint8Array;
+// onChunk calls done once the chunk has been rendered, which acknowledges it
+// to the server.
+export type OnChunk = (chunk: TerminalChunk, done: () => void) => void;
+export type SubscribeOutput = (terminalId: string, onChunk: OnChunk) => () => void;
+
+// Output that arrives before a terminal window has mounted (replay right
+// after session_state, for example) is kept here until it subscribes.
+const MAX_PENDING_CHUNKS = 1000;
+
+const chunkBytes = (chunk: TerminalChunk) =>
+    typeof chunk === 'string' ? new TextEncoder().encode(chunk).length : chunk.length;
 
 export interface CanvasItem {
     id: string; 
     position: { x: number; y: number };
     color: string;
     terminalId?: string; 
-    status: 'creating' | 'ready' | 'error';
+    status: 'creating' | 'ready' | 'error' | 'exited';
     error?: string;
+    exitCode?: number;
+    signal?: string;
+    // readOnly terminals, such as the command of `shellsync run`, only show
+    // output.
+    readOnly?: boolean;
 }
 
 
@@ -21,12 +39,16 @@ const Toolbar = ({
     onAddItem, 
     onReset, 
     isConnected,
-    isCreating 
+    isCreating,
+    canEdit,
+    agentLatencyMs
 }: { 
     onAddItem: () => void;
     onReset: () => void;
     isConnected: boolean;
     isCreating: boolean;
+    canEdit: boolean;
+    agentLatencyMs?: number;
 }) => (
     <div className="absolute top-4 left-4 z-10 flex items-center gap-2">
         <div className={`w-3 h-3 rounded-full ${isConnected ? 'bg-green-500' : 'bg-red-500'}`} 
@@ -34,7 +56,8 @@ const Toolbar = ({
         
         <button
             onClick={onAddItem}
-            disabled={!isConnected || isCreating}
+            disabled={!isConnected || isCreating || !canEdit}
+            title={canEdit ? undefined : 'Viewers cannot open terminals'}
             className="flex items-center gap-2 px-3 py-2 bg-blue-600 text-white rounded-md hover:bg-blue-700 disabled:bg-gray-600 disabled:cursor-not-allowed transition-colors shadow-lg"
         >
             {isCreating ? (
@@ -52,27 +75,184 @@ const Toolbar = ({
         >
             <Maximize size={18} />
         </button>
+
+        {isConnected && agentLatencyMs !== undefined && (
+            <span className="px-2 py-1 text-xs text-gray-300 bg-neutral-700 rounded-md shadow-lg"
+                  title="Round trip between the server and the host">
+                Host {Math.round(agentLatencyMs)} ms
+            </span>
+        )}
     </div>
 );
 
 
+// RolePanel lists the people in the session. The owner can make the others
+// editors or viewers from here.
+const RolePanel = ({
+    roles,
+    clientId,
+    onSetRole,
+}: {
+    roles: Record<string, Role>;
+    clientId: string;
+    onSetRole: (clientId: string, role: Role) => void;
+}) => {
+    const isOwner = roles[clientId] === 'owner';
+    return (
+        <div className="absolute top-4 right-4 z-10 bg-neutral-700 text-white text-xs rounded-md shadow-lg p-2 space-y-1">
+            {Object.entries(roles).sort(([a], [b]) => a.localeCompare(b)).map(([id, role]) => (
+                <div key={id} className="flex items-center justify-between gap-3">
+                    <span className={id === clientId ? 'font-semibold' : undefined}>
+                        {id}{id === clientId && ' (you)'}
+                    </span>
+                    {isOwner && role !== 'owner' ? (
+                        <select
+                            value={role}
+                            onChange={e => onSetRole(id, e.target.value as Role)}
+                            className="bg-neutral-800 rounded px-1"
+                        >
+                            <option value="editor">editor</option>
+                            <option value="viewer">viewer</option>
+                        </select>
+                    ) : (
+                        <span className="text-gray-300">{role}</span>
+                    )}
+                </div>
+            ))}
+        </div>
+    );
+};
+
 export default function CanvasPage() {
     const [items, setItems] = useState<CanvasItem[]>([]);
     const [isCreatingTerminal, setIsCreatingTerminal] = useState(false);
+    // Assume the host is there until the server says otherwise, so the
+    // banner does not flash on every page load.
+    const [agentStatus, setAgentStatus] = useState<AgentStatus>('connected');
+    const [agentLatencyMs, setAgentLatencyMs] = useState<number | undefined>();
+    const [agentNotice, setAgentNotice] = useState<AgentNotice | undefined>();
+    const [roles, setRoles] = useState<Record<string, Role>>({});
 
-    const [latestMessage, setLatestMessage] = useState<SocketMessage | null>(null);
     const canvasRef = useRef<CanvasRef>(null);
+    const outputSubscribers = useRef(new Map<string, OnChunk>());
+    const acknowledgeRef = useRef<(terminalId: string, bytes: number) => void>(() => {});
+    const pendingOutput = useRef(new Map<string, TerminalChunk[]>());
+
+    const subscribeOutput = useCallback<SubscribeOutput>((terminalId, onChunk) => {
+        outputSubscribers.current.set(terminalId, onChunk);
+        const pending = pendingOutput.current.get(terminalId);
+        if (pending) {
+            pendingOutput.current.delete(terminalId);
+            // Buffered output was acknowledged when it arrived.
+            pending.forEach(chunk => onChunk(chunk, () => {}));
+        }
+        return () => {
+            if (outputSubscribers.current.get(terminalId) === onChunk) {
+                outputSubscribers.current.delete(terminalId);
+            }
+        };
+    }, []);
     
     const params = useParams();
     const searchParams = useSearchParams();
     const sessionId = params.slug as string;
-    const [clientId] = useState(() => 
-        searchParams.get('client_id') || `client_${Math.random().toString(36).substr(2, 9)}`
-    );
+    // The owner's link names its client; anyone else is named by the
+    // server in the joined message.
+    const initialClientId = searchParams.get('client_id') || '';
+    const [clientId, setClientId] = useState(initialClientId);
+    // The join token from the session URL, or the one the tab kept; the
+    // backend refuses the socket without it. It is taken out of the address
+    // bar once read, so it does not linger in the history or get copied
+    // along with the page's address.
+    const [token] = useState(() => searchParams.get('token') || storedToken(sessionId));
+    useEffect(() => {
+        const url = new URL(window.location.href);
+        if (url.searchParams.has('token')) {
+            url.searchParams.delete('token');
+            window.history.replaceState(window.history.state, '', url);
+        }
+    }, []);
 
     const handleSocketMessage = useCallback((message: SocketMessage) => {
+        if (message.type === 'pty_output' && message.terminalId) {
+            const chunk = message.data ?? message.content;
+            if (!chunk) return;
+            const terminalId = message.terminalId;
+            const subscriber = outputSubscribers.current.get(terminalId);
+            if (subscriber) {
+                subscriber(chunk, () => acknowledgeRef.current(terminalId, chunkBytes(chunk)));
+            } else {
+                // Nothing renders this terminal yet, so it must not hold
+                // the terminal back for everyone else.
+                acknowledgeRef.current(terminalId, chunkBytes(chunk));
+                const pending = pendingOutput.current.get(message.terminalId) ?? [];
+                pending.push(chunk);
+                if (pending.length > MAX_PENDING_CHUNKS) pending.shift();
+                pendingOutput.current.set(message.terminalId, pending);
+            }
+            return;
+        }
+
         console.log('Canvas received socket message:', message);
-        setLatestMessage(message); 
+
+        if (message.type === 'agent_status' && message.status) {
+            setAgentStatus(message.status);
+            setAgentLatencyMs(message.status === 'connected' ? message.latencyMs : undefined);
+        }
+
+        if (message.type === 'agent_notice') {
+            setAgentNotice(message.notice);
+        }
+
+        if (message.type === 'joined' && message.clientId) {
+            setClientId(message.clientId);
+        }
+
+        if (message.type === 'role_changed' && message.clientId) {
+            const { clientId: id, role } = message;
+            setRoles(prev => {
+                const updated = { ...prev };
+                if (role) {
+                    updated[id] = role;
+                } else {
+                    delete updated[id];
+                }
+                return updated;
+            });
+        }
+
+        if (message.type === 'session_state' && message.session) {
+            const { terminals, agentStatus, agentLatencyMs, notice, roles } = message.session;
+            setAgentStatus(agentStatus);
+            setAgentLatencyMs(agentLatencyMs);
+            setAgentNotice(notice);
+            setRoles(roles ?? {});
+            setItems(prevItems => {
+                const restored = [...prevItems];
+                terminals.forEach((terminal, index) => {
+                    const existing = restored.findIndex(item =>
+                        item.terminalId === terminal.terminalId || item.id === terminal.frontendId);
+                    if (existing >= 0) {
+                        restored[existing] = {
+                            ...restored[existing],
+                            terminalId: terminal.terminalId,
+                            status: 'ready',
+                            readOnly: terminal.readOnly,
+                        };
+                        return;
+                    }
+                    restored.push({
+                        id: terminal.frontendId || terminal.terminalId,
+                        position: { x: 40 + (index % 3) * 680, y: 80 + Math.floor(index / 3) * 440 },
+                        color: "#4bd2f3",
+                        terminalId: terminal.terminalId,
+                        status: 'ready',
+                        readOnly: terminal.readOnly,
+                    });
+                });
+                return restored;
+            });
+        }
         
         if (message.type === 'terminal_created' && message.terminalId && message.frontendId) {
             setItems(prevItems =>
@@ -82,6 +262,7 @@ export default function CanvasPage() {
                             ...item,
                             terminalId: message.terminalId,
                             status: 'ready' as const,
+                            readOnly: message.readOnly,
                         };
                     }
                     return item;
@@ -99,6 +280,25 @@ export default function CanvasPage() {
                 )
             );
             setIsCreatingTerminal(false);
+        } else if (message.type === 'terminal_error' && message.terminalId) {
+            // An error about a running terminal, such as a signal the agent
+            // could not deliver: show it without tearing the window down.
+            setItems(prevItems =>
+                prevItems.map(item =>
+                    item.terminalId === message.terminalId
+                        ? { ...item, error: message.error }
+                        : item
+                )
+            );
+        }
+        if (message.type === 'terminal_exited' && message.terminalId) {
+            setItems(prevItems =>
+                prevItems.map(item =>
+                    item.terminalId === message.terminalId
+                        ? { ...item, status: 'exited' as const, exitCode: message.exitCode, signal: message.signal }
+                        : item
+                )
+            );
         }
     }, []);
 
@@ -116,17 +316,31 @@ export default function CanvasPage() {
    
      const { 
         sendMessage,
+        sendInput,
+        acknowledgeOutput,
         isConnected,
     } = useTerminalSocket(
         sessionId,
-        clientId,
+        initialClientId,
+        token,
         handleSocketMessage,
         handleTerminalCreated,
         handleError
     );
 
+    useEffect(() => {
+        acknowledgeRef.current = acknowledgeOutput;
+    }, [acknowledgeOutput]);
+
+    // The server enforces roles; this only keeps viewers from trying.
+    const canEdit = roles[clientId] === 'owner' || roles[clientId] === 'editor';
+
+    const handleSetRole = useCallback((id: string, role: Role) => {
+        sendMessage('set_role', JSON.stringify({ clientId: id, role }));
+    }, [sendMessage]);
+
     const handleAddItem = useCallback(() => {
-        if (!isConnected || isCreatingTerminal) return;
+        if (!isConnected || isCreatingTerminal || !canEdit) return;
         
         setIsCreatingTerminal(true);
          const frontendId = `item-${Date.now()}-${Math.random().toString(36).substr(2, 9)}`;
@@ -144,7 +358,7 @@ export default function CanvasPage() {
 
         sendMessage('create_terminal', JSON.stringify(payload)); 
 
-    }, [isConnected, isCreatingTerminal, sendMessage]); 
+    }, [isConnected, isCreatingTerminal, canEdit, sendMessage]); 
 
     const handleResetView = useCallback(() => {
         canvasRef.current?.resetView();
@@ -158,9 +372,23 @@ export default function CanvasPage() {
         );
     }, []);
 
+    const handleClearError = useCallback((id: string) => {
+        setItems(currentItems =>
+            currentItems.map(item =>
+                item.id === id && item.status === 'ready' ? { ...item, error: undefined } : item
+            )
+        );
+    }, []);
+
     const handleRemoveItem = useCallback((id: string) => {
+        const item = items.find(i => i.id === id);
+        // A read-only terminal ends with its command; closing its window
+        // only hides it here.
+        if (item?.terminalId && item.status === 'ready' && !item.readOnly && canEdit) {
+            sendMessage('close_terminal', undefined, item.terminalId);
+        }
         setItems(currentItems => currentItems.filter(item => item.id !== id));
-    }, []);
+    }, [items, canEdit, sendMessage]);
 
     return (
         <div className="h-screen w-screen bg-neutral-800">
@@ -169,28 +397,53 @@ export default function CanvasPage() {
                 onReset={handleResetView}
                 isConnected={isConnected}
                 isCreating={isCreatingTerminal}
+                canEdit={canEdit}
+                agentLatencyMs={agentStatus === 'connected' ? agentLatencyMs : undefined}
             />
             
             <InfiniteCanvas ref={canvasRef}>
                 {items.map((item) => (
                     <DraggableTerminal
                         key={item.id}
-                        item={item}
+                        item={canEdit ? item : { ...item, readOnly: true }}
                         onPositionChange={handlePositionChange}
                         onRemove={handleRemoveItem}
+                        onClearError={handleClearError}
                         sessionId={sessionId}
                         clientId={clientId}
                         sendMessage={sendMessage}
-                        latestMessage={latestMessage}
+                        sendInput={sendInput}
+                        subscribeOutput={subscribeOutput}
                     />
                 ))}
             </InfiniteCanvas>
+
+            <RolePanel roles={roles} clientId={clientId} onSetRole={handleSetRole} />
             
+            {agentNotice && (
+                <div className="absolute top-4 left-1/2 -translate-x-1/2 z-10 bg-orange-600 text-white px-4 py-2 rounded-md shadow-lg text-sm">
+                    {agentNotice.message}
+                    {!agentNotice.final && (
+                        <span className="ml-2 text-orange-200">
+                            (at {new Date(agentNotice.deadline).toLocaleTimeString()})
+                        </span>
+                    )}
+                </div>
+            )}
+
             {!isConnected && (
                 <div className="absolute bottom-4 left-4 bg-red-600 text-white px-4 py-2 rounded-md shadow-lg">
                     Disconnected from server
                 </div>
             )}
+
+            {isConnected && agentStatus !== 'connected' && (
+                <div className="absolute bottom-4 left-4 bg-yellow-600 text-white px-4 py-2 rounded-md shadow-lg">
+                    {agentStatus === 'reconnecting'
+                        ? 'Host connection lost. Waiting for it to come back...'
+                        : 'Host is offline. Terminals are unavailable.'}
+                </div>
+            )}
         </div>
     );
 }
@@ -4,16 +4,22 @@ import React, { useCallback, useRef, useEffect } from "react";
 import Xterm, { XtermRef } from "@/components/terminal/Terminal";
 // Remove useTerminalSocket import
 import { SocketMessage } from "@/hooks/useSocket";
-import { CanvasItem } from "@/app/ws/[slug]/page";
+import { CanvasItem, SubscribeOutput } from "@/app/ws/[slug]/page";
 import { Loader2, AlertCircle, X } from "lucide-react";
 
+// Signals offered in the terminal header; the agent delivers them to the
+// foreground job.
+const SIGNALS = ["SIGINT", "SIGTERM", "SIGHUP", "SIGKILL"];
+
 interface DraggableTerminalProps {
   item: CanvasItem;
   onPositionChange: (id: string, position: { x: number; y: number }) => void;
   onRemove: (id: string) => void;
+  onClearError?: (id: string) => void;
   // Add these new props
   sendMessage: (type: SocketMessage['type'], content?: string, terminalId?: string) => void;
-  latestMessage: SocketMessage | null;
+  sendInput: (terminalId: string, data: string) => void;
+  subscribeOutput: SubscribeOutput;
 
   zoom?: number;
   setCanvasPanningLocked?: (isLocked: boolean) => void;
@@ -25,9 +31,11 @@ const DraggableTerminal = ({
   item,
   onPositionChange,
   onRemove,
+  onClearError,
   // Destructure the new props
   sendMessage,
-  latestMessage,
+  sendInput,
+  subscribeOutput,
   zoom = 1,
   setCanvasPanningLocked,
 
@@ -42,27 +50,41 @@ const DraggableTerminal = ({
   // const handleSocketMessage = ...
   // const { sendMessage } = useTerminalSocket(...)
 
-  // NEW: Use an effect to listen to messages passed from the parent
+  // Write this terminal's output, including anything buffered before the
+  // window mounted, straight into xterm, and acknowledge it once rendered.
   useEffect(() => {
-    if (
-      latestMessage &&
-      latestMessage.type === "pty_output" &&
-      latestMessage.content &&
-      latestMessage.terminalId === item.terminalId &&
-      item.status === 'ready'
-    ) {
-      xTermRef.current?.write(latestMessage.content);
-    }
-  }, [latestMessage, item.terminalId, item.status]);
+    if (!item.terminalId || item.status !== 'ready') return;
+    return subscribeOutput(item.terminalId, (chunk, done) => {
+      if (xTermRef.current) {
+        xTermRef.current.write(chunk, done);
+      } else {
+        done();
+      }
+    });
+  }, [subscribeOutput, item.terminalId, item.status]);
 
 
   const handleTerminalData = useCallback((data: string) => {
+    if (item.terminalId && item.status === 'ready' && !item.readOnly) {
+      sendInput(item.terminalId, data);
+    }
+  }, [sendInput, item.terminalId, item.status, item.readOnly]);
+
+  const handleTerminalResize = useCallback((rows: number, cols: number) => {
     if (item.terminalId && item.status === 'ready') {
-      // Use the sendMessage function passed via props
-      sendMessage("pty_input", data, item.terminalId);
+      sendMessage("resize", JSON.stringify({ rows, cols }), item.terminalId);
     }
   }, [sendMessage, item.terminalId, item.status]);
 
+  const handleSignal = useCallback((e: React.ChangeEvent<HTMLSelectElement>) => {
+    const signal = e.target.value;
+    e.target.value = "";
+    if (signal && item.terminalId && item.status === 'ready') {
+      onClearError?.(item.id);
+      sendMessage("signal", signal, item.terminalId);
+    }
+  }, [sendMessage, onClearError, item.id, item.terminalId, item.status]);
+
   // ... rest of the component is unchanged (handlePointerDown, handleClose, renderTerminalContent, etc.)
   // ...
   // ...
@@ -70,7 +92,7 @@ const DraggableTerminal = ({
     if (e.button !== 0) return;
     
     const target = e.target as HTMLElement;
-    if (target.closest('.close-button')) return;
+    if (target.closest('.close-button, .signal-menu')) return;
 
     setCanvasPanningLocked?.(true);
     e.stopPropagation();
@@ -145,9 +167,10 @@ const DraggableTerminal = ({
         );
       
       case 'ready':
+      case 'exited':
         return (
           <div className="flex-grow w-full h-full">
-            <Xterm onData={handleTerminalData} ref={xTermRef} />
+            <Xterm onData={handleTerminalData} onResize={handleTerminalResize} readOnly={item.readOnly} ref={xTermRef} />
           </div>
         );
       
@@ -161,6 +184,7 @@ const DraggableTerminal = ({
       case 'creating': return 'bg-yellow-500';
       case 'error': return 'bg-red-500';
       case 'ready': return 'bg-green-500';
+      case 'exited': return 'bg-gray-500';
       default: return 'bg-gray-500';
     }
   };
@@ -190,9 +214,17 @@ const DraggableTerminal = ({
         </div>
         
         <div className="flex-grow text-center text-gray-400 text-xs font-sans">
-          {item.status === 'ready' && item.terminalId ? (
+          {item.status === 'exited' ? (
+            <span title={`Terminal ID: ${item.terminalId}`}>
+              {item.signal ? `Killed by ${item.signal}` : `Exited with code ${item.exitCode ?? 0}`}
+            </span>
+          ) : item.status === 'ready' && item.error ? (
+            <span className="text-red-400" title={`Terminal ID: ${item.terminalId}`}>
+              {item.error}
+            </span>
+          ) : item.status === 'ready' && item.terminalId ? (
             <span title={`Terminal ID: ${item.terminalId}`}>
-              Terminal: {item.terminalId.substring(0, 8)}...
+              Terminal: {item.terminalId.substring(0, 8)}...{item.readOnly && ' (read-only)'}
             </span>
           ) : (
             <span title={`Item ID: ${item.id}`}>
@@ -203,6 +235,19 @@ const DraggableTerminal = ({
           )}
         </div>
         
+        {item.status === 'ready' && !item.readOnly && (
+          <select
+            onChange={handleSignal}
+            defaultValue=""
+            className="signal-menu mr-2 bg-transparent text-gray-400 text-xs hover:text-white outline-none cursor-pointer"
+            title="Send a signal to the running job"
+          >
+            <option value="" disabled>Signal</option>
+            {SIGNALS.map(signal => (
+              <option key={signal} value={signal}>{signal}</option>
+            ))}
+          </select>
+        )}
 
         <button
           onClick={handleClose}
@@ -8,22 +8,28 @@ import 'xterm/css/xterm.css';
 // Define the props the component will accept from its parent
 interface XtermProps {
   onData: (data: string) => void; // Callback to send user input to the parent
+  onResize?: (rows: number, cols: number) => void; // Callback to report the fitted size
+  readOnly?: boolean; // Show output only and ignore keystrokes
 }
 
 // Define the methods that the parent can call on this component via a ref
 export interface XtermRef {
-  write: (data: string) => void;
+  write: (data: string | Uint8Array, callback?: () => void) => void;
   focus: () => void;
 }
 
-const Xterm = forwardRef<XtermRef, XtermProps>(({ onData }, ref) => {
+const Xterm = forwardRef<XtermRef, XtermProps>(({ onData, onResize, readOnly }, ref) => {
   const terminalRef = useRef<HTMLDivElement>(null);
   const termRef = useRef<XTerminal | null>(null);
 
   // Expose the 'write' and 'focus' methods to the parent component
   useImperativeHandle(ref, () => ({
-    write: (data: string) => {
-      termRef.current?.write(data);
+    write: (data: string | Uint8Array, callback?: () => void) => {
+      if (termRef.current) {
+        termRef.current.write(data, callback);
+      } else {
+        callback?.();
+      }
     },
     focus: () => {
       termRef.current?.focus();
@@ -49,8 +55,12 @@ const Xterm = forwardRef<XtermRef, XtermProps>(({ onData }, ref) => {
     const fitAddon = new FitAddon();
     term.loadAddon(fitAddon);
 
+    // Report every size change so the agent PTY matches what xterm renders.
+    term.onResize(({ rows, cols }) => onResize?.(rows, cols));
+
     term.open(terminalRef.current);
     fitAddon.fit();
+    onResize?.(term.rows, term.cols);
     term.focus();
 
     // This is the crucial change:
@@ -65,7 +75,14 @@ const Xterm = forwardRef<XtermRef, XtermProps>(({ onData }, ref) => {
       window.removeEventListener('resize', handleResize);
       term.dispose();
     };
-  }, [onData]);
+  }, [onData, onResize]);
+
+  // Also reapplied whenever the effect above creates a new terminal.
+  useEffect(() => {
+    if (termRef.current) {
+      termRef.current.options.disableStdin = !!readOnly;
+    }
+  }, [readOnly, onData, onResize]);
 
   return <div ref={terminalRef} className="h-full w-full" />;
 });
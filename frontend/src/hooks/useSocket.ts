@@ -1,13 +1,68 @@
 import { useEffect, useRef, useCallback, useState } from 'react';
+import { PTY_ENCODING, base64ToBytes, bytesToBase64, stringToBase64 } from '@/lib/terminal';
 
 
 export interface SocketMessage {
-    type: 'terminal_created' | 'pty_output' | 'pty_input' | 'create_terminal' | 'terminal_error';
+    type: 'terminal_created' | 'pty_output' | 'pty_input' | 'create_terminal' | 'terminal_error' | 'resize'
+        | 'close_terminal' | 'terminal_exited' | 'session_state' | 'signal' | 'agent_status' | 'ack' | 'input_ack'
+        | 'agent_notice' | 'role_changed' | 'set_role' | 'joined';
     content?: string;
+    data?: Uint8Array;
+    encoding?: string;
     terminalId?: string;
     frontendId?: string;
     error?: string;
     sender?: string;
+    exitCode?: number;
+    signal?: string;
+    replay?: boolean;
+    session?: SessionState;
+    status?: AgentStatus;
+    latencyMs?: number;
+    bytes?: number;
+    readOnly?: boolean;
+    notice?: AgentNotice;
+    // clientId and role are the payload of role_changed, where an empty
+    // role means the client left, and of joined, which tells this client
+    // its own ID and role.
+    clientId?: string;
+    role?: Role | '';
+    // token is the join token for the ID in joined, if the server named
+    // this client; rejoining with it keeps the ID.
+    token?: string;
+}
+
+// Viewers only watch, editors also use the terminals, and the owner can also
+// change the roles of others.
+export type Role = 'owner' | 'editor' | 'viewer';
+
+export type AgentStatus = 'connected' | 'reconnecting' | 'disconnected';
+
+// AgentNotice warns that the host will end the session, for instance after
+// its idle timeout; final is set once it does.
+export interface AgentNotice {
+  reason: string;
+  message: string;
+  deadline: string;
+  final?: boolean;
+}
+
+export interface SessionState {
+  sessionId: string;
+  host: string;
+  agentStatus: AgentStatus;
+  agentLatencyMs?: number;
+  terminals: {
+    terminalId: string;
+    frontendId?: string;
+    createdAt: string;
+    rows?: number;
+    cols?: number;
+    readOnly?: boolean;
+  }[];
+  participants: string[];
+  roles: Record<string, Role>;
+  notice?: AgentNotice;
 }
 
 export interface TerminalInfo {
@@ -20,19 +75,58 @@ export interface TerminalInfo {
 
 // eslint-disable-next-line @typescript-eslint/no-explicit-any
 function normalizeMessage(data: any): SocketMessage {
+  const isBinary = data.encoding === PTY_ENCODING && typeof data.content === 'string';
   return {
     type: data.type,
-    content: data.content,
+    content: isBinary ? undefined : data.content,
+    data: isBinary ? base64ToBytes(data.content) : undefined,
     terminalId: data.terminalId || data.terminal_id, 
     frontendId: data.frontendId || data.frontend_id, 
     error: data.error,
     sender: data.sender,
+    exitCode: data.exitCode ?? data.exit_code,
+    signal: data.signal,
+    replay: data.replay,
+    session: data.session,
+    status: data.status,
+    latencyMs: data.latencyMs,
+    bytes: data.bytes,
+    readOnly: data.readOnly,
+    notice: data.notice,
+    clientId: data.clientId,
+    role: data.role,
+    token: data.token,
   };
 }
 
+// Flow control. Output is acknowledged once xterm has rendered it, which is
+// what lets the host pause a flooding program instead of the server dropping
+// its output. Input beyond INPUT_WINDOW unacknowledged bytes per terminal
+// waits here instead of piling up on the server.
+const ACK_BYTES = 16 * 1024;
+const ACK_DELAY_MS = 20;
+const INPUT_WINDOW = 64 * 1024;
+
+interface InputState {
+  outstanding: number;
+  queued: Uint8Array[];
+}
+
+// The join token is kept per tab, so the page can take it out of its URL and
+// still rejoin after a reload.
+const tokenKey = (sessionId: string) => `shellsync-token:${sessionId}`;
+
+export function storedToken(sessionId: string): string {
+  return typeof window === 'undefined' ? '' : window.sessionStorage.getItem(tokenKey(sessionId)) || '';
+}
+
+// clientId and token are what the page was opened with. A shared link has
+// no client ID, and the server names the client when it joins; the socket
+// then rejoins as that client.
 export function useTerminalSocket(
     sessionId: string,
     clientId: string,
+    token: string,
     onMessage: (msg: SocketMessage) => void,
     onTerminalCreated?: (terminalId: string) => void,
     onError?: (error: string) => void
@@ -42,6 +136,66 @@ export function useTerminalSocket(
   const [isConnected, setIsConnected] = useState(false);
   const [connectionAttempts, setConnectionAttempts] = useState(0);
   const [terminals, setTerminals] = useState<Map<string, TerminalInfo>>(new Map());
+  const pendingAcks = useRef(new Map<string, number>());
+  const ackTimeoutRef = useRef<NodeJS.Timeout | null>(null);
+  const inputState = useRef(new Map<string, InputState>());
+  const identity = useRef({ clientId, token });
+
+  useEffect(() => {
+    if (token) {
+      window.sessionStorage.setItem(tokenKey(sessionId), token);
+    }
+  }, [sessionId, token]);
+
+  const flushAcks = useCallback(() => {
+    if (ackTimeoutRef.current) {
+      clearTimeout(ackTimeoutRef.current);
+      ackTimeoutRef.current = null;
+    }
+    const ws = wsRef.current;
+    if (ws?.readyState === WebSocket.OPEN) {
+      pendingAcks.current.forEach((bytes, terminalId) => {
+        ws.send(JSON.stringify({ type: 'ack', terminalId, content: String(bytes), sender: identity.current.clientId }));
+      });
+    }
+    pendingAcks.current.clear();
+  }, []);
+
+  const acknowledgeOutput = useCallback((terminalId: string, bytes: number) => {
+    if (bytes <= 0) return;
+    const total = (pendingAcks.current.get(terminalId) ?? 0) + bytes;
+    pendingAcks.current.set(terminalId, total);
+    if (total >= ACK_BYTES) {
+      flushAcks();
+    } else if (!ackTimeoutRef.current) {
+      ackTimeoutRef.current = setTimeout(flushAcks, ACK_DELAY_MS);
+    }
+  }, [flushAcks]);
+
+  const flushInput = useCallback((terminalId: string) => {
+    const state = inputState.current.get(terminalId);
+    const ws = wsRef.current;
+    if (!state || ws?.readyState !== WebSocket.OPEN) return;
+    while (state.queued.length > 0) {
+      const room = INPUT_WINDOW - state.outstanding;
+      if (room <= 0) break;
+      const chunk = state.queued[0];
+      const part = chunk.length <= room ? chunk : chunk.subarray(0, room);
+      if (part === chunk) {
+        state.queued.shift();
+      } else {
+        state.queued[0] = chunk.subarray(room);
+      }
+      state.outstanding += part.length;
+      ws.send(JSON.stringify({
+        type: 'pty_input',
+        content: bytesToBase64(part),
+        encoding: PTY_ENCODING,
+        sender: identity.current.clientId,
+        terminalId,
+      }));
+    }
+  }, []);
 
 
   const connect = useCallback(() => {
@@ -50,8 +204,11 @@ export function useTerminalSocket(
       return;
     }
 
-    const wsUrl = `ws://localhost:5000/ws?session_id=${sessionId}&client_id=${clientId}`;
-    console.log(`Attempting to connect to WebSocket: ${wsUrl} (attempt ${connectionAttempts + 1})`);
+    const { clientId, token } = identity.current;
+    const clientParam = clientId ? `&client_id=${encodeURIComponent(clientId)}` : '';
+    const wsUrl = `ws://localhost:5000/ws?session_id=${sessionId}${clientParam}&token=${encodeURIComponent(token)}&encoding=${PTY_ENCODING}&flow=ack`;
+    // The URL carries the token, so it is not logged.
+    console.log(`Attempting to connect to session ${sessionId} (attempt ${connectionAttempts + 1})`);
 
     try {
       const ws = new WebSocket(wsUrl);
@@ -61,6 +218,13 @@ export function useTerminalSocket(
         setIsConnected(true);
         setConnectionAttempts(0);
 
+        // A new connection starts flow control over; send what was held back.
+        pendingAcks.current.clear();
+        inputState.current.forEach((state, terminalId) => {
+          state.outstanding = 0;
+          flushInput(terminalId);
+        });
+
 
         if (reconnectTimeoutRef.current) {
           clearTimeout(reconnectTimeoutRef.current);
@@ -71,17 +235,32 @@ export function useTerminalSocket(
       ws.onmessage = (event) => {
         try {
           const rawData = JSON.parse(event.data);
-          console.log('Raw WebSocket message:', rawData);
-          
+
           // Normalize the message format
           const data: SocketMessage = normalizeMessage(rawData);
-          console.log('Normalized WebSocket message:', data);
-          
+
+          if (data.type === 'joined' && data.clientId) {
+            identity.current = { clientId: data.clientId, token: data.token || identity.current.token };
+            window.sessionStorage.setItem(tokenKey(sessionId), identity.current.token);
+          }
 
           if (data.type === 'terminal_created' && data.terminalId) {
             onTerminalCreated?.(data.terminalId);
           }
 
+          if (data.type === 'input_ack' && data.terminalId) {
+            const state = inputState.current.get(data.terminalId);
+            if (state) {
+              state.outstanding = Math.max(0, state.outstanding - (data.bytes ?? 0));
+              flushInput(data.terminalId);
+            }
+            return;
+          }
+
+          if (data.type === 'terminal_exited' && data.terminalId) {
+            inputState.current.delete(data.terminalId);
+          }
+
 
 
           if (data.type === 'terminal_error') {
@@ -107,7 +286,7 @@ export function useTerminalSocket(
           
           onMessage(data); 
         } catch (error) {
-          console.error('Failed to parse incoming WebSocket message:', event.data, error);
+          console.error('Failed to parse incoming WebSocket message:', error);
         }
       };
 
@@ -144,11 +323,11 @@ export function useTerminalSocket(
         reconnectTimeoutRef.current = setTimeout(connect, 3000);
       }
     }
-  }, [sessionId, clientId, onMessage, onTerminalCreated, onError, connectionAttempts]);
+  }, [sessionId, onMessage, onTerminalCreated, onError, connectionAttempts, flushInput]);
 
 
   useEffect(() => {
-    if (sessionId && clientId) {
+    if (sessionId) {
       connect();
     }
 
@@ -164,7 +343,7 @@ export function useTerminalSocket(
         setIsConnected(false);
       }
     };
-  }, [sessionId, clientId, connect]);
+  }, [sessionId, connect]);
 
 
   const sendMessage = useCallback((type: SocketMessage['type'], content?: string, terminalId?: string) => {
@@ -172,17 +351,20 @@ export function useTerminalSocket(
       const message: SocketMessage = {
         type,
         content,
-        sender: clientId,
+        sender: identity.current.clientId,
         terminalId,
       };
-      console.log('Sending WebSocket message:', message);
+      if (type === 'pty_input' && content !== undefined) {
+        message.content = stringToBase64(content);
+        message.encoding = PTY_ENCODING;
+      }
       wsRef.current.send(JSON.stringify(message));
       return true;
     } else {
       const state = wsRef.current?.readyState;
       const stateNames = ['CONNECTING', 'OPEN', 'CLOSING', 'CLOSED'];
       const stateName = state !== undefined ? stateNames[state] : 'UNDEFINED';
-      console.warn(`WebSocket not connected (state: ${stateName}). Message not sent:`, { type, content, terminalId });
+      console.warn(`WebSocket not connected (state: ${stateName}). Message not sent:`, { type, terminalId });
 
       if (state === WebSocket.CLOSED || state === undefined) {
         console.log('Attempting to reconnect...');
@@ -190,9 +372,19 @@ export function useTerminalSocket(
       }
       return false;
     }
-  }, [clientId, connect]);
+  }, [connect]);
 
 
+  const sendInput = useCallback((terminalId: string, data: string) => {
+    let state = inputState.current.get(terminalId);
+    if (!state) {
+      state = { outstanding: 0, queued: [] };
+      inputState.current.set(terminalId, state);
+    }
+    state.queued.push(new TextEncoder().encode(data));
+    flushInput(terminalId);
+  }, [flushInput]);
+
   const createTerminal = useCallback(() => {
     const tempId = `temp_${Date.now()}_${Math.random().toString(36).substr(2, 9)}`;
     
@@ -247,6 +439,8 @@ export function useTerminalSocket(
 
   return {
     sendMessage,
+    sendInput,
+    acknowledgeOutput,
     createTerminal,
     getTerminalInfo,
     removeTerminal,
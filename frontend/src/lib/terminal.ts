@@ -0,0 +1,24 @@
+// PTY bytes travel as base64 so that invalid UTF-8, split multibyte
+// characters and raw escape sequences reach xterm untouched.
+export const PTY_ENCODING = 'base64';
+
+export function base64ToBytes(content: string): Uint8Array {
+  const binary = atob(content);
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) {
+    bytes[i] = binary.charCodeAt(i);
+  }
+  return bytes;
+}
+
+export function bytesToBase64(bytes: Uint8Array): string {
+  let binary = '';
+  for (let i = 0; i < bytes.length; i++) {
+    binary += String.fromCharCode(bytes[i]);
+  }
+  return btoa(binary);
+}
+
+export function stringToBase64(data: string): string {
+  return bytesToBase64(new TextEncoder().encode(data));
+}
@@ -0,0 +1,140 @@
+// Package tlstest provides what the tests of the backend's and the agent's
+// TLS settings share: a CA that issues certificates to files, and a gRPC
+// server to dial with them.
+package tlstest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// CA signs certificates for tests and writes them to files.
+type CA struct {
+	Cert *x509.Certificate
+	// File is the CA's certificate in PEM.
+	File string
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+var serial atomic.Int64
+
+// NewCA returns a self-signed CA named name, with its files in a temporary
+// directory of t.
+func NewCA(t testing.TB, name string) *CA {
+	t.Helper()
+	ca := &CA{dir: t.TempDir()}
+	ca.Cert, ca.key, ca.File = ca.sign(t, name, &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+// Issue returns the files of a certificate for name and its key, for a
+// server if server is set, otherwise for a client.
+func (ca *CA) Issue(t testing.TB, name string, server bool) (certFile, keyFile string) {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.DNSNames = []string{name}
+	}
+	_, key, certFile := ca.sign(t, name, tmpl)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile = filepath.Join(ca.dir, name+".key")
+	writePEM(t, keyFile, "EC PRIVATE KEY", der)
+	return certFile, keyFile
+}
+
+// sign completes tmpl for name, signs it with the CA, or by itself if there
+// is no CA yet, and writes it to a file.
+func (ca *CA) sign(t testing.TB, name string, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(serial.Add(1))
+	tmpl.Subject = pkix.Name{CommonName: name}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := tmpl, key
+	if ca.Cert != nil {
+		parent, signer = ca.Cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(ca.dir, name+".pem")
+	writePEM(t, file, "CERTIFICATE", der)
+	return cert, key, file
+}
+
+func writePEM(t testing.TB, file, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Serve starts a gRPC server with opts on a local port until t ends, and
+// returns its address by the name localhost, which server certificates
+// are issued for.
+func Serve(t testing.TB, opts ...grpc.ServerOption) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return "localhost:" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// Call makes an RPC to a server started by Serve with creds.
+func Call(t testing.TB, addr string, creds credentials.TransportCredentials) error {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}